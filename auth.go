@@ -2,7 +2,10 @@ package auth
 
 import (
   "fmt"
+  "errors"
   "time"
+  "context"
+  "sort"
   "strings"
   "net/http"
   "gopkg.in/yaml.v2"
@@ -29,15 +32,46 @@ type AuthInterface interface {
   Enabled() bool
   
   Login(login string, password string) (base.User, bool)
+  // LoginContext returns when ctx is done even if the server does not answer
+  LoginContext(ctx context.Context, login string, password string) (base.User, bool)
   
   OAuthLogin(w http.ResponseWriter, r *http.Request)
   OAuthCallback(w http.ResponseWriter, r *http.Request)
   OAuthGetUserData(code string) ([]byte, error)
+  OAuthGetUserDataContext(ctx context.Context, code string) ([]byte, error)
+
+  // CheckUserGroups checks the user against check_groups of the provider
+  CheckUserGroups(user *base.User) bool
+}
+
+// PasswordChanger is implemented by the providers which change the passwords of the users
+type PasswordChanger interface {
+  ChangePassword(ctx context.Context, login string, oldPassword string, newPassword string) error
+}
+
+// Authenticator is implemented by the providers which return the reason of the failed login
+type Authenticator interface {
+  Authenticate(ctx context.Context, login string, password string) (base.User, error)
+}
+
+// UserLookup is implemented by the providers which read the user without the password
+type UserLookup interface {
+  LookupUser(ctx context.Context, login string) (base.User, error)
 }
 
+var (
+  ErrAuthNotFound             = errors.New("ERR: AUTH: Provider not found")
+  ErrUserChanged              = errors.New("ERR: AUTH: User has another ID in the provider")
+  ErrPasswordChangeNotAllowed = errors.New("ERR: AUTH: Provider does not change the passwords")
+  ErrPasswordLoginNotAllowed  = errors.New("ERR: AUTH: Provider does not log in with the password")
+  ErrLoginFailed              = errors.New("ERR: AUTH: Login failed")
+)
+
 type Auth struct {
   ai          map[string]AuthInterface
   hasOAuth    bool
+  // Called after the password is changed, see OnPasswordChanged
+  onPasswordChanged func(user *base.User)
 }
 
 func New() (*Auth) {
@@ -145,28 +179,110 @@ func (a *Auth) ToJSONOAuth() string {
 }
 
 func (a *Auth) AuthUser(code string, params *map[string]string) (base.User, bool) {
-  ok := false
+  return a.AuthUserContext(context.Background(), code, params)
+}
+
+func (a *Auth) AuthUserContext(ctx context.Context, code string, params *map[string]string) (base.User, bool) {
+  user, err := a.Authenticate(ctx, code, params)
+  return user, err == nil
+}
+
+// Authenticate is AuthUserContext with the reason of the failure,
+// f.e. openldap.ErrPasswordExpired or openldap.ErrAccountLocked
+func (a *Auth) Authenticate(ctx context.Context, code string, params *map[string]string) (base.User, error) {
+  var err error
   user := base.User{}
   mod := a.Get(code)
   if mod == nil {
 	  glog.Errorf("ERR: AuthUser(): Code(%s) not found", code)
-	  return user, false
+	  return user, ErrAuthNotFound
   }
   switch (*mod).Type() {
     case "openldap":
-      if (*mod).Connected() {
-        user, ok = (*mod).Login((*params)["login"], (*params)["password"])
+      if !(*mod).Connected() {
+        err = openldap.ErrNotConnected
+        break
+      }
+      if au, ok := (*mod).(Authenticator); ok {
+        user, err = au.Authenticate(ctx, (*params)["login"], (*params)["password"])
+        break
+      }
+      ok := false
+      if user, ok = (*mod).LoginContext(ctx, (*params)["login"], (*params)["password"]); !ok {
+        err = ErrLoginFailed
       }
       break
     default:
       glog.Errorf("ERR: AuthUser(%s)", code)
+      err = ErrPasswordLoginNotAllowed
       break;
   }
-  if !ok {
-    user.AuthCode  = code
+  user.AuthCode = code
+  if err != nil {
     user.TimeLogin = time.Now()
   }
-  return user, ok
+  return user, err
+}
+
+// ChangePassword changes the password by the provider, f.e. openldap
+func (a *Auth) ChangePassword(ctx context.Context, code string, login string, oldPassword string, newPassword string) error {
+  mod := a.Get(code)
+  if mod == nil {
+    glog.Errorf("ERR: ChangePassword(): Code(%s) not found", code)
+    return ErrAuthNotFound
+  }
+  pc, ok := (*mod).(PasswordChanger)
+  if !ok {
+    return ErrPasswordChangeNotAllowed
+  }
+  if err := pc.ChangePassword(ctx, login, oldPassword, newPassword); err != nil {
+    return err
+  }
+  if a.onPasswordChanged != nil {
+    user := base.User{Login: login}
+    if ul, ok := (*mod).(UserLookup); ok {
+      if found, err := ul.LookupUser(ctx, login); err == nil {
+        user = found
+      } else if glog.V(2) {
+        glog.Warningf("WRN: ChangePassword(%s): LookupUser: %v", login, err)
+      }
+    }
+    user.AuthCode = code
+    a.onPasswordChanged(&user)
+  }
+  return nil
+}
+
+// OnPasswordChanged sets the callback called after ChangePassword, f.e. to log out
+// the other sessions of the user with Session.RevokeUser(user.ID, currentToken).
+// The user is read from the provider, only Login and AuthCode are set when it fails
+func (a *Auth) OnPasswordChanged(fn func(user *base.User)) {
+  a.onPasswordChanged = fn
+}
+
+// ReloadUser reads the user from the provider of user.AuthCode again, f.e. for Session.SetUserReload.
+// The providers without UserLookup return the user as it is
+func (a *Auth) ReloadUser(ctx context.Context, user *base.User) (*base.User, error) {
+  mod := a.Get(user.AuthCode)
+  if mod == nil {
+    glog.Errorf("ERR: ReloadUser(): Code(%s) not found", user.AuthCode)
+    return nil, ErrAuthNotFound
+  }
+  ul, ok := (*mod).(UserLookup)
+  if !ok {
+    res := *user
+    return &res, nil
+  }
+  res, err := ul.LookupUser(ctx, user.Login)
+  if err != nil {
+    return nil, err
+  }
+  if res.ID != user.ID {
+    return nil, ErrUserChanged
+  }
+  res.AuthCode = user.AuthCode
+  res.TimeLogin = time.Now()
+  return &res, nil
 }
 
 func (a *Auth) Load(filename string, fileBuf []byte) int {
@@ -193,6 +309,23 @@ func (a *Auth) Load(filename string, fileBuf []byte) int {
       }
     }
   }
+  a.checkIDFallback()
 
   return len(mapAuth)
 }
+
+// checkIDFallback warns about the LDAP providers which give the same IDs to the same logins
+func (a *Auth) checkIDFallback() []string {
+  codes := make([]string, 0)
+  for code, in := range a.ai {
+    if l, ok := in.(*openldap.Info); ok && l.IDFallback() == openldap.IDFallbackLegacy {
+      codes = append(codes, code)
+    }
+  }
+  if len(codes) < 2 {
+    return nil
+  }
+  sort.Strings(codes)
+  glog.Warningf("WRN: AUTH: LDAP %v: the same logins get the same user IDs (id_fallback: legacy), set attr_id or id_fallback: code", codes)
+  return codes
+}
@@ -1,16 +1,21 @@
 package auth
 
 import (
+  "context"
   "testing"
   "github.com/stretchr/testify/assert"
 
   "flag"
+  "time"
+  "net/http"
+  "net/http/httptest"
   
   "github.com/golang/glog"
   "github.com/google/uuid"
   
   "github.com/Lunkov/lib-env"
   "github.com/Lunkov/lib-auth/base"
+  "github.com/Lunkov/lib-auth/openldap"
 )
 
 func TestAuth(t *testing.T) {
@@ -86,3 +91,142 @@ func TestAuth(t *testing.T) {
   
   defer a.Close() 
 }
+
+func TestAuthChangePassword(t *testing.T) {
+  a := New()
+  a.ai["mail"] = a.AddAuth("mail", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "mail", TypeAuth: "mailru"}}, "")
+  a.ai["ldap"] = a.AddAuth("ldap", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "ldap", TypeAuth: "openldap"}}, "")
+
+  assert.Equal(t, ErrAuthNotFound, a.ChangePassword(context.Background(), "none", "user", "old", "new-password"))
+  assert.Equal(t, ErrPasswordChangeNotAllowed, a.ChangePassword(context.Background(), "mail", "user", "old", "new-password"))
+  // The provider is not connected
+  assert.NotNil(t, a.ChangePassword(context.Background(), "ldap", "user", "old", "new-password"))
+}
+
+// fakeLDAP is the connected password provider
+type fakeLDAP struct {
+  AuthInterface
+  user      base.User
+  changed   string
+}
+
+func (f *fakeLDAP) Type() string { return "openldap" }
+func (f *fakeLDAP) Connected() bool { return true }
+
+func (f *fakeLDAP) Authenticate(ctx context.Context, login string, password string) (base.User, error) {
+  if password != "secret" {
+    return base.User{}, openldap.ErrInvalidCredentials
+  }
+  return f.user, nil
+}
+
+func (f *fakeLDAP) LookupUser(ctx context.Context, login string) (base.User, error) {
+  return f.user, nil
+}
+
+func (f *fakeLDAP) ChangePassword(ctx context.Context, login string, oldPassword string, newPassword string) error {
+  f.changed = newPassword
+  return nil
+}
+
+func TestAuthAuthenticate(t *testing.T) {
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000050")
+  a := New()
+  a.ai["mail"] = a.AddAuth("mail", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "mail", TypeAuth: "mailru"}}, "")
+  a.ai["ldap"] = a.AddAuth("ldap", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "ldap", TypeAuth: "openldap"}}, "")
+  a.ai["fake"] = &fakeLDAP{user: base.User{ID: uid, Login: "max"}}
+
+  params := map[string]string{"login": "max", "password": "secret"}
+  _, err := a.Authenticate(context.Background(), "none", &params)
+  assert.Equal(t, ErrAuthNotFound, err)
+  _, err = a.Authenticate(context.Background(), "mail", &params)
+  assert.Equal(t, ErrPasswordLoginNotAllowed, err)
+  _, err = a.Authenticate(context.Background(), "ldap", &params)
+  assert.Equal(t, openldap.ErrNotConnected, err)
+
+  user, err := a.Authenticate(context.Background(), "fake", &params)
+  assert.Nil(t, err)
+  assert.Equal(t, uid, user.ID)
+  assert.Equal(t, "fake", user.AuthCode)
+  user, ok := a.AuthUserContext(context.Background(), "fake", &params)
+  assert.True(t, ok)
+  assert.Equal(t, "max", user.Login)
+
+  params["password"] = "wrong"
+  _, err = a.Authenticate(context.Background(), "fake", &params)
+  assert.Equal(t, openldap.ErrInvalidCredentials, err)
+  _, ok = a.AuthUserContext(context.Background(), "fake", &params)
+  assert.False(t, ok)
+}
+
+func TestAuthPasswordChanged(t *testing.T) {
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000050")
+  a := New()
+  fake := &fakeLDAP{user: base.User{ID: uid, Login: "max"}}
+  a.ai["fake"] = fake
+
+  s := NewSessions()
+  s.Init("memory", 10000, "", 0)
+  remember := NewRememberMemory()
+  s.SetRemember(remember, time.Hour)
+
+  info := base.User{ID: uid, Login: "max"}
+  token1, err := s.HTTPUserLoginToken(httptest.NewRecorder(), "", &info)
+  assert.Nil(t, err)
+  rr := httptest.NewRecorder()
+  assert.Nil(t, s.HTTPUserLoginRemember(rr, "", &info))
+  token2 := lastCookie(rr, "__session").Value
+  assert.Equal(t, 2, len(s.ListUserSessions(uid)))
+
+  var changed *base.User
+  a.OnPasswordChanged(func(user *base.User) {
+    changed = user
+    s.RevokeUser(user.ID, token2)
+  })
+  assert.Nil(t, a.ChangePassword(context.Background(), "fake", "max", "secret", "new-secret"))
+  assert.Equal(t, "new-secret", fake.changed)
+  assert.NotNil(t, changed)
+  assert.Equal(t, uid, changed.ID)
+  assert.Equal(t, "fake", changed.AuthCode)
+
+  // Only the session which has changed the password is left
+  list := s.ListUserSessions(uid)
+  assert.Equal(t, 1, len(list))
+  assert.Equal(t, token2, list[0].Token)
+  assert.False(t, s.Find(token1))
+  req, _ := http.NewRequest("GET", "/iam", nil)
+  req.AddCookie(lastCookie(rr, "__remember"))
+  assert.NotEqual(t, token2, s.HTTPStart(httptest.NewRecorder(), req))
+  _, ok := s.GetUserInfo(s.HTTPStart(httptest.NewRecorder(), req))
+  assert.False(t, ok)
+
+  s.Close()
+}
+
+func TestAuthIDFallback(t *testing.T) {
+  a := New()
+  a.ai["ldap1"] = a.AddAuth("ldap1", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "ldap1", TypeAuth: "openldap"}}, "")
+  a.ai["mail"] = a.AddAuth("mail", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "mail", TypeAuth: "mailru"}}, "")
+  assert.Nil(t, a.checkIDFallback())
+  a.ai["ldap2"] = a.AddAuth("ldap2", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "ldap2", TypeAuth: "openldap", LDAP: base.LDAPInfo{Ldap_id_fallback: "code"}}}, "")
+  assert.Nil(t, a.checkIDFallback())
+  a.ai["ldap3"] = a.AddAuth("ldap3", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "ldap3", TypeAuth: "openldap"}}, "")
+  assert.Equal(t, []string{"ldap1", "ldap3"}, a.checkIDFallback())
+}
+
+func TestAuthReloadUser(t *testing.T) {
+  a := New()
+  a.ai["mail"] = a.AddAuth("mail", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "mail", TypeAuth: "mailru"}}, "")
+  a.ai["ldap"] = a.AddAuth("ldap", base.AuthLoadInfo{AConf: base.AuthConfig{CODE: "ldap", TypeAuth: "openldap"}}, "")
+
+  _, err := a.ReloadUser(context.Background(), &base.User{Login: "user", AuthCode: "none"})
+  assert.Equal(t, ErrAuthNotFound, err)
+  // The provider does not read the users
+  user, err := a.ReloadUser(context.Background(), &base.User{Login: "user", AuthCode: "mail"})
+  assert.Nil(t, err)
+  assert.Equal(t, "user", user.Login)
+  assert.Equal(t, "mail", user.AuthCode)
+  // The provider is not connected
+  _, err = a.ReloadUser(context.Background(), &base.User{Login: "user", AuthCode: "ldap"})
+  assert.NotNil(t, err)
+}
@@ -1,5 +1,10 @@
 package base
 
+import (
+  "strings"
+  "github.com/golang/glog"
+)
+
 type OAuthInfo struct {
   Login_Url               string    `yaml:"login_url"`
   Logout_Url              string    `yaml:"logout_url"`
@@ -11,11 +16,32 @@ type OAuthInfo struct {
 type LDAPInfo struct {
   Host                    string    `yaml:"host"`
   Port                    int       `yaml:"port"`
+  // openldap (default) or ad, the flavor sets the defaults of the filters and of the attributes
+  Flavor                  string    `yaml:"flavor"`
 
+  // The attribute the user logs in with, uid by default (sAMAccountName for ad)
+  Ldap_attr_login         string    `yaml:"attr_login"`
+  // Immutable attribute of the user ID: entryUUID, objectGUID (ad), nsUniqueId
   Ldap_attr_id            string    `yaml:"attr_id"`
+  // legacy, code or none, see openldap.IDFallback*. legacy is the default without attr_id
+  // for the IDs of the old versions, code is the safe choice with several providers:
+  // legacy gives the same ID to the same login of the different providers
+  Ldap_id_fallback        string    `yaml:"id_fallback"`
   Ldap_attr_first_name    string    `yaml:"attr_first_name"`
   Ldap_attr_last_name     string    `yaml:"attr_last_name"`
   Ldap_attr_email         string    `yaml:"attr_email"`
+  // displayName by default, first and last names are used without it
+  Ldap_attr_display_name  string    `yaml:"attr_display_name"`
+  // jpegPhoto or labeledURI, no avatar without it. The binary photo becomes a data URL
+  Ldap_attr_avatar        string    `yaml:"attr_avatar"`
+  // Bytes of the avatar, the bigger ones are skipped. 64 KiB by default
+  Ldap_avatar_max_size    int       `yaml:"avatar_max_size"`
+  // preferredLanguage by default
+  Ldap_attr_language      string    `yaml:"attr_language"`
+  // The name or the DN of the primary group, gidNumber is resolved to the posixGroup
+  Ldap_attr_group         string    `yaml:"attr_group"`
+  // Name in base.User.Attributes -> LDAP attribute
+  Ldap_attr_extra         map[string]string `yaml:"attr_extra"`
 
   Ldap_class_group        string    `yaml:"class_group"`
 
@@ -25,6 +51,43 @@ type LDAPInfo struct {
 
   Ldap_filter_user        string    `yaml:"filter_user"`
   Ldap_filter_group       string    `yaml:"filter_group"`
+  // groupOfNames, groupOfUniqueNames, posixGroup or memberOf, the style sets the empty filter_group
+  Ldap_group_style        string    `yaml:"group_style"`
+  // cn by default
+  Ldap_attr_group_name    string    `yaml:"attr_group_name"`
+  // Levels of the nested groups, 0 is for the direct groups only
+  Ldap_group_depth        int       `yaml:"group_depth"`
+  // Seconds the group lookups are cached, 0 disables the cache
+  Ldap_group_cache        int       `yaml:"group_cache"`
+  // Max entries of the group cache, 10000 by default
+  Ldap_group_cache_size   int       `yaml:"group_cache_size"`
+  // Entries per page of the listings, 500 by default
+  Ldap_page_size          int       `yaml:"page_size"`
+
+  // ldap://host:port or ldaps://host:port with the optional ?timeout=<seconds>, Host and Port are used without them
+  Servers               []string    `yaml:"servers"`
+  // failover (default) or round_robin
+  Server_policy           string    `yaml:"server_policy"`
+  // Seconds a failed server is skipped, 30 by default
+  Server_backoff          int       `yaml:"server_backoff"`
+  // Seconds of the connect and of the requests, 10 by default
+  Timeout                 int       `yaml:"timeout"`
+
+  // none, ldaps or starttls
+  Tls_mode                string    `yaml:"tls_mode"`
+  // PEM files, the system roots are used without the CA
+  Tls_ca_file             string    `yaml:"tls_ca_file"`
+  Tls_cert_file           string    `yaml:"tls_cert_file"`
+  Tls_key_file            string    `yaml:"tls_key_file"`
+  // Host by default
+  Tls_server_name         string    `yaml:"tls_server_name"`
+  // 1.0, 1.1, 1.2 (default) or 1.3
+  Tls_min_version         string    `yaml:"tls_min_version"`
+
+  // Connections of the admin and of the user pools, 4 by default
+  Pool_size               int       `yaml:"pool_size"`
+  // Seconds of idle after which the connection is checked before use, 30 by default
+  Pool_health_check       int       `yaml:"pool_health_check"`
 }
 
 type AuthConfig struct {
@@ -39,6 +102,7 @@ type AuthConfig struct {
   DBConnect               string       `yaml:"dbconnect"`
   AuthTable               string       `yaml:"auth_table"`
 
+  // The users must be members of one of these groups (comma separated) to log in
   CheckGroups             string    `yaml:"check_groups"`
 }
 
@@ -72,3 +136,30 @@ func (a *AuthConfig) Connected() bool {
 func (a *AuthConfig) AuthUrl() string {
   return ""
 }
+
+// AllowedGroups returns the groups of CheckGroups
+func (a *AuthConfig) AllowedGroups() []string {
+  res := make([]string, 0)
+  for _, g := range strings.FieldsFunc(a.CheckGroups, func(c rune) bool { return c == ',' || c == ';' }) {
+    if g = strings.TrimSpace(g); g != "" {
+      res = append(res, g)
+    }
+  }
+  return res
+}
+
+// CheckUserGroups allows the user to log in when CheckGroups is empty
+// or the user is a member of one of its groups
+func (a *AuthConfig) CheckUserGroups(user *User) bool {
+  groups := a.AllowedGroups()
+  if len(groups) == 0 {
+    return true
+  }
+  if user.HasAnyGroup(groups...) {
+    return true
+  }
+  if glog.V(2) {
+    glog.Warningf("WRN: AUTH(%s): User '%s' is not a member of %v", a.CODE, user.Login, groups)
+  }
+  return false
+}
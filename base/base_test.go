@@ -76,3 +76,27 @@ func TestPerson(t *testing.T) {
 
 }
 
+
+func TestUserGroups(t *testing.T) {
+  user := User{Login: "Max", Group: "staff", Groups: []string{"Admin", "dev"}}
+
+  assert.True(t, user.HasGroup("staff"))
+  assert.True(t, user.HasGroup("admin"))
+  assert.False(t, user.HasGroup("ops"))
+  assert.False(t, user.HasGroup(""))
+  assert.True(t, user.HasAnyGroup("ops", "dev"))
+  assert.False(t, user.HasAnyGroup("ops"))
+  assert.True(t, user.HasAllGroups("dev", "staff"))
+  assert.False(t, user.HasAllGroups("dev", "ops"))
+
+  cfg := AuthConfig{CODE: "ldap"}
+  assert.Equal(t, []string{}, cfg.AllowedGroups())
+  assert.True(t, cfg.CheckUserGroups(&user))
+
+  cfg.CheckGroups = "ops, admin"
+  assert.Equal(t, []string{"ops", "admin"}, cfg.AllowedGroups())
+  assert.True(t, cfg.CheckUserGroups(&user))
+
+  cfg.CheckGroups = "ops;finance"
+  assert.False(t, cfg.CheckUserGroups(&user))
+}
@@ -0,0 +1,25 @@
+package base
+
+import (
+  "context"
+)
+
+// RunContext runs fn and waits for it or for the end of ctx.
+// The end of ctx stops the wait only, not the work: fn keeps running in the background,
+// its results must be dropped and fn has to check ctx itself to skip or undo its writes
+func RunContext(ctx context.Context, fn func()) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  done := make(chan struct{})
+  go func() {
+    fn()
+    close(done)
+  }()
+  select {
+    case <-done:
+      return nil
+    case <-ctx.Done():
+      return ctx.Err()
+  }
+}
@@ -0,0 +1,29 @@
+package base
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "time"
+  "context"
+)
+
+func TestRunContext(t *testing.T) {
+  res := 0
+  err := RunContext(context.Background(), func() { res = 1 })
+  assert.Nil(t, err)
+  assert.Equal(t, 1, res)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  err = RunContext(ctx, func() { res = 2 })
+  assert.Equal(t, context.Canceled, err)
+  assert.Equal(t, 1, res)
+
+  ctx, cancel = context.WithTimeout(context.Background(), 10 * time.Millisecond)
+  defer cancel()
+  stop := make(chan struct{})
+  err = RunContext(ctx, func() { <-stop })
+  assert.Equal(t, context.DeadlineExceeded, err)
+  close(stop)
+}
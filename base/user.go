@@ -2,6 +2,7 @@ package base
 
 import (
   "time"
+  "strings"
   "github.com/golang/glog"
   "github.com/google/uuid"
   "encoding/json"
@@ -16,6 +17,7 @@ type User struct {
   Language      string          `json:"lang"`
   Group         string          `json:"group"`
   Groups      []string          `json:"groups"`
+  Attributes    map[string][]string `json:"attributes,omitempty"`
   TimeLogin     time.Time       `json:"-"`
   AuthCode      string          `json:"-"`
   Disable       bool            `json:"disable"`
@@ -38,3 +40,37 @@ func FromJSON(str string) (*User, error) {
   }
   return &p, nil
 }
+
+// HasGroup checks the main group and the groups of the user, the names are case insensitive
+func (p *User) HasGroup(group string) bool {
+  if group == "" {
+    return false
+  }
+  if strings.EqualFold(p.Group, group) {
+    return true
+  }
+  for _, g := range p.Groups {
+    if strings.EqualFold(g, group) {
+      return true
+    }
+  }
+  return false
+}
+
+func (p *User) HasAnyGroup(groups ...string) bool {
+  for _, g := range groups {
+    if p.HasGroup(g) {
+      return true
+    }
+  }
+  return false
+}
+
+func (p *User) HasAllGroups(groups ...string) bool {
+  for _, g := range groups {
+    if !p.HasGroup(g) {
+      return false
+    }
+  }
+  return true
+}
@@ -0,0 +1,27 @@
+package auth
+
+import (
+  "context"
+  "net/http"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+type contextKey int
+
+const userContextKey contextKey = 0
+
+// WithUser returns a copy of ctx with the authenticated user
+func WithUser(ctx context.Context, user *base.User) context.Context {
+  return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the authenticated user stored by WithUser
+func UserFromContext(ctx context.Context) (*base.User, bool) {
+  user, ok := ctx.Value(userContextKey).(*base.User)
+  return user, ok && user != nil
+}
+
+func UserFromRequest(r *http.Request) (*base.User, bool) {
+  return UserFromContext(r.Context())
+}
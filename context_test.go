@@ -0,0 +1,81 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "time"
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestContextUser(t *testing.T) {
+  req, _ := http.NewRequest("GET", "/", nil)
+  user, ok := UserFromRequest(req)
+  assert.False(t, ok)
+  assert.Nil(t, user)
+
+  info := base.User{Login: "Max", EMail: "max@aaa.ru"}
+  req = req.WithContext(WithUser(req.Context(), &info))
+  user, ok = UserFromRequest(req)
+  assert.True(t, ok)
+  assert.Equal(t, "Max", user.Login)
+
+  _, ok = UserFromContext(WithUser(context.Background(), nil))
+  assert.False(t, ok)
+}
+
+func TestSessionContext(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000036")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  cancelled, cancel := context.WithCancel(context.Background())
+  cancel()
+
+  rr := httptest.NewRecorder()
+  assert.Equal(t, context.Canceled, s.HTTPUserLoginContext(cancelled, rr, "", &info))
+  assert.Equal(t, 0, len(rr.Result().Cookies()))
+
+  rr = httptest.NewRecorder()
+  assert.Nil(t, s.HTTPUserLoginContext(context.Background(), rr, "", &info))
+  cookie := lastCookie(rr, "__session")
+  assert.NotNil(t, cookie)
+  token := cookie.Value
+  assert.False(t, info.TimeLogin.IsZero())
+
+  assert.True(t, s.FindContext(context.Background(), token))
+  assert.False(t, s.FindContext(cancelled, token))
+
+  user, ok := s.GetUserInfoContext(context.Background(), token)
+  assert.True(t, ok)
+  assert.Equal(t, "Max", user.Login)
+  user, ok = s.GetUserInfoContext(cancelled, token)
+  assert.False(t, ok)
+  assert.Nil(t, user)
+
+  // The login which has lost its caller is not saved
+  s.DestroyAll()
+  s.muLogin.Lock()
+  timeout, cancelTimeout := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+  defer cancelTimeout()
+  rr = httptest.NewRecorder()
+  assert.Equal(t, context.DeadlineExceeded, s.HTTPUserLoginContext(timeout, rr, "", &info))
+  assert.Equal(t, 0, len(rr.Result().Cookies()))
+  s.muLogin.Unlock()
+  time.Sleep(50 * time.Millisecond)
+  assert.Equal(t, int64(0), s.Count())
+  assert.Equal(t, 0, len(s.ListUserSessions(uid)))
+  // The lost login does not take the place of the user
+  s.SetMaxSessions(1, SessionLimitReject)
+  assert.Nil(t, s.HTTPUserLoginContext(context.Background(), httptest.NewRecorder(), "", &info))
+
+  s.Close()
+}
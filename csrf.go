@@ -0,0 +1,215 @@
+package auth
+
+import (
+  "strings"
+  "net/http"
+  "crypto/hmac"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "github.com/golang/glog"
+)
+
+const (
+  // The token is kept in the session and compared with the submitted one
+  CSRFSynchronizer = "synchronizer"
+  // The token is kept in a cookie readable by JavaScript and signed with the session ID
+  CSRFDoubleSubmit = "double_submit"
+)
+
+// csrfDataKey is the session data key of the synchronizer token
+const csrfDataKey = "__csrf"
+
+type CSRFInfo struct {
+  Mode           string      `yaml:"mode"`
+  Key            string      `yaml:"key"`
+  Header_name    string      `yaml:"header_name"`
+  Field_name     string      `yaml:"field_name"`
+  Cookie_name    string      `yaml:"cookie_name"`
+  Same_site      string      `yaml:"same_site"`
+  Exempt_paths []string      `yaml:"exempt_paths"`
+}
+
+type CSRF struct {
+  session        *Session
+  mode           string
+  key            []byte
+  headerName     string
+  fieldName      string
+  cookieName     string
+  sameSite       http.SameSite
+  exemptPaths    []string
+
+  // FailureHandler answers the rejected requests, 403 by default
+  FailureHandler http.Handler
+}
+
+func NewCSRF(s *Session, cfg *CSRFInfo) *CSRF {
+  c := &CSRF{
+    session:     s,
+    mode:        strings.ToLower(cfg.Mode),
+    key:         []byte(cfg.Key),
+    headerName:  cfg.Header_name,
+    fieldName:   cfg.Field_name,
+    cookieName:  cfg.Cookie_name,
+    exemptPaths: cfg.Exempt_paths,
+  }
+  if c.mode == "" {
+    c.mode = CSRFSynchronizer
+  }
+  if c.headerName == "" {
+    c.headerName = "X-CSRF-Token"
+  }
+  if c.fieldName == "" {
+    c.fieldName = "csrf_token"
+  }
+  if c.cookieName == "" {
+    c.cookieName = "__csrf"
+  }
+  switch strings.ToLower(cfg.Same_site) {
+    case "strict":
+      c.sameSite = http.SameSiteStrictMode
+    case "none":
+      c.sameSite = http.SameSiteNoneMode
+    default:
+      c.sameSite = http.SameSiteLaxMode
+  }
+  if len(c.key) == 0 {
+    // Tokens signed with the random key are valid only in this process
+    c.key = randomBytes(32)
+  }
+  c.FailureHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Error(w, "Forbidden: CSRF token is not valid", http.StatusForbidden)
+  })
+  return c
+}
+
+func randomBytes(n int) []byte {
+  buf := make([]byte, n)
+  if _, err := rand.Read(buf); err != nil {
+    glog.Errorf("ERR: CSRF: rand: %v", err)
+  }
+  return buf
+}
+
+func safeMethod(method string) bool {
+  switch method {
+    case "GET", "HEAD", "OPTIONS", "TRACE":
+      return true
+  }
+  return false
+}
+
+func (c *CSRF) exempt(r *http.Request) bool {
+  for _, path := range c.exemptPaths {
+    if strings.HasPrefix(r.URL.Path, path) {
+      return true
+    }
+  }
+  return false
+}
+
+// sign makes the double submit token of the session
+func (c *CSRF) sign(nonce []byte, sessionID string) string {
+  mac := hmac.New(sha256.New, c.key)
+  mac.Write(nonce)
+  mac.Write([]byte(sessionID))
+  return base64.RawURLEncoding.EncodeToString(nonce) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validSigned checks that the double submit token belongs to the session
+func (c *CSRF) validSigned(token string, sessionID string) bool {
+  pos := strings.IndexByte(token, '.')
+  if pos < 0 || sessionID == "" {
+    return false
+  }
+  nonce, err := base64.RawURLEncoding.DecodeString(token[:pos])
+  if err != nil {
+    return false
+  }
+  return equalTokens(c.sign(nonce, sessionID), token)
+}
+
+func equalTokens(a string, b string) bool {
+  return a != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (c *CSRF) setCookie(w http.ResponseWriter, r *http.Request, token string) {
+  http.SetCookie(w, &http.Cookie{
+    Name:     c.cookieName,
+    Value:    token,
+    Path:     "/",
+    SameSite: c.sameSite,
+    // SameSite=None is accepted by the browsers only with Secure,
+    // behind the TLS proxy the session tells the cookies are secure (see Session.SetSecure)
+    Secure:   c.session.secure || r.TLS != nil || c.sameSite == http.SameSiteNoneMode,
+  })
+}
+
+// Token returns the CSRF token of the session of the request, the token
+// is created when the session has no one yet
+func (c *CSRF) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+  if c.mode == CSRFDoubleSubmit {
+    sessionID := c.session.HTTPSessionID(w, r)
+    if sessionID == "" {
+      return "", ErrSessionNotFound
+    }
+    if cookie, err := r.Cookie(c.cookieName); err == nil && c.validSigned(cookie.Value, sessionID) {
+      return cookie.Value, nil
+    }
+    token := c.sign(randomBytes(16), sessionID)
+    c.setCookie(w, r, token)
+    return token, nil
+  }
+  var token string
+  if c.session.HTTPGetData(w, r, csrfDataKey, &token) && token != "" {
+    return token, nil
+  }
+  token = base64.RawURLEncoding.EncodeToString(randomBytes(32))
+  if err := c.session.HTTPSetData(w, r, csrfDataKey, token); err != nil {
+    return "", err
+  }
+  return token, nil
+}
+
+func (c *CSRF) submitted(r *http.Request) string {
+  if token := r.Header.Get(c.headerName); token != "" {
+    return token
+  }
+  return r.PostFormValue(c.fieldName)
+}
+
+// Check validates the token submitted with the request
+func (c *CSRF) Check(w http.ResponseWriter, r *http.Request) bool {
+  if safeMethod(r.Method) || c.exempt(r) {
+    return true
+  }
+  token := c.submitted(r)
+  if c.mode == CSRFDoubleSubmit {
+    cookie, err := r.Cookie(c.cookieName)
+    if err != nil {
+      return false
+    }
+    return equalTokens(cookie.Value, token) && c.validSigned(token, c.session.HTTPSessionID(w, r))
+  }
+  var stored string
+  if !c.session.HTTPGetData(w, r, csrfDataKey, &stored) {
+    return false
+  }
+  return equalTokens(stored, token)
+}
+
+// Handler rejects the unsafe requests without a valid CSRF token
+func (c *CSRF) Handler(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if !c.Check(w, r) {
+      if glog.V(2) {
+        glog.Warningf("WRN: CSRF: %s %s: token is not valid", r.Method, r.URL.Path)
+      }
+      c.FailureHandler.ServeHTTP(w, r)
+      return
+    }
+    next.ServeHTTP(w, r)
+  })
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "strings"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+)
+
+func csrfServe(c *CSRF, req *http.Request) int {
+  rr := httptest.NewRecorder()
+  c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusOK)
+  })).ServeHTTP(rr, req)
+  return rr.Code
+}
+
+func TestCSRFSynchronizer(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+
+  c := NewCSRF(s, &CSRFInfo{Exempt_paths: []string{"/api/v1/hook"}})
+
+  req, _ := http.NewRequest("GET", "/form", nil)
+  rr := httptest.NewRecorder()
+  s.HTTPStart(rr, req)
+  cookie := lastCookie(rr, "__session")
+
+  // No session, no token
+  _, err := c.Token(httptest.NewRecorder(), req)
+  assert.Equal(t, ErrSessionNotFound, err)
+
+  req.AddCookie(cookie)
+  token, err := c.Token(httptest.NewRecorder(), req)
+  assert.Nil(t, err)
+  assert.NotEqual(t, "", token)
+  token2, _ := c.Token(httptest.NewRecorder(), req)
+  assert.Equal(t, token, token2)
+  assert.Equal(t, http.StatusOK, csrfServe(c, req))
+
+  req, _ = http.NewRequest("POST", "/api/v1/save", nil)
+  req.AddCookie(cookie)
+  assert.Equal(t, http.StatusForbidden, csrfServe(c, req))
+
+  req.Header.Set("X-CSRF-Token", "bad")
+  assert.Equal(t, http.StatusForbidden, csrfServe(c, req))
+
+  req.Header.Set("X-CSRF-Token", token)
+  assert.Equal(t, http.StatusOK, csrfServe(c, req))
+
+  form := url.Values{"csrf_token": {token}}
+  req, _ = http.NewRequest("POST", "/api/v1/save", strings.NewReader(form.Encode()))
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  req.AddCookie(cookie)
+  assert.Equal(t, http.StatusOK, csrfServe(c, req))
+
+  req, _ = http.NewRequest("POST", "/api/v1/hook/mail", nil)
+  assert.Equal(t, http.StatusOK, csrfServe(c, req))
+
+  s.Close()
+}
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, true, s.InitCookie(1000, []string{testCookieKey1}, 0))
+
+  c := NewCSRF(s, &CSRFInfo{Mode: "double_submit", Key: "csrf-key", Same_site: "strict"})
+
+  newSession := func() *http.Cookie {
+    req, _ := http.NewRequest("GET", "/form", nil)
+    rr := httptest.NewRecorder()
+    s.HTTPStart(rr, req)
+    return lastCookie(rr, "__session")
+  }
+  session1 := newSession()
+  session2 := newSession()
+
+  req, _ := http.NewRequest("GET", "/form", nil)
+  req.AddCookie(session1)
+  rr := httptest.NewRecorder()
+  token, err := c.Token(rr, req)
+  assert.Nil(t, err)
+  csrfCookie := lastCookie(rr, "__csrf")
+  assert.Equal(t, token, csrfCookie.Value)
+  assert.Equal(t, http.SameSiteStrictMode, csrfCookie.SameSite)
+  assert.Equal(t, false, csrfCookie.HttpOnly)
+  assert.Equal(t, false, csrfCookie.Secure)
+
+  // The TLS is terminated by the proxy
+  s.SetSecure(true)
+  rr = httptest.NewRecorder()
+  c.Token(rr, req)
+  assert.Equal(t, true, lastCookie(rr, "__csrf").Secure)
+  s.SetSecure(false)
+
+  req, _ = http.NewRequest("POST", "/api/v1/save", nil)
+  req.AddCookie(session1)
+  req.AddCookie(csrfCookie)
+  assert.Equal(t, http.StatusForbidden, csrfServe(c, req))
+  req.Header.Set("X-CSRF-Token", token)
+  assert.Equal(t, http.StatusOK, csrfServe(c, req))
+
+  // The token of one session is not valid for another one
+  req, _ = http.NewRequest("POST", "/api/v1/save", nil)
+  req.AddCookie(session2)
+  req.AddCookie(csrfCookie)
+  req.Header.Set("X-CSRF-Token", token)
+  assert.Equal(t, http.StatusForbidden, csrfServe(c, req))
+
+  // The same token is kept while the cookie is valid
+  req, _ = http.NewRequest("GET", "/form", nil)
+  req.AddCookie(session1)
+  req.AddCookie(csrfCookie)
+  rr = httptest.NewRecorder()
+  token2, _ := c.Token(rr, req)
+  assert.Equal(t, token, token2)
+  assert.Nil(t, lastCookie(rr, "__csrf"))
+
+  s.Close()
+}
@@ -9,7 +9,7 @@ require (
 	github.com/Lunkov/lib-ref v0.0.0-20210329183231-3e3304abcd4b
 	github.com/aerospike/aerospike-client-go v4.5.0+incompatible // indirect
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
-	github.com/go-asn1-ber/asn1-ber v1.5.3 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.3
 	github.com/go-ldap/ldap/v3 v3.3.0
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/golang/protobuf v1.5.2 // indirect
@@ -33,6 +33,7 @@ type Claims struct {
   DisplayName     string    `json:"displayname"`
   Group           string    `json:"group"`
   Groups        []string    `json:"groups"`
+  AuthCode        string    `json:"auth,omitempty"`
   jwt.StandardClaims
 }
 
@@ -81,6 +82,7 @@ func (c *JWTItem) JWTGen(user *base.User, issuer string) (string, error) {
     Avatar:      user.Avatar,
     Group:       user.Group,
     Groups:      user.Groups,
+    AuthCode:    user.AuthCode,
     StandardClaims: jwt.StandardClaims{
       // In JWT, the expiry time is expressed as unix milliseconds
       ExpiresAt: expirationTime.Unix(),
@@ -152,5 +154,6 @@ func (c *JWTItem) JWTCheck(token string) (base.User, int, error) {
   user.Avatar = claims.Avatar
   user.EMail = claims.EMail
   user.DisplayName = claims.DisplayName
+  user.AuthCode = claims.AuthCode
   return user, http.StatusOK, nil
 }
@@ -0,0 +1,183 @@
+package auth
+
+import (
+  "strings"
+  "net/url"
+  "net/http"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const (
+  // 401 with a JSON body
+  UnauthorizedJSON      = "json"
+  // 302 to the login URL, the requested URL is passed in the redirect parameter
+  UnauthorizedRedirect  = "redirect"
+  // The request goes on without a user in the context
+  UnauthorizedAnonymous = "anonymous"
+)
+
+const (
+  // The user must be a member of one of the groups
+  GroupsAny = "any"
+  // The user must be a member of all groups
+  GroupsAll = "all"
+)
+
+type MiddlewareInfo struct {
+  Unauthorized    string      `yaml:"unauthorized"`
+  Login_url       string      `yaml:"login_url"`
+  Redirect_param  string      `yaml:"redirect_param"`
+}
+
+// Middleware authenticates the requests with the session or the bearer JWT
+// and puts the user into the context of the request (see UserFromRequest)
+type Middleware struct {
+  session        *Session
+  jwt            *JWTItem
+  unauthorized   string
+  loginURL       string
+  redirectParam  string
+
+  // UnauthorizedHandler answers the requests without a user, it is set by the Unauthorized mode
+  UnauthorizedHandler http.Handler
+  // ForbiddenHandler answers the requests of the users without access, 403 by default
+  ForbiddenHandler    http.Handler
+}
+
+// NewMiddleware makes the middleware, s or j may be nil
+func NewMiddleware(s *Session, j *JWTItem, cfg *MiddlewareInfo) *Middleware {
+  m := &Middleware{
+    session:       s,
+    jwt:           j,
+    unauthorized:  strings.ToLower(cfg.Unauthorized),
+    loginURL:      cfg.Login_url,
+    redirectParam: cfg.Redirect_param,
+  }
+  if m.redirectParam == "" {
+    m.redirectParam = "next"
+  }
+  switch m.unauthorized {
+    case UnauthorizedRedirect:
+      if m.loginURL == "" {
+        glog.Errorf("ERR: MIDDLEWARE: login_url is empty, answer with 401")
+        m.unauthorized = UnauthorizedJSON
+      }
+    case UnauthorizedAnonymous:
+    default:
+      m.unauthorized = UnauthorizedJSON
+  }
+  m.UnauthorizedHandler = http.HandlerFunc(m.reject)
+  m.ForbiddenHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.WriteHeader(http.StatusForbidden)
+    w.Write([]byte(`{"error":"forbidden"}`))
+  })
+  return m
+}
+
+func bearerToken(r *http.Request) string {
+  src := tokenSource{kind: TokenFromBearer}
+  return src.get(r, "")
+}
+
+// Authenticate returns the user of the session or of the bearer JWT
+func (m *Middleware) Authenticate(w http.ResponseWriter, r *http.Request) (*base.User, bool) {
+  if m.session != nil {
+    if user, ok := m.session.HTTPUserInfo(w, r); ok {
+      return user, true
+    }
+  }
+  if m.jwt != nil {
+    token := bearerToken(r)
+    if token == "" {
+      return nil, false
+    }
+    user, code, err := m.jwt.JWTCheck(token)
+    if err != nil || code != http.StatusOK {
+      if glog.V(2) {
+        glog.Warningf("WRN: MIDDLEWARE: JWT is not valid (code=%d): %v", code, err)
+      }
+      return nil, false
+    }
+    return &user, true
+  }
+  return nil, false
+}
+
+func (m *Middleware) reject(w http.ResponseWriter, r *http.Request) {
+  switch m.unauthorized {
+    case UnauthorizedRedirect:
+      target := m.loginURL
+      sep := "?"
+      if strings.Contains(target, "?") {
+        sep = "&"
+      }
+      target += sep + url.QueryEscape(m.redirectParam) + "=" + url.QueryEscape(r.URL.RequestURI())
+      http.Redirect(w, r, target, http.StatusFound)
+    default:
+      if m.jwt != nil {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+      }
+      w.Header().Set("Content-Type", "application/json; charset=utf-8")
+      w.WriteHeader(http.StatusUnauthorized)
+      w.Write([]byte(`{"error":"unauthorized"}`))
+  }
+}
+
+// Handler passes the authenticated requests to next with the user in the context
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    user, ok := m.Authenticate(w, r)
+    if ok {
+      next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+      return
+    }
+    if m.unauthorized == UnauthorizedAnonymous {
+      next.ServeHTTP(w, r)
+      return
+    }
+    m.UnauthorizedHandler.ServeHTTP(w, r)
+  })
+}
+
+// user returns the user put into the context by Handler or authenticates the request
+func (m *Middleware) user(w http.ResponseWriter, r *http.Request) (*base.User, *http.Request, bool) {
+  if user, ok := UserFromRequest(r); ok {
+    return user, r, true
+  }
+  user, ok := m.Authenticate(w, r)
+  if !ok {
+    return nil, r, false
+  }
+  return user, r.WithContext(WithUser(r.Context(), user)), true
+}
+
+// RequireGroups passes the requests of the members of the groups to next.
+// match is GroupsAny or GroupsAll
+func (m *Middleware) RequireGroups(match string, groups ...string) func(http.Handler) http.Handler {
+  all := strings.ToLower(match) == GroupsAll
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      user, r, ok := m.user(w, r)
+      if !ok {
+        m.UnauthorizedHandler.ServeHTTP(w, r)
+        return
+      }
+      if all {
+        ok = user.HasAllGroups(groups...)
+      } else {
+        ok = user.HasAnyGroup(groups...)
+      }
+      if !ok {
+        if glog.V(2) {
+          glog.Warningf("WRN: MIDDLEWARE: User '%s' is not a member of %s %v", user.Login, match, groups)
+        }
+        m.ForbiddenHandler.ServeHTTP(w, r)
+        return
+      }
+      next.ServeHTTP(w, r)
+    })
+  }
+}
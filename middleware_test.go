@@ -0,0 +1,136 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestMiddleware(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+
+  j := JWTItem{ServiceJWTType: "HS256", ServiceJWTKey: "mkdvrmiot5e8945er89345tmiwr8345rej34n7w46s", ExpiryTime: 100}
+  assert.True(t, j.JWTInit())
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000037")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    user, ok := UserFromRequest(r)
+    if ok {
+      w.Write([]byte(user.Login))
+    } else {
+      w.Write([]byte("anonymous"))
+    }
+  })
+
+  serve := func(m *Middleware, req *http.Request) *httptest.ResponseRecorder {
+    rr := httptest.NewRecorder()
+    m.Handler(next).ServeHTTP(rr, req)
+    return rr
+  }
+
+  m := NewMiddleware(s, &j, &MiddlewareInfo{})
+
+  // Not authenticated
+  req, _ := http.NewRequest("GET", "/api/v1/info", nil)
+  rr := serve(m, req)
+  assert.Equal(t, http.StatusUnauthorized, rr.Code)
+  assert.Equal(t, `{"error":"unauthorized"}`, rr.Body.String())
+  assert.Equal(t, "Bearer", rr.Header().Get("WWW-Authenticate"))
+
+  // Session
+  rr = httptest.NewRecorder()
+  token, err := s.HTTPUserLoginToken(rr, s.HTTPStart(rr, req), &info)
+  assert.Nil(t, err)
+  req, _ = http.NewRequest("GET", "/api/v1/info", nil)
+  req.AddCookie(&http.Cookie{Name: "__session", Value: token})
+  rr = serve(m, req)
+  assert.Equal(t, http.StatusOK, rr.Code)
+  assert.Equal(t, "Max", rr.Body.String())
+
+  // JWT
+  jwtToken, err := j.JWTGen(&base.User{ID: uid, Login: "Jwt", EMail: "jwt@aaa.ru"}, "system")
+  assert.Nil(t, err)
+  req, _ = http.NewRequest("GET", "/api/v1/info", nil)
+  req.Header.Set("Authorization", "Bearer " + jwtToken)
+  rr = serve(m, req)
+  assert.Equal(t, http.StatusOK, rr.Code)
+  assert.Equal(t, "Jwt", rr.Body.String())
+
+  req.Header.Set("Authorization", "Bearer 0000000000")
+  rr = serve(m, req)
+  assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+  // Redirect
+  m = NewMiddleware(s, nil, &MiddlewareInfo{Unauthorized: UnauthorizedRedirect, Login_url: "/login"})
+  req, _ = http.NewRequest("GET", "/page?id=1", nil)
+  rr = serve(m, req)
+  assert.Equal(t, http.StatusFound, rr.Code)
+  assert.Equal(t, "/login?next=%2Fpage%3Fid%3D1", rr.Header().Get("Location"))
+
+  // Redirect without the login URL falls back to 401
+  m = NewMiddleware(s, nil, &MiddlewareInfo{Unauthorized: UnauthorizedRedirect})
+  rr = serve(m, req)
+  assert.Equal(t, http.StatusUnauthorized, rr.Code)
+  assert.Equal(t, "", rr.Header().Get("WWW-Authenticate"))
+
+  // Anonymous
+  m = NewMiddleware(s, nil, &MiddlewareInfo{Unauthorized: UnauthorizedAnonymous})
+  rr = serve(m, req)
+  assert.Equal(t, http.StatusOK, rr.Code)
+  assert.Equal(t, "anonymous", rr.Body.String())
+
+  s.Close()
+}
+
+func TestMiddlewareRequireGroups(t *testing.T) {
+  j := JWTItem{ServiceJWTType: "HS256", ServiceJWTKey: "mkdvrmiot5e8945er89345tmiwr8345rej34n7w46s", ExpiryTime: 100}
+  assert.True(t, j.JWTInit())
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000038")
+  jwtToken, err := j.JWTGen(&base.User{ID: uid, Login: "Max", Groups: []string{"admin", "dev"}}, "system")
+  assert.Nil(t, err)
+
+  m := NewMiddleware(nil, &j, &MiddlewareInfo{})
+  next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    user, _ := UserFromRequest(r)
+    w.Write([]byte(user.Login))
+  })
+
+  serve := func(h http.Handler, token string) *httptest.ResponseRecorder {
+    req, _ := http.NewRequest("GET", "/api/v1/admin", nil)
+    if token != "" {
+      req.Header.Set("Authorization", "Bearer " + token)
+    }
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    return rr
+  }
+
+  rr := serve(m.RequireGroups(GroupsAny, "ops", "admin")(next), jwtToken)
+  assert.Equal(t, http.StatusOK, rr.Code)
+  assert.Equal(t, "Max", rr.Body.String())
+
+  rr = serve(m.RequireGroups(GroupsAll, "admin", "ops")(next), jwtToken)
+  assert.Equal(t, http.StatusForbidden, rr.Code)
+  assert.Equal(t, `{"error":"forbidden"}`, rr.Body.String())
+
+  rr = serve(m.RequireGroups(GroupsAll, "admin", "dev")(next), jwtToken)
+  assert.Equal(t, http.StatusOK, rr.Code)
+
+  rr = serve(m.RequireGroups(GroupsAny, "admin")(next), "")
+  assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+  // After Handler the user is taken from the context
+  rr = serve(m.Handler(m.RequireGroups(GroupsAny, "dev")(next)), jwtToken)
+  assert.Equal(t, http.StatusOK, rr.Code)
+  assert.Equal(t, "Max", rr.Body.String())
+}
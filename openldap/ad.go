@@ -0,0 +1,98 @@
+package openldap
+
+import (
+  "strings"
+  "strconv"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/google/uuid"
+  "github.com/golang/glog"
+)
+
+const (
+  FlavorOpenLDAP = "openldap"
+  // Active Directory
+  FlavorAD       = "ad"
+
+  // The groups of the user with the nested ones (LDAP_MATCHING_RULE_IN_CHAIN)
+  adFilterUser   = "(&(objectCategory=person)(objectClass=user)(|(sAMAccountName=%[1]s)(userPrincipalName=%[1]s)))"
+  adFilterGroup  = "(&(objectClass=group)(member:1.2.840.113556.1.4.1941:=%[2]s))"
+
+  // userAccountControl flags
+  adAccountDisable = 0x0002
+  adLockout        = 0x0010
+)
+
+func (a *Info) isAD() bool {
+  return strings.ToLower(a.LDAP.Flavor) == FlavorAD
+}
+
+// applyFlavor sets the defaults of the directory flavor to the empty fields of the config
+func (a *Info) applyFlavor() {
+  if !a.isAD() {
+    return
+  }
+  if a.LDAP.Ldap_filter_user == "" {
+    a.LDAP.Ldap_filter_user = adFilterUser
+  }
+  if a.LDAP.Ldap_filter_group == "" {
+    a.LDAP.Ldap_filter_group = adFilterGroup
+  }
+  if a.LDAP.Ldap_attr_login == "" {
+    a.LDAP.Ldap_attr_login = "sAMAccountName"
+  }
+  if a.LDAP.Ldap_attr_id == "" {
+    a.LDAP.Ldap_attr_id = "objectGUID"
+  }
+}
+
+// matchLogin checks the found entry has the login, AD users may log in with userPrincipalName
+func (a *Info) matchLogin(entry *ldap.Entry, login string) bool {
+  if a.LDAP.Ldap_attr_login == "" {
+    return true
+  }
+  if strings.EqualFold(entry.GetEqualFoldAttributeValue(a.LDAP.Ldap_attr_login), login) {
+    return true
+  }
+  return a.isAD() && strings.EqualFold(entry.GetEqualFoldAttributeValue("userPrincipalName"), login)
+}
+
+// accountDisabled checks userAccountControl of the AD accounts
+func (a *Info) accountDisabled(entry *ldap.Entry) bool {
+  return a.accountStatus(entry) != nil
+}
+
+// accountStatus returns ErrAccountDisabled or ErrAccountLocked by userAccountControl
+func (a *Info) accountStatus(entry *ldap.Entry) error {
+  if !a.isAD() {
+    return nil
+  }
+  str := entry.GetEqualFoldAttributeValue("userAccountControl")
+  if str == "" {
+    return nil
+  }
+  uac, err := strconv.ParseInt(str, 10, 64)
+  if err != nil {
+    glog.Errorf("ERR: LDAP: %s: userAccountControl '%s': %v", entry.DN, str, err)
+    return ErrAccountDisabled
+  }
+  if uac & adAccountDisable != 0 {
+    return ErrAccountDisabled
+  }
+  if uac & adLockout != 0 {
+    return ErrAccountLocked
+  }
+  return nil
+}
+
+// parseObjectGUID converts the binary objectGUID, the first three fields are little endian
+func parseObjectGUID(buf []byte) (uuid.UUID, bool) {
+  if len(buf) != 16 {
+    return uuid.Nil, false
+  }
+  var id uuid.UUID
+  id[0], id[1], id[2], id[3] = buf[3], buf[2], buf[1], buf[0]
+  id[4], id[5] = buf[5], buf[4]
+  id[6], id[7] = buf[7], buf[6]
+  copy(id[8:], buf[8:])
+  return id, true
+}
@@ -0,0 +1,128 @@
+package openldap
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "github.com/google/uuid"
+  "github.com/go-ldap/ldap/v3"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+// objectGUID of 3f2504e0-4f89-11d3-9a0c-0305e82c3301 as AD stores it
+var testObjectGUID = string([]byte{0xe0, 0x04, 0x25, 0x3f, 0x89, 0x4f, 0xd3, 0x11, 0x9a, 0x0c, 0x03, 0x05, 0xe8, 0x2c, 0x33, 0x01})
+
+func testADDirectory() []testEntry {
+  return []testEntry{
+    {DN: "CN=svc,CN=Users,DC=corp,DC=test", Attrs: map[string][]string{"cn": {"svc"}, "userPassword": {"password"}}},
+    {DN: "CN=Alice Smith,OU=Staff,DC=corp,DC=test", Attrs: map[string][]string{
+        "objectCategory": {"person"}, "objectClass": {"top", "person", "user"},
+        "sAMAccountName": {"alice"}, "userPrincipalName": {"alice@corp.test"}, "mail": {"alice.smith@corp.test"},
+        "objectGUID": {testObjectGUID}, "userAccountControl": {"512"}, "userPassword": {"alice-pwd"}}},
+    {DN: "CN=Bob Old,OU=Staff,DC=corp,DC=test", Attrs: map[string][]string{
+        "objectCategory": {"person"}, "objectClass": {"top", "person", "user"},
+        "sAMAccountName": {"bob"}, "userPrincipalName": {"bob@corp.test"},
+        "userAccountControl": {"514"}, "userPassword": {"bob-pwd"}}},
+    {DN: "CN=Staff,OU=Groups,DC=corp,DC=test", Attrs: map[string][]string{"objectClass": {"group"}, "cn": {"Staff"},
+        "member": {"CN=Alice Smith,OU=Staff,DC=corp,DC=test", "CN=Bob Old,OU=Staff,DC=corp,DC=test"}}},
+    {DN: "CN=Developers,OU=Groups,DC=corp,DC=test", Attrs: map[string][]string{"objectClass": {"group"}, "cn": {"Developers"},
+        "member": {"CN=Staff,OU=Groups,DC=corp,DC=test"}}},
+    {DN: "CN=Loop A,OU=Groups,DC=corp,DC=test", Attrs: map[string][]string{"objectClass": {"group"}, "cn": {"Loop A"},
+        "member": {"CN=Loop B,OU=Groups,DC=corp,DC=test"}}},
+    {DN: "CN=Loop B,OU=Groups,DC=corp,DC=test", Attrs: map[string][]string{"objectClass": {"group"}, "cn": {"Loop B"},
+        "member": {"CN=Loop A,OU=Groups,DC=corp,DC=test", "CN=Developers,OU=Groups,DC=corp,DC=test"}}},
+  }
+}
+
+func newTestAD(t *testing.T, srv *testServer) *Info {
+  cfg := base.AuthConfig{ CODE: "ad", TypeAuth: "openldap",
+                           LDAP: base.LDAPInfo{ Flavor: "AD",
+                                Host: "127.0.0.1",
+                                Port: srv.port(),
+                                Ldap_bind_user: "CN=svc,CN=Users,DC=corp,DC=test",
+                                Ldap_bind_pwd: "password",
+                                Ldap_base_dn: "DC=corp,DC=test"}}
+  l := New(&cfg)
+  assert.Equal(t, true, l.Init())
+  return l
+}
+
+func TestADLogin(t *testing.T) {
+  srv := newTestServer(t, testADDirectory()...)
+  defer srv.close()
+  l := newTestAD(t, srv)
+  defer l.Close()
+
+  assert.Equal(t, adFilterUser, l.LDAP.Ldap_filter_user)
+  assert.Equal(t, "sAMAccountName", l.LDAP.Ldap_attr_login)
+  assert.Equal(t, "objectGUID", l.LDAP.Ldap_attr_id)
+
+  for _, login := range []string{"alice", "ALICE", "alice@corp.test"} {
+    user, ok := l.Login(login, "alice-pwd")
+    assert.Equal(t, true, ok, login)
+    assert.Equal(t, "alice", user.Login)
+    assert.Equal(t, "alice.smith@corp.test", user.EMail)
+    assert.Equal(t, "3f2504e0-4f89-11d3-9a0c-0305e82c3301", user.ID.String())
+    // Nested groups with the cycle
+    assert.ElementsMatch(t, []string{"Staff", "Developers", "Loop A", "Loop B"}, user.Groups)
+  }
+  assert.Equal(t, `(&(objectClass=group)(member:1.2.840.113556.1.4.1941:=CN=Alice Smith,OU=Staff,DC=corp,DC=test))`, srv.lastFilter())
+
+  _, ok := l.Login("alice", "bob-pwd")
+  assert.Equal(t, false, ok)
+
+  // Disabled account
+  _, ok = l.Login("bob", "bob-pwd")
+  assert.Equal(t, false, ok)
+}
+
+func TestADAccountControl(t *testing.T) {
+  l := &Info{}
+  l.LDAP.Flavor = FlavorAD
+  entry := func(uac string) *ldap.Entry {
+    return ldap.NewEntry("CN=x", map[string][]string{"userAccountControl": {uac}})
+  }
+  assert.Equal(t, false, l.accountDisabled(entry("512")))
+  assert.Equal(t, true, l.accountDisabled(entry("514")))
+  assert.Equal(t, true, l.accountDisabled(entry("528")))
+  assert.Equal(t, true, l.accountDisabled(entry("bad")))
+  assert.Equal(t, false, l.accountDisabled(ldap.NewEntry("CN=x", nil)))
+
+  l.LDAP.Flavor = FlavorOpenLDAP
+  assert.Equal(t, false, l.accountDisabled(entry("514")))
+
+  id, ok := parseObjectGUID([]byte(testObjectGUID))
+  assert.Equal(t, true, ok)
+  assert.Equal(t, uuid.MustParse("3f2504e0-4f89-11d3-9a0c-0305e82c3301"), id)
+  _, ok = parseObjectGUID([]byte{1, 2, 3})
+  assert.Equal(t, false, ok)
+}
+
+func TestADFlavorDefaults(t *testing.T) {
+  l := &Info{}
+  l.LDAP.Flavor = FlavorAD
+  l.LDAP.Ldap_attr_id = "employeeNumber"
+  l.LDAP.Ldap_filter_user = "(userPrincipalName=%s)"
+  l.applyFlavor()
+  // The configured fields are kept
+  assert.Equal(t, "employeeNumber", l.LDAP.Ldap_attr_id)
+  assert.Equal(t, "(userPrincipalName=%s)", l.LDAP.Ldap_filter_user)
+  assert.Equal(t, "sAMAccountName", l.LDAP.Ldap_attr_login)
+  assert.Equal(t, adFilterGroup, l.LDAP.Ldap_filter_group)
+
+  l.LDAP.Ldap_attr_login = "mail"
+  l.applyFlavor()
+  assert.Equal(t, "mail", l.LDAP.Ldap_attr_login)
+  assert.Equal(t, "mail", l.loginAttr())
+
+  l = &Info{}
+  l.LDAP.Flavor = FlavorAD
+  l.applyFlavor()
+  assert.Equal(t, "objectGUID", l.LDAP.Ldap_attr_id)
+
+  l = &Info{}
+  l.applyFlavor()
+  assert.Equal(t, "", l.LDAP.Ldap_attr_id)
+  assert.Equal(t, "", l.LDAP.Ldap_attr_login)
+  assert.Equal(t, "uid", l.loginAttr())
+}
@@ -0,0 +1,173 @@
+package openldap
+
+import (
+  "fmt"
+  "context"
+  "strings"
+  "net/http"
+  "encoding/base64"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const defaultAvatarMaxSize = 64 * 1024
+
+// The number of gidNumbers in one search of the groups of the listing
+const gidBatchSize = 100
+
+// userList is the state of the listing of the users
+type userList struct {
+  // gidNumber -> the name of the posixGroup, read once for the whole listing
+  gids map[string]string
+}
+
+// attrName returns the configured attribute or the default one
+func attrName(configured string, def string) string {
+  if configured != "" {
+    return configured
+  }
+  return def
+}
+
+func (a *Info) userAttributes() []string {
+  attrs := []string{"dn", "uid", "cn",
+    attrName(a.LDAP.Ldap_attr_email, "mail"),
+    attrName(a.LDAP.Ldap_attr_first_name, "givenName"),
+    attrName(a.LDAP.Ldap_attr_last_name, "sn"),
+    attrName(a.LDAP.Ldap_attr_display_name, "displayName"),
+    attrName(a.LDAP.Ldap_attr_language, "preferredLanguage"),
+  }
+  if a.LDAP.Ldap_attr_login != "" {
+    attrs = append(attrs, a.LDAP.Ldap_attr_login)
+  }
+  if a.LDAP.Ldap_attr_id != "" {
+    attrs = append(attrs, a.LDAP.Ldap_attr_id)
+  }
+  if a.LDAP.Ldap_attr_avatar != "" {
+    attrs = append(attrs, a.LDAP.Ldap_attr_avatar)
+  }
+  if a.LDAP.Ldap_attr_group != "" {
+    attrs = append(attrs, a.LDAP.Ldap_attr_group)
+  }
+  for _, attr := range a.LDAP.Ldap_attr_extra {
+    attrs = append(attrs, attr)
+  }
+  if a.isAD() {
+    attrs = append(attrs, "sAMAccountName", "userPrincipalName", "objectGUID", "userAccountControl")
+  }
+  return attrs
+}
+
+// mapUser fills the user with the attributes of the entry.
+// The listing (list != nil) has no avatar and takes the primary groups from the list
+func (a *Info) mapUser(ctx context.Context, entry *ldap.Entry, user *base.User, list *userList) {
+  user.EMail = entry.GetEqualFoldAttributeValue(attrName(a.LDAP.Ldap_attr_email, "mail"))
+  user.DisplayName = entry.GetEqualFoldAttributeValue(attrName(a.LDAP.Ldap_attr_display_name, "displayName"))
+  if user.DisplayName == "" {
+    first := entry.GetEqualFoldAttributeValue(attrName(a.LDAP.Ldap_attr_first_name, "givenName"))
+    last := entry.GetEqualFoldAttributeValue(attrName(a.LDAP.Ldap_attr_last_name, "sn"))
+    user.DisplayName = strings.TrimSpace(first + " " + last)
+  }
+  if user.DisplayName == "" {
+    user.DisplayName = entry.GetEqualFoldAttributeValue("cn")
+  }
+  if a.LDAP.Ldap_attr_avatar != "" && list == nil {
+    user.Avatar = avatarURL(entry.GetEqualFoldRawAttributeValue(a.LDAP.Ldap_attr_avatar), a.avatarMaxSize())
+  }
+  user.Language = entry.GetEqualFoldAttributeValue(attrName(a.LDAP.Ldap_attr_language, "preferredLanguage"))
+  if a.LDAP.Ldap_attr_group != "" {
+    value := entry.GetEqualFoldAttributeValue(a.LDAP.Ldap_attr_group)
+    if list != nil && a.gidGroup() {
+      user.Group = list.gids[value]
+    } else {
+      user.Group = a.primaryGroup(ctx, value)
+    }
+  }
+  if len(a.LDAP.Ldap_attr_extra) > 0 {
+    user.Attributes = make(map[string][]string, len(a.LDAP.Ldap_attr_extra))
+    for name, attr := range a.LDAP.Ldap_attr_extra {
+      if values := entry.GetEqualFoldAttributeValues(attr); len(values) > 0 {
+        user.Attributes[name] = values
+      }
+    }
+  }
+}
+
+func (a *Info) avatarMaxSize() int {
+  if a.LDAP.Ldap_avatar_max_size > 0 {
+    return a.LDAP.Ldap_avatar_max_size
+  }
+  return defaultAvatarMaxSize
+}
+
+// avatarURL keeps the URLs and makes a data URL of the binary photo up to max bytes
+func avatarURL(buf []byte, max int) string {
+  if len(buf) == 0 {
+    return ""
+  }
+  if len(buf) > max {
+    glog.Warningf("WRN: LDAP: Avatar of %d bytes is skipped (max=%d)", len(buf), max)
+    return ""
+  }
+  str := string(buf)
+  if strings.HasPrefix(str, "http://") || strings.HasPrefix(str, "https://") {
+    return str
+  }
+  contentType := http.DetectContentType(buf)
+  if !strings.HasPrefix(contentType, "image/") {
+    glog.Warningf("WRN: LDAP: Avatar of type '%s' is skipped", contentType)
+    return ""
+  }
+  return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(buf)
+}
+
+// primaryGroup returns the name of the group: the first RDN of the DN
+// or the cn of the posixGroup with the gidNumber
+func (a *Info) primaryGroup(ctx context.Context, value string) string {
+  if value == "" {
+    return ""
+  }
+  if a.gidGroup() {
+    str_filter := fmt.Sprintf("(&(objectClass=posixGroup)(gidNumber=%s))", ldap.EscapeFilter(value))
+    sr, err := a.search(ctx, ldap.NewSearchRequest(a.LDAP.Ldap_base_dn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 1, 0, false,
+                                                   str_filter, []string{"cn"}, nil))
+    if err != nil || len(sr.Entries) == 0 {
+      glog.Errorf("ERR: LDAP SEARCH (%s): group is not found: %v", str_filter, err)
+      return ""
+    }
+    return sr.Entries[0].GetEqualFoldAttributeValue("cn")
+  }
+  if dn, err := ldap.ParseDN(value); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+    return dn.RDNs[0].Attributes[0].Value
+  }
+  return value
+}
+
+func (a *Info) gidGroup() bool {
+  return strings.EqualFold(a.LDAP.Ldap_attr_group, "gidNumber")
+}
+
+// primaryGroups reads the names of the posixGroups of the gidNumbers by batches
+func (a *Info) primaryGroups(ctx context.Context, gids []string) (map[string]string, error) {
+  res := make(map[string]string, len(gids))
+  for start := 0; start < len(gids); start += gidBatchSize {
+    end := start + gidBatchSize
+    if end > len(gids) {
+      end = len(gids)
+    }
+    var sb strings.Builder
+    for _, gid := range gids[start:end] {
+      sb.WriteString("(gidNumber=" + ldap.EscapeFilter(gid) + ")")
+    }
+    entries, err := a.searchPaged(ctx, "(&(objectClass=posixGroup)(|" + sb.String() + "))", []string{"cn", "gidNumber"})
+    if err != nil {
+      return nil, err
+    }
+    for _, entry := range entries {
+      res[entry.GetEqualFoldAttributeValue("gidNumber")] = entry.GetEqualFoldAttributeValue("cn")
+    }
+  }
+  return res, nil
+}
@@ -0,0 +1,65 @@
+package openldap
+
+import (
+  "testing"
+  "encoding/base64"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestLDAPAttrs(t *testing.T) {
+  photo := "\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01"
+  entries := append(testDirectory(),
+    testEntry{DN: "uid=carol,ou=users,dc=test", Attrs: map[string][]string{"uid": {"carol"}, "Mail": {"carol@test"}, "objectclass": {"organizationalPerson"}, "userpassword": {"carol-pwd"},
+              "givenName": {"Carol"}, "sn": {"Smith"}, "jpegPhoto": {photo}, "preferredLanguage": {"ru"},
+              "gidNumber": {"500"}, "telephoneNumber": {"+1", "+2"}}},
+    testEntry{DN: "uid=dave,ou=users,dc=test", Attrs: map[string][]string{"uid": {"dave"}, "mail": {"dave@test"}, "objectclass": {"organizationalPerson"}, "userpassword": {"dave-pwd"},
+              "displayName": {"Dave D."}, "labeledURI": {"https://test/dave.png"}, "departmentNumber": {"cn=Dev,ou=groups,dc=test"}}},
+    testEntry{DN: "cn=staff,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"staff"}, "objectclass": {"posixGroup"}, "gidNumber": {"500"}}},
+  )
+  srv := newTestServer(t, entries...)
+  defer srv.close()
+
+  // No avatar by default
+  l := newTestLDAP(t, srv)
+  user, ok := l.Login("carol", "carol-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "", user.Avatar)
+  l.Close()
+
+  l = newTestInfo(srv)
+  l.LDAP.Ldap_attr_avatar = "jpegPhoto"
+  l.LDAP.Ldap_attr_group = "gidNumber"
+  l.LDAP.Ldap_attr_extra = map[string]string{"phone": "telephoneNumber"}
+  assert.Equal(t, true, l.Init())
+  user, ok = l.Login("carol", "carol-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "carol@test", user.EMail)
+  assert.Equal(t, "Carol Smith", user.DisplayName)
+  assert.Equal(t, "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString([]byte(photo)), user.Avatar)
+  assert.Equal(t, "ru", user.Language)
+  assert.Equal(t, "staff", user.Group)
+  assert.Equal(t, map[string][]string{"phone": {"+1", "+2"}}, user.Attributes)
+  l.Close()
+
+  l = newTestInfo(srv)
+  l.LDAP.Ldap_attr_avatar = "labeledURI"
+  l.LDAP.Ldap_attr_group = "departmentNumber"
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+  user, ok = l.Login("dave", "dave-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Dave D.", user.DisplayName)
+  assert.Equal(t, "https://test/dave.png", user.Avatar)
+  assert.Equal(t, "Dev", user.Group)
+  assert.Nil(t, user.Attributes)
+
+  // No name attributes at all
+  user, ok = l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "", user.DisplayName)
+  assert.Equal(t, "", user.Avatar)
+
+  assert.Equal(t, "", avatarURL([]byte("plain text"), defaultAvatarMaxSize))
+  assert.Equal(t, "", avatarURL([]byte(photo), 4))
+  assert.Equal(t, "https://test/dave.png", avatarURL([]byte("https://test/dave.png"), 100))
+}
@@ -0,0 +1,166 @@
+package openldap
+
+import (
+  "fmt"
+  "context"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const defaultPageSize = 500
+
+// entryUser makes the user of the entry without the groups, see mapUser for the list
+func (a *Info) entryUser(ctx context.Context, entry *ldap.Entry, login string, list *userList) (base.User, bool) {
+  user := base.User{Login: login}
+  if a.isAD() && entry.GetEqualFoldAttributeValue(a.loginAttr()) != "" {
+    // The same login for sAMAccountName and userPrincipalName
+    user.Login = entry.GetEqualFoldAttributeValue(a.loginAttr())
+  }
+  id, ok := a.userID(entry, user.Login)
+  if !ok {
+    glog.Errorf("ERR: LDAP: Entry '%s' has no %s for the user ID", entry.DN, a.LDAP.Ldap_attr_id)
+    return base.User{}, false
+  }
+  user.ID = id
+  a.mapUser(ctx, entry, &user, list)
+  return user, true
+}
+
+// ListUsers returns all users of filter_user
+func (a *Info) ListUsers(ctx context.Context) ([]base.User, error) {
+  return a.listUsers(ctx, a.allUsersFilter())
+}
+
+// SearchUsers returns the users with the query in the login, the name or the email
+func (a *Info) SearchUsers(ctx context.Context, query string) ([]base.User, error) {
+  if query == "" {
+    return a.ListUsers(ctx)
+  }
+  q := ldap.EscapeFilter(query)
+  str_filter := fmt.Sprintf("(&%s(|(%s=*%s*)(%s=*%s*)(%s=*%s*)(cn=*%s*)))", a.allUsersFilter(),
+                            a.loginAttr(), q,
+                            attrName(a.LDAP.Ldap_attr_email, "mail"), q,
+                            attrName(a.LDAP.Ldap_attr_display_name, "displayName"), q,
+                            q)
+  return a.listUsers(ctx, str_filter)
+}
+
+// ListGroups returns the names of all groups
+func (a *Info) ListGroups(ctx context.Context) ([]string, error) {
+  entries, err := a.searchPaged(ctx, a.allGroupsFilter(), []string{a.groupNameAttr()})
+  if err != nil {
+    return nil, err
+  }
+  groups := make([]string, 0, len(entries))
+  for _, entry := range entries {
+    if name := entry.GetEqualFoldAttributeValue(a.groupNameAttr()); name != "" {
+      groups = append(groups, name)
+    }
+  }
+  return groups, nil
+}
+
+func (a *Info) loginAttr() string {
+  return attrName(a.LDAP.Ldap_attr_login, "uid")
+}
+
+// allUsersFilter puts * instead of the login into filter_user
+func (a *Info) allUsersFilter() string {
+  return fmt.Sprintf(a.LDAP.Ldap_filter_user, "*")
+}
+
+// allGroupsFilter takes the object class of the group style, of class_group or of the flavor
+func (a *Info) allGroupsFilter() string {
+  switch {
+    case a.LDAP.Ldap_class_group != "":
+      return fmt.Sprintf("(objectClass=%s)", ldap.EscapeFilter(a.LDAP.Ldap_class_group))
+    case a.isAD():
+      return "(objectClass=group)"
+    case a.groupStyle() == GroupStyleGroupOfNames:
+      return "(objectClass=groupOfNames)"
+    case a.groupStyle() == GroupStyleGroupOfUniqueNames:
+      return "(objectClass=groupOfUniqueNames)"
+    case a.groupStyle() == GroupStylePosixGroup:
+      return "(objectClass=posixGroup)"
+  }
+  return "(|(objectClass=groupOfNames)(objectClass=groupOfUniqueNames)(objectClass=posixGroup))"
+}
+
+// listUsers returns the disabled users too with Disable set, the users have no avatar
+func (a *Info) listUsers(ctx context.Context, str_filter string) ([]base.User, error) {
+  attrs := make([]string, 0)
+  for _, attr := range a.userAttributes() {
+    if attr != a.LDAP.Ldap_attr_avatar {
+      attrs = append(attrs, attr)
+    }
+  }
+  entries, err := a.searchPaged(ctx, str_filter, attrs)
+  if err != nil {
+    return nil, err
+  }
+  list := &userList{}
+  if a.LDAP.Ldap_attr_group != "" && a.gidGroup() {
+    gids := make([]string, 0)
+    seen := make(map[string]bool)
+    for _, entry := range entries {
+      gid := entry.GetEqualFoldAttributeValue(a.LDAP.Ldap_attr_group)
+      if gid != "" && !seen[gid] {
+        seen[gid] = true
+        gids = append(gids, gid)
+      }
+    }
+    if list.gids, err = a.primaryGroups(ctx, gids); err != nil {
+      return nil, err
+    }
+  }
+  users := make([]base.User, 0, len(entries))
+  for _, entry := range entries {
+    login := entry.GetEqualFoldAttributeValue(a.loginAttr())
+    if login == "" {
+      continue
+    }
+    if user, ok := a.entryUser(ctx, entry, login, list); ok {
+      user.Disable = a.accountDisabled(entry)
+      users = append(users, user)
+    }
+  }
+  return users, nil
+}
+
+// searchPaged runs the search with the paged results control, it returns when ctx is done
+func (a *Info) searchPaged(ctx context.Context, str_filter string, attrs []string) ([]*ldap.Entry, error) {
+  if a.admin == nil {
+    return nil, ErrNotConnected
+  }
+  pageSize := a.LDAP.Ldap_page_size
+  if pageSize <= 0 {
+    pageSize = defaultPageSize
+  }
+  if glog.V(9) {
+    glog.Infof("DBG: LDAP Paged SearchRequest (%s)\n", str_filter)
+  }
+  var entries []*ldap.Entry
+  var err error
+  errCtx := base.RunContext(ctx, func() {
+    err = a.admin.do(ctx, func(conn *ldap.Conn) error {
+      // The request keeps the cookie, the repeated search starts again
+      req := ldap.NewSearchRequest(a.LDAP.Ldap_base_dn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+                                   str_filter, attrs, nil)
+      sr, err := conn.SearchWithPaging(req, uint32(pageSize))
+      if err == nil {
+        entries = sr.Entries
+      }
+      return err
+    })
+  })
+  if errCtx != nil {
+    return nil, errCtx
+  }
+  if err != nil {
+    glog.Errorf("ERR: LDAP SEARCH (%s): %s\n", str_filter, err)
+    return nil, err
+  }
+  return entries, nil
+}
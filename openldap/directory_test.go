@@ -0,0 +1,142 @@
+package openldap
+
+import (
+  "fmt"
+  "context"
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestLDAPListUsers(t *testing.T) {
+  entries := testDirectory()
+  for i := 0; i < 7; i++ {
+    login := fmt.Sprintf("user%d", i)
+    entries = append(entries, testEntry{DN: "uid=" + login + ",ou=users,dc=test", Attrs: map[string][]string{"uid": {login}, "mail": {login + "@test"},
+                                        "displayName": {fmt.Sprintf("User Number %d", i)}, "objectclass": {"organizationalPerson"}}})
+  }
+  srv := newTestServer(t, entries...)
+  defer srv.close()
+  l := newTestInfo(srv)
+  l.LDAP.Ldap_page_size = 3
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+
+  users, err := l.ListUsers(context.Background())
+  assert.Nil(t, err)
+  assert.Equal(t, 10, len(users))
+  // 10 entries by 3
+  assert.Equal(t, 4, srv.pages)
+  assert.Equal(t, "alice", users[0].Login)
+  assert.Equal(t, "alice@test", users[0].EMail)
+  assert.Equal(t, "user6", users[9].Login)
+  assert.Equal(t, "User Number 6", users[9].DisplayName)
+  assert.NotEqual(t, users[8].ID, users[9].ID)
+
+  users, err = l.SearchUsers(context.Background(), "number 1")
+  assert.Nil(t, err)
+  assert.Equal(t, 1, len(users))
+  assert.Equal(t, "user1", users[0].Login)
+
+  // The query is escaped
+  users, err = l.SearchUsers(context.Background(), "*")
+  assert.Nil(t, err)
+  assert.Equal(t, 1, len(users))
+  assert.Equal(t, "a*", users[0].Login)
+
+  users, err = l.SearchUsers(context.Background(), "bob@")
+  assert.Nil(t, err)
+  assert.Equal(t, 1, len(users))
+
+  groups, err := l.ListGroups(context.Background())
+  assert.Nil(t, err)
+  assert.Equal(t, []string{}, groups)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  _, err = l.ListUsers(ctx)
+  assert.Equal(t, context.Canceled, err)
+}
+
+func TestLDAPListGroups(t *testing.T) {
+  srv := newTestServer(t, testGroupDirectory()...)
+  defer srv.close()
+  l := newTestInfo(srv)
+  l.LDAP.Ldap_page_size = 2
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+
+  groups, err := l.ListGroups(context.Background())
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"dev", "staff", "all", "web", "posix"}, groups)
+
+  l.LDAP.Ldap_group_style = "posixGroup"
+  groups, err = l.ListGroups(context.Background())
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"posix"}, groups)
+
+  l.LDAP.Ldap_class_group = "groupOfUniqueNames"
+  groups, err = l.ListGroups(context.Background())
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"web"}, groups)
+}
+
+func TestLDAPListUsersAttrs(t *testing.T) {
+  entries := testDirectory()
+  for i := 0; i < 6; i++ {
+    login := fmt.Sprintf("user%d", i)
+    entries = append(entries, testEntry{DN: "uid=" + login + ",ou=users,dc=test", Attrs: map[string][]string{"uid": {login}, "objectclass": {"organizationalPerson"},
+                                        "gidNumber": {fmt.Sprintf("50%d", i % 2)}, "jpegPhoto": {"\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01"}}})
+  }
+  entries = append(entries,
+    testEntry{DN: "cn=staff,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"staff"}, "objectclass": {"posixGroup"}, "gidNumber": {"500"}}},
+    testEntry{DN: "cn=dev,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"dev"}, "objectclass": {"posixGroup"}, "gidNumber": {"501"}}})
+  srv := newTestServer(t, entries...)
+  defer srv.close()
+  l := newTestInfo(srv)
+  l.LDAP.Ldap_attr_avatar = "jpegPhoto"
+  l.LDAP.Ldap_attr_group = "gidNumber"
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+
+  srv.mu.Lock()
+  srv.filters = nil
+  srv.mu.Unlock()
+  users, err := l.ListUsers(context.Background())
+  assert.Nil(t, err)
+  assert.Equal(t, 9, len(users))
+  assert.Equal(t, "user0", users[3].Login)
+  assert.Equal(t, "staff", users[3].Group)
+  assert.Equal(t, "dev", users[4].Group)
+  assert.Equal(t, "", users[4].Avatar)
+  // The users and the groups, no search by the user
+  srv.mu.Lock()
+  assert.Equal(t, 2, len(srv.filters))
+  srv.mu.Unlock()
+}
+
+func TestADListUsers(t *testing.T) {
+  entries := append(testADDirectory(), testEntry{DN: "CN=Carol Gone,OU=Staff,DC=corp,DC=test", Attrs: map[string][]string{
+                      "objectCategory": {"person"}, "objectClass": {"top", "person", "user"},
+                      "sAMAccountName": {"carol"}, "objectGUID": {"0123456789abcdef"}, "userAccountControl": {"514"}}})
+  srv := newTestServer(t, entries...)
+  defer srv.close()
+  l := newTestAD(t, srv)
+  defer l.Close()
+
+  // The disabled accounts are listed with Disable
+  users, err := l.ListUsers(context.Background())
+  assert.Nil(t, err)
+  assert.Equal(t, 2, len(users))
+  assert.Equal(t, "alice", users[0].Login)
+  assert.Equal(t, false, users[0].Disable)
+  assert.Equal(t, "carol", users[1].Login)
+  assert.Equal(t, true, users[1].Disable)
+}
+
+func TestLDAPListNotConnected(t *testing.T) {
+  l := New(&base.AuthConfig{CODE: "ldap1", TypeAuth: "openldap"})
+  _, err := l.ListUsers(context.Background())
+  assert.Equal(t, ErrNotConnected, err)
+}
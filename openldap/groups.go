@@ -0,0 +1,276 @@
+package openldap
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "context"
+  "strings"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/golang/glog"
+)
+
+const (
+  GroupStyleGroupOfNames       = "groupofnames"
+  GroupStyleGroupOfUniqueNames = "groupofuniquenames"
+  GroupStylePosixGroup         = "posixgroup"
+  // The groups are in the memberOf attribute of the user and of the groups
+  GroupStyleMemberOf           = "memberof"
+
+  // The group filters have the login as %[1]s and the DN as %[2]s
+  filterGroupOfNames       = "(&(objectClass=groupOfNames)(member=%[2]s))"
+  filterGroupOfUniqueNames = "(&(objectClass=groupOfUniqueNames)(uniqueMember=%[2]s))"
+  filterPosixGroup         = "(&(objectClass=posixGroup)(memberUid=%[1]s))"
+  // Parents of the group with the custom filter_group
+  filterParentGroup        = "(|(member=%[2]s)(uniqueMember=%[2]s))"
+
+  maxGroupDepth = 32
+)
+
+type groupNode struct {
+  DN       string
+  Name     string
+  // memberOf of the group
+  Parents  []string
+}
+
+const defaultGroupCacheSize = 10000
+
+type groupCacheItem struct {
+  nodes    []groupNode
+  expires  time.Time
+}
+
+// groupCache keeps the results of the group searches by the filter or the DN.
+// The expired entries are swept when the cache is full, then the oldest one is dropped
+type groupCache struct {
+  ttl      time.Duration
+  size     int
+  mu       sync.Mutex
+  items    map[string]groupCacheItem
+}
+
+func newGroupCache(ttl time.Duration, size int) *groupCache {
+  if ttl <= 0 {
+    return nil
+  }
+  if size <= 0 {
+    size = defaultGroupCacheSize
+  }
+  return &groupCache{ttl: ttl, size: size, items: make(map[string]groupCacheItem)}
+}
+
+func (c *groupCache) get(key string) ([]groupNode, bool) {
+  if c == nil {
+    return nil, false
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  item, ok := c.items[key]
+  if !ok || time.Now().After(item.expires) {
+    delete(c.items, key)
+    return nil, false
+  }
+  return item.nodes, true
+}
+
+func (c *groupCache) set(key string, nodes []groupNode) {
+  if c == nil {
+    return
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  now := time.Now()
+  if _, ok := c.items[key]; !ok && len(c.items) >= c.size {
+    c.sweep(now)
+  }
+  c.items[key] = groupCacheItem{nodes: nodes, expires: now.Add(c.ttl)}
+}
+
+// sweep drops the expired entries or the oldest one if none has expired
+func (c *groupCache) sweep(now time.Time) {
+  oldest := ""
+  for key, item := range c.items {
+    if now.After(item.expires) {
+      delete(c.items, key)
+    } else if oldest == "" || item.expires.Before(c.items[oldest].expires) {
+      oldest = key
+    }
+  }
+  if len(c.items) >= c.size && oldest != "" {
+    delete(c.items, oldest)
+  }
+}
+
+func (c *groupCache) clear() {
+  if c == nil {
+    return
+  }
+  c.mu.Lock()
+  c.items = make(map[string]groupCacheItem)
+  c.mu.Unlock()
+}
+
+func (a *Info) groupStyle() string {
+  return strings.ToLower(a.LDAP.Ldap_group_style)
+}
+
+// applyGroupStyle sets the filter of the style to the empty filter_group
+func (a *Info) applyGroupStyle() {
+  if a.LDAP.Ldap_filter_group == "" {
+    switch a.groupStyle() {
+      case GroupStyleGroupOfNames:
+        a.LDAP.Ldap_filter_group = filterGroupOfNames
+      case GroupStyleGroupOfUniqueNames:
+        a.LDAP.Ldap_filter_group = filterGroupOfUniqueNames
+      case GroupStylePosixGroup:
+        a.LDAP.Ldap_filter_group = filterPosixGroup
+    }
+  }
+  a.groupCache = newGroupCache(time.Duration(a.LDAP.Ldap_group_cache) * time.Second, a.LDAP.Ldap_group_cache_size)
+}
+
+func (a *Info) groupNameAttr() string {
+  return attrName(a.LDAP.Ldap_attr_group_name, "cn")
+}
+
+// getGroupsOfUser returns the names of the groups of the user with the nested ones up to group_depth
+func (a *Info) getGroupsOfUser(ctx context.Context, username string, userdn string) ([]string, error) {
+  level, err := a.directGroups(ctx, username, userdn)
+  if err != nil {
+    return nil, err
+  }
+  depth := a.LDAP.Ldap_group_depth
+  if depth > maxGroupDepth {
+    depth = maxGroupDepth
+  }
+  groups := []string{}
+  seen := map[string]bool{strings.ToLower(userdn): true}
+  for i := 0; len(level) > 0; i++ {
+    next := []groupNode{}
+    for _, node := range level {
+      key := strings.ToLower(node.DN)
+      if seen[key] {
+        // The cycle or the group reached by several paths
+        continue
+      }
+      seen[key] = true
+      if node.Name != "" {
+        groups = append(groups, node.Name)
+      }
+      if i >= depth {
+        continue
+      }
+      parents, err := a.parentGroups(ctx, node)
+      if err != nil {
+        return groups, err
+      }
+      next = append(next, parents...)
+    }
+    level = next
+  }
+  return groups, nil
+}
+
+func (a *Info) directGroups(ctx context.Context, username string, userdn string) ([]groupNode, error) {
+  if a.groupStyle() == GroupStyleMemberOf {
+    user, err := a.groupEntry(ctx, userdn)
+    if err != nil || user == nil {
+      return nil, err
+    }
+    return a.groupEntries(ctx, user.Parents)
+  }
+  return a.searchGroups(ctx, a.groupFilter(username, userdn))
+}
+
+// parentGroups returns the groups having the group as a member
+func (a *Info) parentGroups(ctx context.Context, node groupNode) ([]groupNode, error) {
+  switch a.groupStyle() {
+    case GroupStyleMemberOf:
+      return a.groupEntries(ctx, node.Parents)
+    case GroupStylePosixGroup:
+      // The members of posixGroup are the logins
+      return nil, nil
+    case GroupStyleGroupOfNames:
+      return a.searchGroups(ctx, fmt.Sprintf(filterGroupOfNames, "", ldap.EscapeFilter(node.DN)))
+    case GroupStyleGroupOfUniqueNames:
+      return a.searchGroups(ctx, fmt.Sprintf(filterGroupOfUniqueNames, "", ldap.EscapeFilter(node.DN)))
+  }
+  return a.searchGroups(ctx, fmt.Sprintf(filterParentGroup, "", ldap.EscapeFilter(node.DN)))
+}
+
+func (a *Info) searchGroups(ctx context.Context, str_filter string) ([]groupNode, error) {
+  if nodes, ok := a.groupCache.get(str_filter); ok {
+    return nodes, nil
+  }
+  searchRequest := ldap.NewSearchRequest(
+    a.LDAP.Ldap_base_dn,
+    ldap.ScopeWholeSubtree,
+    ldap.NeverDerefAliases,
+    0,
+    0,
+    false,
+    str_filter,
+    []string{a.groupNameAttr()},
+    nil,
+  )
+  if glog.V(9) {
+    glog.Infof("DBG: LDAP SearchRequest (%s)\n", str_filter)
+  }
+  sr, err := a.search(ctx, searchRequest)
+  if err != nil {
+    glog.Errorf("ERR: LDAP SEARCH (%s): %s\n", str_filter, err)
+    return nil, err
+  }
+  nodes := make([]groupNode, 0, len(sr.Entries))
+  for _, entry := range sr.Entries {
+    nodes = append(nodes, groupNode{DN: entry.DN, Name: entry.GetEqualFoldAttributeValue(a.groupNameAttr())})
+  }
+  a.groupCache.set(str_filter, nodes)
+  return nodes, nil
+}
+
+func (a *Info) groupEntries(ctx context.Context, dns []string) ([]groupNode, error) {
+  nodes := make([]groupNode, 0, len(dns))
+  for _, dn := range dns {
+    node, err := a.groupEntry(ctx, dn)
+    if err != nil {
+      return nodes, err
+    }
+    if node != nil {
+      nodes = append(nodes, *node)
+    }
+  }
+  return nodes, nil
+}
+
+// groupEntry reads the name and memberOf of the entry, nil if it does not exist
+func (a *Info) groupEntry(ctx context.Context, dn string) (*groupNode, error) {
+  key := "dn:" + strings.ToLower(dn)
+  if nodes, ok := a.groupCache.get(key); ok {
+    if len(nodes) == 0 {
+      return nil, nil
+    }
+    return &nodes[0], nil
+  }
+  searchRequest := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+                                         "(objectClass=*)", []string{a.groupNameAttr(), "memberOf"}, nil)
+  sr, err := a.search(ctx, searchRequest)
+  if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+    a.groupCache.set(key, nil)
+    return nil, nil
+  }
+  if err != nil {
+    glog.Errorf("ERR: LDAP SEARCH (%s): %s\n", dn, err)
+    return nil, err
+  }
+  nodes := []groupNode{}
+  for _, entry := range sr.Entries {
+    nodes = append(nodes, groupNode{DN: entry.DN, Name: entry.GetEqualFoldAttributeValue(a.groupNameAttr()), Parents: entry.GetEqualFoldAttributeValues("memberOf")})
+  }
+  a.groupCache.set(key, nodes)
+  if len(nodes) == 0 {
+    return nil, nil
+  }
+  return &nodes[0], nil
+}
@@ -0,0 +1,131 @@
+package openldap
+
+import (
+  "time"
+  "context"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func testGroupDirectory() []testEntry {
+  return []testEntry{
+    {DN: "cn=admin,dc=test", Attrs: map[string][]string{"cn": {"admin"}, "userpassword": {"password"}}},
+    {DN: "uid=alice,ou=users,dc=test", Attrs: map[string][]string{"uid": {"alice"}, "objectclass": {"organizationalPerson"}, "userpassword": {"alice-pwd"},
+      "memberOf": {"cn=dev,ou=groups,dc=test"}}},
+    {DN: "cn=dev,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"dev"}, "description": {"Developers"}, "objectclass": {"groupOfNames"},
+      "member": {"uid=alice,ou=users,dc=test"}, "memberOf": {"cn=staff,ou=groups,dc=test"}}},
+    {DN: "cn=staff,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"staff"}, "description": {"Staff"}, "objectclass": {"groupOfNames"},
+      "member": {"cn=dev,ou=groups,dc=test", "cn=all,ou=groups,dc=test"}, "memberOf": {"cn=all,ou=groups,dc=test"}}},
+    // The cycle all -> staff -> all
+    {DN: "cn=all,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"all"}, "description": {"All"}, "objectclass": {"groupOfNames"},
+      "member": {"cn=staff,ou=groups,dc=test"}, "memberOf": {"cn=staff,ou=groups,dc=test"}}},
+    {DN: "cn=web,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"web"}, "objectclass": {"groupOfUniqueNames"},
+      "uniqueMember": {"uid=alice,ou=users,dc=test"}}},
+    {DN: "cn=posix,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"posix"}, "objectclass": {"posixGroup"}, "memberUid": {"alice"}}},
+  }
+}
+
+func newTestGroups(t *testing.T, srv *testServer, style string, depth int) *Info {
+  l := newTestInfo(srv)
+  l.LDAP.Ldap_filter_group = ""
+  l.LDAP.Ldap_group_style = style
+  l.LDAP.Ldap_group_depth = depth
+  assert.Equal(t, true, l.Init())
+  return l
+}
+
+func TestLDAPGroupStyles(t *testing.T) {
+  srv := newTestServer(t, testGroupDirectory()...)
+  defer srv.close()
+  userdn := "uid=alice,ou=users,dc=test"
+
+  for style, groups := range map[string][]string{
+      "groupOfNames":       {"dev"},
+      "groupOfUniqueNames": {"web"},
+      "posixGroup":         {"posix"},
+      "memberOf":           {"dev"},
+    } {
+    l := newTestGroups(t, srv, style, 0)
+    res, err := l.getGroupsOfUser(context.Background(), "alice", userdn)
+    assert.Nil(t, err, style)
+    assert.Equal(t, groups, res, style)
+    l.Close()
+  }
+
+  // Nested groups with the cycle
+  for _, style := range []string{"groupOfNames", "memberOf"} {
+    l := newTestGroups(t, srv, style, 10)
+    res, err := l.getGroupsOfUser(context.Background(), "alice", userdn)
+    assert.Nil(t, err, style)
+    assert.Equal(t, []string{"dev", "staff", "all"}, res, style)
+
+    // The depth limit
+    l.LDAP.Ldap_group_depth = 1
+    res, err = l.getGroupsOfUser(context.Background(), "alice", userdn)
+    assert.Nil(t, err, style)
+    assert.Equal(t, []string{"dev", "staff"}, res, style)
+    l.Close()
+  }
+
+  // The name attribute
+  l := newTestGroups(t, srv, "groupOfNames", 10)
+  l.LDAP.Ldap_attr_group_name = "description"
+  res, err := l.getGroupsOfUser(context.Background(), "alice", userdn)
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"Developers", "Staff", "All"}, res)
+  l.Close()
+}
+
+func TestLDAPGroupCache(t *testing.T) {
+  srv := newTestServer(t, testGroupDirectory()...)
+  defer srv.close()
+  l := newTestInfo(srv)
+  l.LDAP.Ldap_filter_group = ""
+  l.LDAP.Ldap_group_style = "groupOfNames"
+  l.LDAP.Ldap_group_depth = 10
+  l.LDAP.Ldap_group_cache = 60
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+
+  count := func() int {
+    srv.mu.Lock()
+    defer srv.mu.Unlock()
+    return len(srv.filters)
+  }
+  res, err := l.getGroupsOfUser(context.Background(), "alice", "uid=alice,ou=users,dc=test")
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"dev", "staff", "all"}, res)
+  searches := count()
+
+  res, err = l.getGroupsOfUser(context.Background(), "alice", "uid=alice,ou=users,dc=test")
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"dev", "staff", "all"}, res)
+  assert.Equal(t, searches, count())
+
+  l.groupCache.clear()
+  l.getGroupsOfUser(context.Background(), "alice", "uid=alice,ou=users,dc=test")
+  assert.Equal(t, true, count() > searches)
+}
+
+func TestLDAPGroupCacheSize(t *testing.T) {
+  c := newGroupCache(time.Minute, 2)
+  c.set("a", []groupNode{{Name: "a"}})
+  time.Sleep(time.Millisecond)
+  c.set("b", nil)
+  c.set("c", nil)
+  assert.Equal(t, 2, len(c.items))
+  // The oldest is dropped
+  _, ok := c.get("a")
+  assert.Equal(t, false, ok)
+  _, ok = c.get("c")
+  assert.Equal(t, true, ok)
+
+  // The expired ones are swept first
+  c.items["b"] = groupCacheItem{expires: time.Now().Add(-time.Second)}
+  c.set("d", nil)
+  assert.Equal(t, 2, len(c.items))
+  _, ok = c.get("c")
+  assert.Equal(t, true, ok)
+  _, ok = c.get("d")
+  assert.Equal(t, true, ok)
+}
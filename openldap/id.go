@@ -0,0 +1,75 @@
+package openldap
+
+import (
+  "io"
+  "fmt"
+  "strings"
+  "crypto/sha1"
+  "encoding/hex"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/google/uuid"
+)
+
+const (
+  // SHA-1 of the login, the IDs of the versions before attr_id.
+  // The providers with the same logins get the same IDs
+  IDFallbackLegacy = "legacy"
+  // SHA-1 of the login in the namespace of the provider code
+  IDFallbackCode   = "code"
+  // The login fails without the unique attribute
+  IDFallbackNone   = "none"
+)
+
+// IDFallback is legacy without attr_id and none with it by default
+func (a *Info) IDFallback() string {
+  if a.LDAP.Ldap_id_fallback != "" {
+    return strings.ToLower(a.LDAP.Ldap_id_fallback)
+  }
+  if a.LDAP.Ldap_attr_id == "" {
+    return IDFallbackLegacy
+  }
+  return IDFallbackNone
+}
+
+// userID returns the ID from the unique attribute of the entry or by the fallback
+func (a *Info) userID(entry *ldap.Entry, login string) (uuid.UUID, bool) {
+  if attr := a.LDAP.Ldap_attr_id; attr != "" {
+    if raw := entry.GetEqualFoldRawAttributeValue(attr); len(raw) > 0 {
+      return a.parseUniqueID(attr, raw), true
+    }
+  }
+  switch a.IDFallback() {
+    case IDFallbackLegacy:
+      h := sha1.New()
+      io.WriteString(h, login)
+      loginHash := fmt.Sprintf("%x", h.Sum(nil))
+      return uuid.NewSHA1(uuid.Nil, ([]byte)(loginHash)), true
+    case IDFallbackCode:
+      return uuid.NewSHA1(a.namespace(), []byte("login:" + strings.ToLower(login))), true
+  }
+  return uuid.Nil, false
+}
+
+// namespace separates the IDs of the providers with the same logins
+func (a *Info) namespace() uuid.UUID {
+  return uuid.NewSHA1(uuid.NameSpaceURL, []byte("ldap:" + a.CODE))
+}
+
+// parseUniqueID converts objectGUID (binary), entryUUID (RFC 4122) and nsUniqueId (8-8-8-8 hex),
+// the other values are hashed in the namespace of the provider
+func (a *Info) parseUniqueID(attr string, raw []byte) uuid.UUID {
+  if strings.EqualFold(attr, "objectGUID") {
+    if id, ok := parseObjectGUID(raw); ok {
+      return id
+    }
+  }
+  str := strings.TrimSpace(string(raw))
+  if id, err := uuid.Parse(str); err == nil {
+    return id
+  }
+  if buf, err := hex.DecodeString(strings.Replace(str, "-", "", -1)); err == nil && len(buf) == 16 {
+    id, _ := uuid.FromBytes(buf)
+    return id
+  }
+  return uuid.NewSHA1(a.namespace(), []byte(attr + ":" + str))
+}
@@ -0,0 +1,57 @@
+package openldap
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "github.com/google/uuid"
+)
+
+func TestLDAPUserID(t *testing.T) {
+  entries := testDirectory()
+  entries[1].Attrs["entryUUID"] = []string{"597ae2f6-16a6-1027-98f4-d28b5365dc14"}
+  entries[2].Attrs["nsUniqueId"] = []string{"66446001-1dd211b2-8c5a8e5c-2bd2d8f4"}
+  srv := newTestServer(t, entries...)
+  defer srv.close()
+
+  // The IDs of the logins stay as before without attr_id
+  l := newTestLDAP(t, srv)
+  user, ok := l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "807c4ec7-8ef9-5067-9d06-71ef9da2bc27", user.ID.String())
+  l.Close()
+
+  l = newTestInfo(srv)
+  l.LDAP.Ldap_attr_id = "entryUUID"
+  assert.Equal(t, true, l.Init())
+  user, ok = l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "597ae2f6-16a6-1027-98f4-d28b5365dc14", user.ID.String())
+  // No entryUUID and no fallback
+  _, ok = l.Login("bob", "bob-pwd")
+  assert.Equal(t, false, ok)
+
+  l.LDAP.Ldap_id_fallback = IDFallbackCode
+  user, ok = l.Login("bob", "bob-pwd")
+  assert.Equal(t, true, ok)
+  bobID := user.ID
+  assert.Equal(t, uuid.NewSHA1(uuid.NewSHA1(uuid.NameSpaceURL, []byte("ldap:ldap1")), []byte("login:bob")), bobID)
+  // Other provider, other ID
+  l.CODE = "ldap2"
+  user, ok = l.Login("bob", "bob-pwd")
+  assert.Equal(t, true, ok)
+  assert.NotEqual(t, bobID, user.ID)
+  l.Close()
+
+  l = newTestInfo(srv)
+  l.LDAP.Ldap_attr_id = "nsUniqueId"
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+  user, ok = l.Login("bob", "bob-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "66446001-1dd2-11b2-8c5a-8e5c2bd2d8f4", user.ID.String())
+
+  // Not a UUID
+  id := l.parseUniqueID("employeeNumber", []byte("42"))
+  assert.Equal(t, id, l.parseUniqueID("employeeNumber", []byte("42")))
+  assert.NotEqual(t, id, l.parseUniqueID("employeeNumber", []byte("43")))
+}
@@ -1,30 +1,41 @@
 package openldap
 
 import (
-  "io"
   "fmt"
-  "crypto/sha1"
-  "sync"
+  "context"
+  "strings"
+  "unicode/utf8"
+  "time"
   "net/http"
   "github.com/go-ldap/ldap/v3"
-  "github.com/google/uuid"
   "github.com/golang/glog"
   "github.com/jinzhu/copier"
   
   "github.com/Lunkov/lib-auth/base"
 )
 
+const maxLoginLength = 256
+
 type Info struct {
   base.AuthConfig     `yaml:"authconfig"`
 
-  LdapConn       *ldap.Conn // Connect for Admin User
-  LdapConnUser   *ldap.Conn // Check user password
-  MUU            sync.RWMutex
-  MUA            sync.RWMutex
+  servers        *serverList
+  admin          *pool // Connects of Admin User
+  users          *pool // Check user password
+  groupCache     *groupCache
 }
 
+// Connected is true after Init, the broken connections are dialed again on use
 func (a *Info) Connected() bool {
-  return a.LdapConn != nil && a.LdapConnUser != nil
+  return a.admin != nil && a.users != nil
+}
+
+// Stats returns the metrics of the connection pools
+func (a *Info) Stats() Stats {
+  if a.admin == nil || a.users == nil {
+    return Stats{}
+  }
+  return Stats{Admin: a.admin.getStats(), User: a.users.getStats(), Servers: a.servers.getStats()}
 }
 
 func New(cfg *base.AuthConfig) *Info {
@@ -35,77 +46,179 @@ func New(cfg *base.AuthConfig) *Info {
 
 func (a *Info) Init() bool {
   var err error
-  str_conn := fmt.Sprintf("%s:%d", a.LDAP.Host, a.LDAP.Port)
-  // User connect
-  a.LdapConnUser, err = ldap.Dial("tcp", str_conn)
+  a.applyFlavor()
+  a.applyGroupStyle()
+  a.servers, err = newServerList(&a.LDAP)
   if err != nil {
-    glog.Errorf("ERR: LDAP (%s): %s\n", str_conn, err)
+    glog.Errorf("ERR: LDAP: %s", err)
     return false
   }
-  // Admin Connect and Bind
-  a.LdapConn, err = ldap.Dial("tcp", str_conn)
-  if err != nil {
-    glog.Errorf("ERR: LDAP (%s): %s", str_conn, err)
-    return false
-  }
-  err = a.LdapConn.Bind(a.LDAP.Ldap_bind_user, a.LDAP.Ldap_bind_pwd)
-  if err != nil {
-    glog.Errorf("ERR: LDAP BIND (%s): %s", a.LDAP.Ldap_bind_user, err)
-    return false
+  str_conn := a.servers.String()
+  healthCheck := time.Duration(a.LDAP.Pool_health_check) * time.Second
+  a.users = newPool("user", a.LDAP.Pool_size, healthCheck, a.servers.dial, nil)
+  a.admin = newPool("admin", a.LDAP.Pool_size, healthCheck, a.servers.dial, func(conn *ldap.Conn) error {
+    err := conn.Bind(a.LDAP.Ldap_bind_user, a.LDAP.Ldap_bind_pwd)
+    if err != nil {
+      glog.Errorf("ERR: LDAP BIND (%s): %s", a.LDAP.Ldap_bind_user, err)
+    }
+    return err
+  })
+  // The first connects check the server and the bind user
+  for _, p := range []*pool{a.users, a.admin} {
+    if err := p.do(context.Background(), func(conn *ldap.Conn) error { return nil }); err != nil {
+      glog.Errorf("ERR: LDAP (%s): %s", str_conn, err)
+      return false
+    }
   }
-  glog.Infof("LOG: LDAP %s connected", str_conn)
+  glog.Infof("LOG: LDAP %s connected (tls=%s, pool=%d)", str_conn, tlsMode(&a.LDAP), a.admin.getStats().Size)
   return true
 }
 
 func (a *Info) Close() {
-  if a.LdapConnUser != nil {
-    a.LdapConnUser.Close()
+  a.groupCache.clear()
+  if a.users != nil {
+    a.users.close()
   }
-  if a.LdapConn != nil {
-    a.LdapConn.Close()
+  if a.admin != nil {
+    a.admin.close()
+  }
+  if a.servers != nil {
+    glog.Infof("LOG: LDAP %s disconnected\n", a.servers.String())
   }
-  str_conn := fmt.Sprintf("%s:%d", a.LDAP.Host, a.LDAP.Port)
-  glog.Infof("LOG: LDAP %s disconnected\n", str_conn)
 }
 
 func (a *Info) Login(login string, password string) (base.User, bool) {
-  user := base.User{}
-  if a.LdapConn == nil || a.LdapConnUser == nil {
+  return a.LoginContext(context.Background(), login, password)
+}
+
+// LoginContext returns when ctx is done even if the LDAP server does not answer
+func (a *Info) LoginContext(ctx context.Context, login string, password string) (base.User, bool) {
+  user, err := a.Authenticate(ctx, login, password)
+  return user, err == nil
+}
+
+// Authenticate is LoginContext with the reason of the failure, see the Err* errors
+func (a *Info) Authenticate(ctx context.Context, login string, password string) (base.User, error) {
+  var user base.User
+  var err error
+  errCtx := base.RunContext(ctx, func() {
+    user, err = a.login(ctx, login, password)
+  })
+  if errCtx != nil {
+    glog.Errorf("ERR: LDAP: Login(%s): %v", login, errCtx)
+    return base.User{}, errCtx
+  }
+  if err != nil {
+    return base.User{}, err
+  }
+  if !a.CheckUserGroups(&user) {
+    return base.User{}, ErrAccessDenied
+  }
+  return user, nil
+}
+
+// LookupUser reads the user by the login without the password, f.e. for the remember-me login.
+// The disabled accounts and the users out of check_groups are refused like on Authenticate
+func (a *Info) LookupUser(ctx context.Context, login string) (base.User, error) {
+  var user base.User
+  var err error
+  errCtx := base.RunContext(ctx, func() {
+    user, err = a.lookupUser(ctx, login)
+  })
+  if errCtx != nil {
+    glog.Errorf("ERR: LDAP: LookupUser(%s): %v", login, errCtx)
+    return base.User{}, errCtx
+  }
+  if err != nil {
+    return base.User{}, err
+  }
+  if !a.CheckUserGroups(&user) {
+    return base.User{}, ErrAccessDenied
+  }
+  return user, nil
+}
+
+func (a *Info) lookupUser(ctx context.Context, login string) (base.User, error) {
+  if !validLogin(login) {
+    return base.User{}, ErrInvalidCredentials
+  }
+  entry, err := a.findUser(ctx, login)
+  if err != nil {
+    return base.User{}, err
+  }
+  groups, err := a.getGroupsOfUser(ctx, login, entry.DN)
+  if err != nil {
+    glog.Errorf("ERR: LDAP: Error getting groups for user %s: %+v", login, err)
+  }
+  user, ok := a.entryUser(ctx, entry, login, nil)
+  if !ok {
+    return base.User{}, ErrInvalidCredentials
+  }
+  user.Groups = groups
+  return user, nil
+}
+
+// findUser returns the only entry of the login
+func (a *Info) findUser(ctx context.Context, login string) (*ldap.Entry, error) {
+  if a.admin == nil || a.users == nil {
     str_conn := fmt.Sprintf("%s:%d", a.LDAP.Host, a.LDAP.Port)
-    glog.Errorf("ERR: AUTH: LOGIN: LDAP NOT CONNECTED (%s, admin=%v, user=%v)", str_conn, a.LdapConn, a.LdapConnUser)
-    return user, false
+    glog.Errorf("ERR: AUTH: LOGIN: LDAP NOT CONNECTED (%s)", str_conn)
+    return nil, ErrNotConnected
   }
-  
+
   // Search for the given username
-  str_filter := fmt.Sprintf(a.LDAP.Ldap_filter_user, login)
+  str_filter := a.userFilter(login)
   searchRequest := ldap.NewSearchRequest(
       a.LDAP.Ldap_base_dn,
       ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
       str_filter,
-      []string{"dn", "mail", "giveName", "uid", "cn"},
+      a.userAttributes(),
       nil,
   )
 
-  a.MUA.RLock()
   if glog.V(9) {
     glog.Infof("DBG: LDAP SearchRequest: '%s'", str_filter)
   }
-  sr, err := a.LdapConn.Search(searchRequest)
-  a.MUA.RUnlock()
+  sr, err := a.search(ctx, searchRequest)
   if err != nil {
     glog.Errorf("ERR: LDAP SEARCH: '%s': %s", str_filter, err)
-    return user, false
+    return nil, err
   }
 
   if len(sr.Entries) != 1 {
     glog.Errorf("ERR: LDAP SEARCH: User does not exist or too many entries returned (result = %d)", len(sr.Entries))
-    return user, false
+    return nil, ErrInvalidCredentials
+  }
+
+  entry := sr.Entries[0]
+  if !a.matchLogin(entry, login) {
+    glog.Errorf("ERR: LDAP SEARCH: Entry '%s' does not match login '%s'", entry.DN, login)
+    return nil, ErrInvalidCredentials
+  }
+  if err := a.accountStatus(entry); err != nil {
+    glog.Errorf("ERR: LDAP: Account '%s': %v", entry.DN, err)
+    return nil, err
   }
+  return entry, nil
+}
 
-  userdn := sr.Entries[0].DN
-  email := sr.Entries[0].GetAttributeValue("mail")
+func (a *Info) login(ctx context.Context, login string, password string) (base.User, error) {
+  var user base.User
+  if !validLogin(login) || password == "" {
+    // The empty password makes an unauthenticated bind which always succeeds
+    glog.Errorf("ERR: LDAP: Login: bad login or empty password (login=%q)", login)
+    return user, ErrInvalidCredentials
+  }
+  entry, err := a.findUser(ctx, login)
+  if err != nil {
+    return user, err
+  }
+  userdn := entry.DN
+  if err := ctx.Err(); err != nil {
+    return user, err
+  }
 
-  groups, err := a.getGroupsOfUser(login)
+  groups, err := a.getGroupsOfUser(ctx, login, userdn)
   if err != nil {
     glog.Errorf("ERR: LDAP: Error getting groups for user %s: %+v", login, err)
   }
@@ -113,27 +226,35 @@ func (a *Info) Login(login string, password string) (base.User, bool) {
     glog.Infof("LOG: LDAP: User '%s' has Groups: %+v", login, groups)
   }
 
+  if err := ctx.Err(); err != nil {
+    return user, err
+  }
   // Bind as the user to verify their password
-  a.MUU.Lock()
-  err = a.LdapConnUser.Bind(userdn, password)
-  a.MUU.Unlock()
+  var policy passwordPolicy
+  err = a.users.do(ctx, func(conn *ldap.Conn) error {
+    var err error
+    policy, err = a.bindUser(conn, userdn, password)
+    return err
+  })
+  if err == nil {
+    err = policy.err
+  }
   if err != nil {
     glog.Errorf("ERR: LDAP BIND (%s): %s\n", userdn, err)
-    return user, false
+    return user, err
   }
   if glog.V(9) {
     glog.Infof("LOG: LDAP: User dn found: %s", userdn)
   }
 
-  h := sha1.New()
-  io.WriteString(h, login)
-  loginHash := fmt.Sprintf("%x", h.Sum(nil))
-  user.ID    = uuid.NewSHA1(uuid.Nil, ([]byte)(loginHash))
-  user.Login = login
-  user.EMail = email
+  user, ok := a.entryUser(ctx, entry, login, nil)
+  if !ok {
+    return user, ErrInvalidCredentials
+  }
   user.Groups = groups
+  policy.setWarnings(&user)
 
-  return user, true
+  return user, nil
 }
   
 func (a *Info) OAuthLogin(w http.ResponseWriter, r *http.Request) {
@@ -147,33 +268,47 @@ func (a *Info) OAuthGetUserData(code string) ([]byte, error) {
   return buf, nil
 }
 
-// GetGroupsOfUser returns the group for a user.
-func (a *Info) getGroupsOfUser(username string) ([]string, error) {
-  str_filter := fmt.Sprintf(a.LDAP.Ldap_filter_group, username)
-  searchRequest := ldap.NewSearchRequest(
-    a.LDAP.Ldap_base_dn,
-    ldap.ScopeWholeSubtree,
-    ldap.NeverDerefAliases,
-    0,
-    0,
-    false,
-    str_filter,
-    []string{"cn"}, // can it be something else than "cn"?
-    nil,
-  )
-  a.MUA.RLock()
-  if glog.V(9) {
-    glog.Infof("DBG: LDAP SearchRequest (%s)\n", str_filter)
-  }
-  sr, err := a.LdapConn.Search(searchRequest)
-  a.MUA.RUnlock()
-  if err != nil {
-    glog.Errorf("ERR: LDAP SEARCH (%s): %s\n", str_filter, err)
+func (a *Info) OAuthGetUserDataContext(ctx context.Context, code string) ([]byte, error) {
+  if err := ctx.Err(); err != nil {
     return nil, err
   }
-  groups := []string{}
-  for _, entry := range sr.Entries {
-    groups = append(groups, entry.GetAttributeValue("cn"))
+  return a.OAuthGetUserData(code)
+}
+
+// search runs the request with an admin connection
+func (a *Info) search(ctx context.Context, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+  var sr *ldap.SearchResult
+  err := a.admin.do(ctx, func(conn *ldap.Conn) error {
+    var err error
+    sr, err = conn.Search(req)
+    return err
+  })
+  return sr, err
+}
+
+// userFilter and groupFilter put the login into the filters escaped by RFC 4515
+func (a *Info) userFilter(login string) string {
+  return fmt.Sprintf(a.LDAP.Ldap_filter_user, ldap.EscapeFilter(login))
+}
+
+// The group filter has the login as %s or %[1]s and the DN of the user as %[2]s
+func (a *Info) groupFilter(login string, userdn string) string {
+  if strings.Contains(a.LDAP.Ldap_filter_group, "%[") {
+    return fmt.Sprintf(a.LDAP.Ldap_filter_group, ldap.EscapeFilter(login), ldap.EscapeFilter(userdn))
+  }
+  return fmt.Sprintf(a.LDAP.Ldap_filter_group, ldap.EscapeFilter(login))
+}
+
+// validLogin rejects the logins with control or LDAP filter characters,
+// the login is escaped in the filters anyway
+func validLogin(login string) bool {
+  if login == "" || len(login) > maxLoginLength || !utf8.ValidString(login) {
+    return false
   }
-  return groups, nil
+  for _, c := range login {
+    if c < 0x20 || c == 0x7f || strings.ContainsRune(`*()\`, c) {
+      return false
+    }
+  }
+  return true
 }
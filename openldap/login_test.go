@@ -0,0 +1,142 @@
+package openldap
+
+import (
+  "fmt"
+  "context"
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "github.com/go-ldap/ldap/v3"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func newTestInfo(srv *testServer) *Info {
+  cfg := base.AuthConfig{ CODE: "ldap1", TypeAuth: "openldap",
+                           LDAP: base.LDAPInfo{ Host: "127.0.0.1",
+                                Port: srv.port(),
+                                Ldap_bind_user: "cn=admin,dc=test",
+                                Ldap_bind_pwd: "password",
+                                Ldap_base_dn: "dc=test",
+                                Ldap_attr_login: "uid",
+                                Ldap_filter_user: "(&(objectClass=organizationalPerson)(uid=%s))",
+                                Ldap_filter_group: "(memberUid=%s)"}}
+  return New(&cfg)
+}
+
+func newTestLDAP(t *testing.T, srv *testServer) *Info {
+  l := newTestInfo(srv)
+  assert.Equal(t, true, l.Init())
+  return l
+}
+
+func testDirectory() []testEntry {
+  return []testEntry{
+    {DN: "cn=admin,dc=test", Attrs: map[string][]string{"cn": {"admin"}, "userpassword": {"password"}}},
+    {DN: "uid=alice,ou=users,dc=test", Attrs: map[string][]string{"uid": {"alice"}, "mail": {"alice@test"}, "objectclass": {"organizationalPerson"}, "userpassword": {"alice-pwd"}}},
+    {DN: "uid=bob,ou=users,dc=test", Attrs: map[string][]string{"uid": {"bob"}, "mail": {"bob@test"}, "objectclass": {"organizationalPerson"}, "userpassword": {"bob-pwd"}}},
+    {DN: "uid=a*,ou=users,dc=test", Attrs: map[string][]string{"uid": {"a*"}, "mail": {"star@test"}, "objectclass": {"organizationalPerson"}, "userpassword": {"star-pwd"}}},
+    {DN: "cn=Users,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"Users"}, "memberuid": {"alice", "bob"}}},
+    {DN: "cn=Admins,ou=groups,dc=test", Attrs: map[string][]string{"cn": {"Admins"}, "memberuid": {"bob"}}},
+  }
+}
+
+func TestLDAPLogin(t *testing.T) {
+  srv := newTestServer(t, testDirectory()...)
+  defer srv.close()
+  l := newTestLDAP(t, srv)
+  defer l.Close()
+
+  user, ok := l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "alice", user.Login)
+  assert.Equal(t, "alice@test", user.EMail)
+  assert.Equal(t, []string{"Users"}, user.Groups)
+
+  _, ok = l.Login("alice", "bob-pwd")
+  assert.Equal(t, false, ok)
+
+  // Without the password
+  found, err := l.LookupUser(context.Background(), "alice")
+  assert.Nil(t, err)
+  assert.Equal(t, user.ID, found.ID)
+  assert.Equal(t, []string{"Users"}, found.Groups)
+  _, err = l.LookupUser(context.Background(), "nobody")
+  assert.Equal(t, ErrInvalidCredentials, err)
+  l.CheckGroups = "Admins"
+  _, err = l.LookupUser(context.Background(), "alice")
+  assert.Equal(t, ErrAccessDenied, err)
+}
+
+func TestLDAPLoginInjection(t *testing.T) {
+  srv := newTestServer(t, testDirectory()...)
+  defer srv.close()
+  l := newTestLDAP(t, srv)
+  defer l.Close()
+
+  // The crafted logins are rejected before the search
+  for _, login := range []string{"*", "a*", "*)(uid=*", "alice)(|(uid=*", "bob\x00", "alice\\2a", "", string(make([]byte, maxLoginLength + 1))} {
+    _, ok := l.Login(login, "bob-pwd")
+    assert.Equal(t, false, ok, login)
+    assert.Equal(t, false, validLogin(login), login)
+  }
+  assert.Equal(t, "", srv.lastFilter())
+
+  // The empty password would make an unauthenticated bind
+  _, ok := l.Login("alice", "")
+  assert.Equal(t, false, ok)
+  assert.Equal(t, "", srv.lastFilter())
+
+  assert.Equal(t, true, validLogin("alice"))
+  assert.Equal(t, true, validLogin("Иван.Петров@test.ru"))
+}
+
+func TestLDAPFilterEscape(t *testing.T) {
+  srv := newTestServer(t, testDirectory()...)
+  defer srv.close()
+  l := newTestLDAP(t, srv)
+  defer l.Close()
+
+  assert.Equal(t, `(&(objectClass=organizationalPerson)(uid=\2a\29\28uid=\2a))`, l.userFilter("*)(uid=*"))
+  assert.Equal(t, `(memberUid=a\2a)`, l.groupFilter("a*", ""))
+
+  search := func(filter string) []string {
+    sr, err := l.search(context.Background(), ldap.NewSearchRequest("dc=test", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+                                                       filter, []string{"uid"}, nil))
+    assert.Nil(t, err)
+    res := []string{}
+    for _, e := range sr.Entries {
+      res = append(res, e.DN)
+    }
+    return res
+  }
+
+  // Not escaped "a*" matches alice too
+  assert.Equal(t, 2, len(search(fmt.Sprintf(l.LDAP.Ldap_filter_user, "a*"))))
+  // The escaped one is compared literally
+  assert.Equal(t, []string{"uid=a*,ou=users,dc=test"}, search(l.userFilter("a*")))
+  assert.Equal(t, []string{}, search(l.userFilter("*)(uid=*")))
+  assert.Equal(t, []string{}, search(l.userFilter("*")))
+
+  groups, err := l.getGroupsOfUser(context.Background(), "*", "")
+  assert.Nil(t, err)
+  assert.Equal(t, []string{}, groups)
+  groups, err = l.getGroupsOfUser(context.Background(), "bob", "uid=bob,ou=users,dc=test")
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"Users", "Admins"}, groups)
+}
+
+func TestLDAPLoginEntryCheck(t *testing.T) {
+  // The filter of the config may match an entry of other user
+  srv := newTestServer(t, testDirectory()...)
+  defer srv.close()
+  l := newTestLDAP(t, srv)
+  defer l.Close()
+  l.LDAP.Ldap_filter_user = "(&(objectClass=organizationalPerson)(mail=%s@test))"
+
+  _, ok := l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+
+  l.LDAP.Ldap_filter_user = "(&(objectClass=organizationalPerson)(mail=bob@test)(!(uid=%s)))"
+  _, ok = l.Login("alice", "bob-pwd")
+  assert.Equal(t, false, ok)
+}
@@ -0,0 +1,242 @@
+package openldap
+
+import (
+  "sync"
+  "time"
+  "context"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/golang/glog"
+)
+
+const (
+  defaultPoolSize        = 4
+  // The idle connections are checked before use not more often than this
+  defaultPoolHealthCheck = 30 * time.Second
+)
+
+// PoolStats are the metrics of the connection pool
+type PoolStats struct {
+  Size             int
+  Open             int
+  Idle             int
+  InUse            int
+  // The last dial failed and no connection is open
+  Down             bool
+
+  Dials            int64
+  DialErrors       int64
+  Reconnects       int64
+  HealthChecks     int64
+  HealthFailures   int64
+  // Requests waited for a free connection
+  Waits            int64
+  WaitTime         time.Duration
+}
+
+type Stats struct {
+  Admin            PoolStats
+  User             PoolStats
+  Servers        []ServerStats
+}
+
+type pooledConn struct {
+  conn             *ldap.Conn
+  lastUsed         time.Time
+}
+
+// pool keeps up to size connections, the requests wait for a free one
+type pool struct {
+  name             string
+  dial             func() (*ldap.Conn, error)
+  // bind is called on the new connections, it may be nil
+  bind             func(conn *ldap.Conn) error
+  healthCheck      time.Duration
+
+  slots            chan struct{}
+  mu               sync.Mutex
+  idle           []pooledConn
+  open             int
+  lastErr          error
+  stats            PoolStats
+}
+
+func newPool(name string, size int, healthCheck time.Duration, dial func() (*ldap.Conn, error), bind func(conn *ldap.Conn) error) *pool {
+  if size <= 0 {
+    size = defaultPoolSize
+  }
+  if healthCheck <= 0 {
+    healthCheck = defaultPoolHealthCheck
+  }
+  return &pool{
+    name:        name,
+    dial:        dial,
+    bind:        bind,
+    healthCheck: healthCheck,
+    slots:       make(chan struct{}, size),
+    idle:        make([]pooledConn, 0, size),
+  }
+}
+
+// isNetworkError checks if the connection is broken and must be dialed again
+func isNetworkError(err error, conn *ldap.Conn) bool {
+  return conn.IsClosing() || ldap.IsErrorAnyOf(err, ldap.ErrorNetwork, ldap.LDAPResultServerDown)
+}
+
+// get takes an idle connection or dials a new one, fresh skips the idle connections
+func (p *pool) get(ctx context.Context, fresh bool) (*ldap.Conn, error) {
+  select {
+    case p.slots <- struct{}{}:
+    default:
+      start := time.Now()
+      select {
+        case p.slots <- struct{}{}:
+        case <-ctx.Done():
+          return nil, ctx.Err()
+      }
+      p.mu.Lock()
+      p.stats.Waits++
+      p.stats.WaitTime += time.Since(start)
+      p.mu.Unlock()
+  }
+
+  for !fresh {
+    p.mu.Lock()
+    if len(p.idle) == 0 {
+      p.mu.Unlock()
+      break
+    }
+    pc := p.idle[len(p.idle) - 1]
+    p.idle = p.idle[:len(p.idle) - 1]
+    p.mu.Unlock()
+    if p.healthy(&pc) {
+      return pc.conn, nil
+    }
+    p.discard(pc.conn)
+  }
+
+  conn, err := p.connect()
+  if err != nil {
+    <-p.slots
+    return nil, err
+  }
+  return conn, nil
+}
+
+func (p *pool) healthy(pc *pooledConn) bool {
+  if pc.conn.IsClosing() {
+    return false
+  }
+  if time.Since(pc.lastUsed) < p.healthCheck {
+    return true
+  }
+  // The root DSE answers to everybody
+  req := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 5, false, "(objectClass=*)", []string{"1.1"}, nil)
+  _, err := pc.conn.Search(req)
+  p.mu.Lock()
+  p.stats.HealthChecks++
+  if err != nil && isNetworkError(err, pc.conn) {
+    p.stats.HealthFailures++
+    p.mu.Unlock()
+    if glog.V(2) {
+      glog.Warningf("WRN: LDAP POOL(%s): health check: %v", p.name, err)
+    }
+    return false
+  }
+  p.mu.Unlock()
+  return true
+}
+
+func (p *pool) connect() (*ldap.Conn, error) {
+  conn, err := p.dial()
+  if err == nil && p.bind != nil {
+    if err = p.bind(conn); err != nil {
+      conn.Close()
+    }
+  }
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.stats.Dials++
+  p.lastErr = err
+  if err != nil {
+    p.stats.DialErrors++
+    glog.Errorf("ERR: LDAP POOL(%s): dial: %v", p.name, err)
+    return nil, err
+  }
+  p.open++
+  return conn, nil
+}
+
+func (p *pool) discard(conn *ldap.Conn) {
+  conn.Close()
+  p.mu.Lock()
+  p.open--
+  p.mu.Unlock()
+}
+
+// put returns the connection to the pool, the broken ones are closed
+func (p *pool) put(conn *ldap.Conn, broken bool) {
+  if broken || conn.IsClosing() {
+    p.discard(conn)
+  } else {
+    p.mu.Lock()
+    p.idle = append(p.idle, pooledConn{conn: conn, lastUsed: time.Now()})
+    p.mu.Unlock()
+  }
+  <-p.slots
+}
+
+// do runs fn with a connection, it is dialed again and fn is repeated once on the network errors
+func (p *pool) do(ctx context.Context, fn func(conn *ldap.Conn) error) error {
+  return p.doOnce(ctx, func(conn *ldap.Conn, sent *bool) error {
+    return fn(conn)
+  })
+}
+
+// doOnce is do for the operations which must not be repeated: fn sets *sent before
+// the request and nothing is repeated after it, even the dial of the new connection
+func (p *pool) doOnce(ctx context.Context, fn func(conn *ldap.Conn, sent *bool) error) error {
+  conn, err := p.get(ctx, false)
+  if err != nil {
+    return err
+  }
+  sent := false
+  err = fn(conn, &sent)
+  if err != nil && !sent && isNetworkError(err, conn) {
+    p.put(conn, true)
+    if glog.V(2) {
+      glog.Warningf("WRN: LDAP POOL(%s): reconnect: %v", p.name, err)
+    }
+    p.mu.Lock()
+    p.stats.Reconnects++
+    p.mu.Unlock()
+    if conn, err = p.get(ctx, true); err != nil {
+      return err
+    }
+    err = fn(conn, &sent)
+  }
+  p.put(conn, err != nil && isNetworkError(err, conn))
+  return err
+}
+
+func (p *pool) getStats() PoolStats {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  res := p.stats
+  res.Size = cap(p.slots)
+  res.Open = p.open
+  res.Idle = len(p.idle)
+  res.InUse = p.open - len(p.idle)
+  res.Down = p.lastErr != nil && p.open == 0
+  return res
+}
+
+func (p *pool) close() {
+  p.mu.Lock()
+  idle := p.idle
+  p.idle = make([]pooledConn, 0, cap(p.slots))
+  p.open -= len(idle)
+  p.mu.Unlock()
+  for _, pc := range idle {
+    pc.conn.Close()
+  }
+}
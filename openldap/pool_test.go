@@ -0,0 +1,107 @@
+package openldap
+
+import (
+  "sync"
+  "time"
+  "context"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestLDAPPoolReconnect(t *testing.T) {
+  srv := newTestServer(t, testDirectory()...)
+  defer srv.close()
+  l := newTestLDAP(t, srv)
+  defer l.Close()
+
+  _, ok := l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+
+  // The connections are dialed again after the server drops them
+  srv.dropConns()
+  time.Sleep(20 * time.Millisecond)
+  assert.Equal(t, true, l.Connected())
+  _, ok = l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+
+  stats := l.Stats()
+  assert.Equal(t, 1, stats.Admin.Open)
+  assert.Equal(t, 1, stats.User.Open)
+  assert.Equal(t, 0, stats.Admin.InUse)
+  assert.True(t, stats.Admin.Dials >= 2)
+  assert.False(t, stats.Admin.Down)
+
+  // The server is down
+  srv.close()
+  srv.dropConns()
+  time.Sleep(20 * time.Millisecond)
+  _, ok = l.Login("alice", "alice-pwd")
+  assert.Equal(t, false, ok)
+  stats = l.Stats()
+  assert.True(t, stats.Admin.DialErrors >= 1)
+  assert.True(t, stats.Admin.Down)
+  assert.Equal(t, 0, stats.Admin.Open)
+}
+
+func TestLDAPPoolHealthCheck(t *testing.T) {
+  srv := newTestServer(t, testDirectory()...)
+  defer srv.close()
+  l := newTestInfo(srv)
+  l.LDAP.Pool_health_check = 1
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+
+  // Idle connections are checked before use
+  l.admin.mu.Lock()
+  for i := range l.admin.idle {
+    l.admin.idle[i].lastUsed = time.Now().Add(-time.Minute)
+  }
+  l.admin.mu.Unlock()
+  _, ok := l.Login("bob", "bob-pwd")
+  assert.Equal(t, true, ok)
+  stats := l.Stats()
+  assert.Equal(t, int64(1), stats.Admin.HealthChecks)
+  assert.Equal(t, int64(0), stats.Admin.HealthFailures)
+  assert.Equal(t, int64(0), stats.Admin.Reconnects)
+}
+
+func TestLDAPPoolBounded(t *testing.T) {
+  srv := newTestServer(t, testDirectory()...)
+  defer srv.close()
+  l := newTestInfo(srv)
+  l.LDAP.Pool_size = 2
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+
+  var wg sync.WaitGroup
+  fails := 0
+  var mu sync.Mutex
+  for i := 0; i < 20; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      if _, ok := l.Login("bob", "bob-pwd"); !ok {
+        mu.Lock()
+        fails++
+        mu.Unlock()
+      }
+    }()
+  }
+  wg.Wait()
+  assert.Equal(t, 0, fails)
+  stats := l.Stats()
+  assert.Equal(t, 2, stats.Admin.Size)
+  assert.True(t, stats.Admin.Open <= 2)
+  assert.True(t, stats.User.Open <= 2)
+
+  // Waiting for a free connection ends with ctx
+  conn1, _ := l.admin.get(context.Background(), false)
+  conn2, _ := l.admin.get(context.Background(), false)
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+  defer cancel()
+  _, err := l.admin.get(ctx, false)
+  assert.Equal(t, context.DeadlineExceeded, err)
+  l.admin.put(conn1, false)
+  l.admin.put(conn2, false)
+  assert.True(t, l.Stats().Admin.Waits >= 1)
+}
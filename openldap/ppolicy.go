@@ -0,0 +1,234 @@
+package openldap
+
+import (
+  "fmt"
+  "errors"
+  "regexp"
+  "context"
+  "strconv"
+  "strings"
+  "unicode/utf16"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+var (
+  ErrNotConnected          = errors.New("ERR: LDAP: Not connected")
+  ErrInvalidCredentials    = errors.New("ERR: LDAP: Invalid login or password")
+  // The user is not a member of check_groups
+  ErrAccessDenied          = errors.New("ERR: LDAP: Access denied")
+  ErrAccountDisabled       = errors.New("ERR: LDAP: Account is disabled")
+  ErrAccountLocked         = errors.New("ERR: LDAP: Account is locked")
+  ErrPasswordExpired       = errors.New("ERR: LDAP: Password is expired")
+  // The password is reset by the administrator, the user has to change it
+  ErrPasswordMustChange    = errors.New("ERR: LDAP: Password must be changed")
+  // The connection is lost after the change is sent, the change may be applied or not
+  ErrPasswordChangeUnknown = errors.New("ERR: LDAP: Result of the password change is unknown")
+
+  // The new password is rejected, errors.Is(err, ErrPasswordPolicy) is true for all of them
+  ErrPasswordPolicy        = errors.New("ERR: LDAP: Password does not meet the policy")
+  ErrPasswordQuality       = fmt.Errorf("%w: insufficient quality", ErrPasswordPolicy)
+  ErrPasswordTooShort      = fmt.Errorf("%w: too short", ErrPasswordPolicy)
+  ErrPasswordTooYoung      = fmt.Errorf("%w: changed too recently", ErrPasswordPolicy)
+  ErrPasswordInHistory     = fmt.Errorf("%w: used before", ErrPasswordPolicy)
+  ErrPasswordModNotAllowed = fmt.Errorf("%w: change is not allowed", ErrPasswordPolicy)
+)
+
+const (
+  // Keys of base.User.Attributes with the warnings of the password policy
+  AttrPasswordExpire = "password_expire" // Seconds before the password expires
+  AttrPasswordGrace  = "password_grace"  // Logins left with the expired password
+)
+
+// The sub-codes of the AD bind errors: "... AcceptSecurityContext error, data 775, v3839"
+var adDataCode = regexp.MustCompile(`data ([0-9a-fA-F]+)`)
+
+var adBindErrors = map[string]error{
+  "52e": ErrInvalidCredentials,
+  "525": ErrInvalidCredentials,
+  "530": ErrAccountDisabled, // Not permitted to log on at this time
+  "531": ErrAccountDisabled, // Not permitted to log on at this workstation
+  "532": ErrPasswordExpired,
+  "533": ErrAccountDisabled,
+  "701": ErrAccountDisabled, // Account expired
+  "773": ErrPasswordMustChange,
+  "775": ErrAccountLocked,
+}
+
+var ppolicyErrors = map[int8]error{
+  ldap.BeheraPasswordExpired:             ErrPasswordExpired,
+  ldap.BeheraAccountLocked:               ErrAccountLocked,
+  ldap.BeheraChangeAfterReset:            ErrPasswordMustChange,
+  ldap.BeheraPasswordModNotAllowed:       ErrPasswordModNotAllowed,
+  ldap.BeheraMustSupplyOldPassword:       ErrPasswordModNotAllowed,
+  ldap.BeheraInsufficientPasswordQuality: ErrPasswordQuality,
+  ldap.BeheraPasswordTooShort:            ErrPasswordTooShort,
+  ldap.BeheraPasswordTooYoung:            ErrPasswordTooYoung,
+  ldap.BeheraPasswordInHistory:           ErrPasswordInHistory,
+}
+
+// passwordPolicy is the state of the password after the bind
+type passwordPolicy struct {
+  expire     int64
+  grace      int64
+  // The bind succeeded but the password has to be changed
+  err        error
+}
+
+func (p *passwordPolicy) setWarnings(user *base.User) {
+  if p.expire <= 0 && p.grace <= 0 {
+    return
+  }
+  if user.Attributes == nil {
+    user.Attributes = make(map[string][]string)
+  }
+  if p.expire > 0 {
+    user.Attributes[AttrPasswordExpire] = []string{strconv.FormatInt(p.expire, 10)}
+  }
+  if p.grace > 0 {
+    user.Attributes[AttrPasswordGrace] = []string{strconv.FormatInt(p.grace, 10)}
+  }
+}
+
+// bindUser binds with the password policy control, the errors of the directory are mapped to the Err* ones
+func (a *Info) bindUser(conn *ldap.Conn, userdn string, password string) (passwordPolicy, error) {
+  policy := passwordPolicy{}
+  res, err := conn.SimpleBind(&ldap.SimpleBindRequest{
+    Username: userdn,
+    Password: password,
+    Controls: []ldap.Control{ldap.NewControlBeheraPasswordPolicy()},
+  })
+  var ppolicyErr error
+  if res != nil {
+    for _, c := range res.Controls {
+      switch c := c.(type) {
+        case *ldap.ControlBeheraPasswordPolicy:
+          policy.expire, policy.grace = c.Expire, c.Grace
+          ppolicyErr = ppolicyErrors[c.Error]
+        case *ldap.ControlVChuPasswordMustChange:
+          if c.MustChange {
+            ppolicyErr = ErrPasswordMustChange
+          }
+        case *ldap.ControlVChuPasswordWarning:
+          policy.expire = c.Expire
+      }
+    }
+  }
+  if err == nil {
+    policy.err = ppolicyErr
+    return policy, nil
+  }
+  if isNetworkError(err, conn) {
+    return policy, err
+  }
+  if glog.V(2) {
+    glog.Warningf("WRN: LDAP BIND (%s): %v", userdn, err)
+  }
+  if ppolicyErr != nil {
+    return policy, ppolicyErr
+  }
+  if m := adDataCode.FindStringSubmatch(err.Error()); m != nil {
+    if mapped, ok := adBindErrors[strings.ToLower(m[1])]; ok {
+      return policy, mapped
+    }
+  }
+  if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+    return policy, ErrInvalidCredentials
+  }
+  return policy, err
+}
+
+// ChangePassword binds as the user with the old password and sets the new one
+// by the Password Modify extended operation or by unicodePwd of AD.
+// The reset passwords and the expired ones with the grace logins may be changed.
+func (a *Info) ChangePassword(ctx context.Context, login string, oldPassword string, newPassword string) error {
+  if !validLogin(login) || oldPassword == "" {
+    return ErrInvalidCredentials
+  }
+  if newPassword == "" {
+    return ErrPasswordTooShort
+  }
+  var err error
+  errCtx := base.RunContext(ctx, func() {
+    err = a.changePassword(ctx, login, oldPassword, newPassword)
+  })
+  if errCtx != nil {
+    err = errCtx
+  }
+  if err != nil {
+    glog.Errorf("ERR: LDAP: ChangePassword(%s): %v", login, err)
+    return err
+  }
+  if glog.V(2) {
+    glog.Infof("LOG: LDAP: Password of '%s' is changed", login)
+  }
+  return nil
+}
+
+func (a *Info) changePassword(ctx context.Context, login string, oldPassword string, newPassword string) error {
+  entry, err := a.findUser(ctx, login)
+  if err != nil {
+    return err
+  }
+  // The bind may be repeated on the network errors but not the change:
+  // the lost answer does not mean the change is not applied
+  return a.users.doOnce(ctx, func(conn *ldap.Conn, sent *bool) error {
+    if _, err := a.bindUser(conn, entry.DN, oldPassword); err != nil {
+      return err
+    }
+    *sent = true
+    var err error
+    if a.isAD() {
+      // AD changes unicodePwd over the encrypted connections only
+      req := ldap.NewModifyRequest(entry.DN, nil)
+      req.Delete("unicodePwd", []string{adPassword(oldPassword)})
+      req.Add("unicodePwd", []string{adPassword(newPassword)})
+      err = conn.Modify(req)
+    } else {
+      _, err = conn.PasswordModify(ldap.NewPasswordModifyRequest("", oldPassword, newPassword))
+    }
+    if err != nil && isNetworkError(err, conn) {
+      return fmt.Errorf("%w: %v", ErrPasswordChangeUnknown, err)
+    }
+    return passwordModifyError(err, conn)
+  })
+}
+
+// adPassword is the quoted password in UTF-16LE
+func adPassword(password string) string {
+  quoted := utf16.Encode([]rune(`"` + password + `"`))
+  buf := make([]byte, 0, len(quoted) * 2)
+  for _, c := range quoted {
+    buf = append(buf, byte(c), byte(c >> 8))
+  }
+  return string(buf)
+}
+
+// passwordModifyError maps the result of the change by the code and the diagnostic message,
+// go-ldap does not return the password policy control of the extended operations
+func passwordModifyError(err error, conn *ldap.Conn) error {
+  if err == nil || isNetworkError(err, conn) {
+    return err
+  }
+  msg := strings.ToLower(err.Error())
+  switch {
+    case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+      return ErrInvalidCredentials
+    case ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights):
+      return ErrPasswordModNotAllowed
+    case strings.Contains(msg, "history") || strings.Contains(msg, "existing value"):
+      return ErrPasswordInHistory
+    case strings.Contains(msg, "too young"):
+      return ErrPasswordTooYoung
+    case strings.Contains(msg, "too short"):
+      return ErrPasswordTooShort
+    case strings.Contains(msg, "quality"):
+      return ErrPasswordQuality
+    case ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation):
+      // AD: 0000052D the new password does not meet the length, the complexity or the history
+      return fmt.Errorf("%w: %v", ErrPasswordPolicy, err)
+  }
+  return err
+}
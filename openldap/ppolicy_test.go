@@ -0,0 +1,130 @@
+package openldap
+
+import (
+  "errors"
+  "context"
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func testPolicyDirectory() []testEntry {
+  entries := testDirectory()
+  for _, state := range []string{"expired", "locked", "reset", "warn", "grace"} {
+    entries = append(entries, testEntry{DN: "uid=" + state + ",ou=users,dc=test", Attrs: map[string][]string{"uid": {state}, "objectclass": {"organizationalPerson"},
+                                        "userpassword": {state + "-pwd"}, "pwdState": {state}}})
+  }
+  return entries
+}
+
+func TestLDAPPasswordPolicy(t *testing.T) {
+  srv := newTestServer(t, testPolicyDirectory()...)
+  defer srv.close()
+  l := newTestLDAP(t, srv)
+  defer l.Close()
+  ctx := context.Background()
+
+  _, err := l.Authenticate(ctx, "alice", "bad-pwd")
+  assert.Equal(t, ErrInvalidCredentials, err)
+  _, err = l.Authenticate(ctx, "nobody", "bad-pwd")
+  assert.Equal(t, ErrInvalidCredentials, err)
+  _, err = l.Authenticate(ctx, "expired", "expired-pwd")
+  assert.Equal(t, ErrPasswordExpired, err)
+  _, err = l.Authenticate(ctx, "locked", "locked-pwd")
+  assert.Equal(t, ErrAccountLocked, err)
+  // The bind succeeds but the password has to be changed
+  _, err = l.Authenticate(ctx, "reset", "reset-pwd")
+  assert.Equal(t, ErrPasswordMustChange, err)
+  _, ok := l.Login("reset", "reset-pwd")
+  assert.Equal(t, false, ok)
+
+  user, err := l.Authenticate(ctx, "warn", "warn-pwd")
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"3600"}, user.Attributes[AttrPasswordExpire])
+  user, err = l.Authenticate(ctx, "grace", "grace-pwd")
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"2"}, user.Attributes[AttrPasswordGrace])
+
+  user, err = l.Authenticate(ctx, "alice", "alice-pwd")
+  assert.Nil(t, err)
+  assert.Nil(t, user.Attributes)
+
+  l.CheckGroups = "Admins"
+  _, err = l.Authenticate(ctx, "alice", "alice-pwd")
+  assert.Equal(t, ErrAccessDenied, err)
+}
+
+func TestLDAPChangePassword(t *testing.T) {
+  srv := newTestServer(t, testPolicyDirectory()...)
+  defer srv.close()
+  l := newTestLDAP(t, srv)
+  defer l.Close()
+  ctx := context.Background()
+
+  assert.Equal(t, ErrInvalidCredentials, l.ChangePassword(ctx, "alice", "bad-pwd", "new-alice-pwd"))
+  assert.Equal(t, ErrPasswordQuality, l.ChangePassword(ctx, "alice", "alice-pwd", "short"))
+  assert.Equal(t, true, errors.Is(l.ChangePassword(ctx, "alice", "alice-pwd", "short"), ErrPasswordPolicy))
+  assert.Equal(t, ErrPasswordTooShort, l.ChangePassword(ctx, "alice", "alice-pwd", ""))
+
+  assert.Nil(t, l.ChangePassword(ctx, "alice", "alice-pwd", "new-alice-pwd"))
+  _, ok := l.Login("alice", "alice-pwd")
+  assert.Equal(t, false, ok)
+  _, ok = l.Login("alice", "new-alice-pwd")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, ErrPasswordInHistory, l.ChangePassword(ctx, "alice", "new-alice-pwd", "alice-pwd"))
+
+  // The reset password may be changed, the expired one may not
+  assert.Nil(t, l.ChangePassword(ctx, "reset", "reset-pwd", "new-reset-pwd"))
+  _, err := l.Authenticate(ctx, "reset", "new-reset-pwd")
+  assert.Nil(t, err)
+  assert.Equal(t, ErrPasswordExpired, l.ChangePassword(ctx, "expired", "expired-pwd", "new-expired-pwd"))
+
+  // The answer is lost: the change is not sent again with the old password
+  srv.mu.Lock()
+  srv.dropChange = true
+  srv.mu.Unlock()
+  err = l.ChangePassword(ctx, "alice", "new-alice-pwd", "next-alice-pwd")
+  assert.Equal(t, true, errors.Is(err, ErrPasswordChangeUnknown), err)
+  srv.mu.Lock()
+  srv.dropChange = false
+  srv.mu.Unlock()
+  _, ok = l.Login("alice", "next-alice-pwd")
+  assert.Equal(t, true, ok)
+
+  // The server is gone after the change, the dial error does not hide it
+  srv.mu.Lock()
+  srv.dropChange = true
+  srv.stopChange = true
+  srv.mu.Unlock()
+  err = l.ChangePassword(ctx, "alice", "next-alice-pwd", "last-alice-pwd")
+  assert.Equal(t, true, errors.Is(err, ErrPasswordChangeUnknown), err)
+  srv.mu.Lock()
+  assert.Equal(t, []string{"last-alice-pwd"}, srv.entry("uid=alice,ou=users,dc=test").values("userPassword"))
+  srv.mu.Unlock()
+}
+
+func TestADPassword(t *testing.T) {
+  entries := append(testADDirectory(),
+    testEntry{DN: "CN=Locked,OU=Staff,DC=corp,DC=test", Attrs: map[string][]string{"sAMAccountName": {"locked"}, "objectCategory": {"person"}, "objectClass": {"user"},
+              "userPassword": {"locked-pwd"}, "adData": {"775"}}},
+    testEntry{DN: "CN=Expired,OU=Staff,DC=corp,DC=test", Attrs: map[string][]string{"sAMAccountName": {"expired"}, "objectCategory": {"person"}, "objectClass": {"user"},
+              "userPassword": {"expired-pwd"}, "adData": {"532"}}},
+  )
+  srv := newTestServer(t, entries...)
+  defer srv.close()
+  l := newTestAD(t, srv)
+  defer l.Close()
+  ctx := context.Background()
+
+  _, err := l.Authenticate(ctx, "locked", "locked-pwd")
+  assert.Equal(t, ErrAccountLocked, err)
+  _, err = l.Authenticate(ctx, "expired", "expired-pwd")
+  assert.Equal(t, ErrPasswordExpired, err)
+
+  assert.Nil(t, l.ChangePassword(ctx, "alice", "alice-pwd", "new-alice-pwd"))
+  _, err = l.Authenticate(ctx, "alice", "new-alice-pwd")
+  assert.Nil(t, err)
+  assert.Equal(t, ErrInvalidCredentials, l.ChangePassword(ctx, "alice", "alice-pwd", "other-alice-pwd"))
+
+  assert.Equal(t, "\"\x00p\x00w\x00\"\x00", adPassword("pw"))
+  assert.Equal(t, "пароль", decodeADPassword([]byte(adPassword("пароль"))))
+}
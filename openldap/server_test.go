@@ -0,0 +1,559 @@
+package openldap
+
+import (
+  "io"
+  "strconv"
+  "crypto/tls"
+  "net"
+  "sync"
+  "strings"
+  "testing"
+  "github.com/go-ldap/ldap/v3"
+  ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+////
+// In-process LDAP server for the tests: simple bind, search and a subset of the filters
+////
+
+const (
+  startTLSOID       = "1.3.6.1.4.1.1466.20037"
+  passwordModifyOID = "1.3.6.1.4.1.4203.1.11.1"
+  minTestPassword   = 8
+)
+
+type testEntry struct {
+  DN       string
+  Attrs    map[string][]string
+}
+
+// values returns the values of the attribute, the names are case insensitive
+func (e *testEntry) values(name string) []string {
+  for k, v := range e.Attrs {
+    if strings.EqualFold(k, name) {
+      return v
+    }
+  }
+  return nil
+}
+
+type testServer struct {
+  ln         net.Listener
+  // Config of StartTLS
+  tls       *tls.Config
+  mu         sync.Mutex
+  entries  []testEntry
+  filters  []string
+  // Pages sent with the paged results control
+  pages      int
+  conns      map[net.Conn]bool
+  // The password changes are applied but the connection is closed instead of the answer
+  dropChange bool
+  // The listener is closed too after the dropped change
+  stopChange bool
+}
+
+func newTestServer(t *testing.T, entries ...testEntry) *testServer {
+  return newTestTLSServer(t, nil, false, entries...)
+}
+
+// newTestTLSServer listens with TLS in the ldaps mode, otherwise it supports StartTLS with cfg
+func newTestTLSServer(t *testing.T, cfg *tls.Config, ldaps bool, entries ...testEntry) *testServer {
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("listen: %v", err)
+  }
+  if ldaps {
+    ln = tls.NewListener(ln, cfg)
+  }
+  s := &testServer{ln: ln, tls: cfg, entries: entries, conns: make(map[net.Conn]bool)}
+  go s.serve()
+  return s
+}
+
+func (s *testServer) port() int {
+  return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testServer) close() {
+  s.ln.Close()
+}
+
+// lastFilter returns the filter of the last search
+func (s *testServer) lastFilter() string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if len(s.filters) == 0 {
+    return ""
+  }
+  return s.filters[len(s.filters) - 1]
+}
+
+func (s *testServer) serve() {
+  for {
+    conn, err := s.ln.Accept()
+    if err != nil {
+      return
+    }
+    go s.handle(conn)
+  }
+}
+
+// dropConns breaks all client connections like a restart of the server
+func (s *testServer) dropConns() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for conn := range s.conns {
+    conn.Close()
+  }
+}
+
+func (s *testServer) handle(conn net.Conn) {
+  raw := conn
+  s.mu.Lock()
+  s.conns[raw] = true
+  s.mu.Unlock()
+  defer func() {
+    s.mu.Lock()
+    delete(s.conns, raw)
+    s.mu.Unlock()
+    conn.Close()
+  }()
+  // DN of the last successful bind
+  bound := ""
+  for {
+    packet, err := ber.ReadPacket(conn)
+    if err != nil || len(packet.Children) < 2 {
+      return
+    }
+    msgID := packet.Children[0].Value.(int64)
+    op := packet.Children[1]
+    switch op.Tag {
+      case ldap.ApplicationBindRequest:
+        dn := ber.DecodeString(op.Children[1].Data.Bytes())
+        code, msg, controls := s.bind(dn, op.Children[2].Data.String(), hasControl(packet, ldap.ControlTypeBeheraPasswordPolicy))
+        if code == ldap.LDAPResultSuccess {
+          bound = dn
+        }
+        s.write(conn, msgID, resultMsg(ldap.ApplicationBindResponse, code, msg), controls...)
+      case ldap.ApplicationModifyRequest:
+        s.write(conn, msgID, result(ldap.ApplicationModifyResponse, s.modify(bound, op)))
+      case ldap.ApplicationUnbindRequest:
+        return
+      case ldap.ApplicationSearchRequest:
+        s.search(conn, msgID, op, pagingControl(packet))
+      case ldap.ApplicationExtendedRequest:
+        name := ber.DecodeString(op.Children[0].Data.Bytes())
+        if name == startTLSOID && s.tls != nil {
+          s.write(conn, msgID, result(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+          conn = tls.Server(conn, s.tls)
+          continue
+        }
+        if name == passwordModifyOID && len(op.Children) > 1 {
+          code, msg := s.passwordModify(bound, ber.DecodePacket(op.Children[1].Data.Bytes()))
+          s.mu.Lock()
+          drop := s.dropChange
+          stop := s.stopChange
+          s.mu.Unlock()
+          if stop {
+            s.ln.Close()
+          }
+          if drop {
+            return
+          }
+          s.write(conn, msgID, resultMsg(ldap.ApplicationExtendedResponse, code, msg))
+          continue
+        }
+        s.write(conn, msgID, result(ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform))
+    }
+  }
+}
+
+func (s *testServer) write(w io.Writer, msgID int64, op *ber.Packet, controls ...ldap.Control) {
+  packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+  packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+  packet.AppendChild(op)
+  if len(controls) > 0 {
+    list := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+    for _, c := range controls {
+      list.AppendChild(c.Encode())
+    }
+    packet.AppendChild(list)
+  }
+  w.Write(packet.Bytes())
+}
+
+// pagingControl returns the paged results control of the request
+func pagingControl(packet *ber.Packet) *ldap.ControlPaging {
+  if len(packet.Children) < 3 {
+    return nil
+  }
+  for _, child := range packet.Children[2].Children {
+    if c, err := ldap.DecodeControl(child); err == nil {
+      if paging, ok := c.(*ldap.ControlPaging); ok {
+        return paging
+      }
+    }
+  }
+  return nil
+}
+
+func result(tag ber.Tag, code uint16) *ber.Packet {
+  return resultMsg(tag, code, "")
+}
+
+func resultMsg(tag ber.Tag, code uint16, msg string) *ber.Packet {
+  op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+  op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Code"))
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "MatchedDN"))
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, msg, "Diagnostic"))
+  return op
+}
+
+func hasControl(packet *ber.Packet, oid string) bool {
+  if len(packet.Children) < 3 {
+    return false
+  }
+  for _, child := range packet.Children[2].Children {
+    if len(child.Children) > 0 && ber.DecodeString(child.Children[0].Data.Bytes()) == oid {
+      return true
+    }
+  }
+  return false
+}
+
+// testControl sends the encoded control as it is
+type testControl struct {
+  packet   *ber.Packet
+}
+
+func (c *testControl) GetControlType() string { return "" }
+func (c *testControl) Encode() *ber.Packet    { return c.packet }
+func (c *testControl) String() string         { return "test control" }
+
+// ppolicyControl is the response of draft-behera-ldap-password-policy, errCode < 0 is for no error
+func ppolicyControl(expire int64, grace int64, errCode int64) ldap.Control {
+  value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "PasswordPolicyResponseValue")
+  if expire > 0 || grace > 0 {
+    warning := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "warning")
+    if expire > 0 {
+      warning.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 0, expire, "timeBeforeExpiration"))
+    } else {
+      warning.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, grace, "graceAuthNsRemaining"))
+    }
+    value.AppendChild(warning)
+  }
+  if errCode >= 0 {
+    value.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, errCode, "error"))
+  }
+  packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+  packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ldap.ControlTypeBeheraPasswordPolicy, "Control Type"))
+  packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value.Bytes()), "Control Value"))
+  return &testControl{packet: packet}
+}
+
+// bind checks userPassword, the attribute pwdState makes the responses of ppolicy:
+// expired, locked, reset, warn or grace; adData makes the AD diagnostic
+func (s *testServer) bind(dn string, password string, ppolicy bool) (uint16, string, []ldap.Control) {
+  if password == "" {
+    // Anonymous or unauthenticated bind
+    return ldap.LDAPResultSuccess, "", nil
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  e := s.entry(dn)
+  if e == nil {
+    return ldap.LDAPResultInvalidCredentials, "", nil
+  }
+  if data := e.values("adData"); len(data) > 0 {
+    return ldap.LDAPResultInvalidCredentials, "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data " + data[0] + ", v3839", nil
+  }
+  ok := false
+  for _, pwd := range e.values("userPassword") {
+    ok = ok || pwd == password
+  }
+  if !ok {
+    return ldap.LDAPResultInvalidCredentials, "", nil
+  }
+  var controls []ldap.Control
+  code := uint16(ldap.LDAPResultSuccess)
+  for _, state := range e.values("pwdState") {
+    switch state {
+      case "expired":
+        code, controls = ldap.LDAPResultInvalidCredentials, []ldap.Control{ppolicyControl(0, 0, ldap.BeheraPasswordExpired)}
+      case "locked":
+        code, controls = ldap.LDAPResultInvalidCredentials, []ldap.Control{ppolicyControl(0, 0, ldap.BeheraAccountLocked)}
+      case "reset":
+        controls = []ldap.Control{ppolicyControl(0, 0, ldap.BeheraChangeAfterReset)}
+      case "warn":
+        controls = []ldap.Control{ppolicyControl(3600, 0, -1)}
+      case "grace":
+        controls = []ldap.Control{ppolicyControl(0, 2, -1)}
+    }
+  }
+  if !ppolicy {
+    controls = nil
+  }
+  return code, "", controls
+}
+
+// setPassword checks the new password like ppolicy and keeps the old one in pwdHistory
+func (s *testServer) setPassword(e *testEntry, oldPassword string, newPassword string) (uint16, string) {
+  if len(newPassword) < minTestPassword {
+    return ldap.LDAPResultConstraintViolation, "Password fails quality checking policy"
+  }
+  if newPassword == oldPassword {
+    return ldap.LDAPResultConstraintViolation, "Password is not being changed from existing value"
+  }
+  for _, pwd := range e.values("pwdHistory") {
+    if pwd == newPassword {
+      return ldap.LDAPResultConstraintViolation, "Password is in history of old passwords"
+    }
+  }
+  e.Attrs["pwdHistory"] = append(e.values("pwdHistory"), oldPassword)
+  for k := range e.Attrs {
+    if strings.EqualFold(k, "userPassword") || strings.EqualFold(k, "pwdState") {
+      delete(e.Attrs, k)
+    }
+  }
+  e.Attrs["userPassword"] = []string{newPassword}
+  return ldap.LDAPResultSuccess, ""
+}
+
+// passwordModify changes the password of the bound user by RFC 3062
+func (s *testServer) passwordModify(bound string, req *ber.Packet) (uint16, string) {
+  var identity, oldPassword, newPassword string
+  for _, c := range req.Children {
+    switch c.Tag {
+      case 0:
+        identity = c.Data.String()
+      case 1:
+        oldPassword = c.Data.String()
+      case 2:
+        newPassword = c.Data.String()
+    }
+  }
+  if identity == "" {
+    identity = bound
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  e := s.entry(identity)
+  if bound == "" || e == nil || !strings.EqualFold(identity, bound) {
+    return ldap.LDAPResultInsufficientAccessRights, ""
+  }
+  if pwd := e.values("userPassword"); len(pwd) == 0 || pwd[0] != oldPassword {
+    return ldap.LDAPResultInvalidCredentials, ""
+  }
+  return s.setPassword(e, oldPassword, newPassword)
+}
+
+// modify supports the change of unicodePwd of AD only: delete of the old value and add of the new one
+func (s *testServer) modify(bound string, op *ber.Packet) uint16 {
+  dn := ber.DecodeString(op.Children[0].Data.Bytes())
+  var oldPassword, newPassword string
+  for _, change := range op.Children[1].Children {
+    kind := change.Children[0].Value.(int64)
+    attr := change.Children[1]
+    if !strings.EqualFold(ber.DecodeString(attr.Children[0].Data.Bytes()), "unicodePwd") || len(attr.Children[1].Children) != 1 {
+      return ldap.LDAPResultUnwillingToPerform
+    }
+    value := decodeADPassword(attr.Children[1].Children[0].Data.Bytes())
+    switch kind {
+      case ldap.DeleteAttribute:
+        oldPassword = value
+      case ldap.AddAttribute:
+        newPassword = value
+    }
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  e := s.entry(dn)
+  if e == nil || !strings.EqualFold(dn, bound) {
+    return ldap.LDAPResultInsufficientAccessRights
+  }
+  if pwd := e.values("userPassword"); len(pwd) == 0 || pwd[0] != oldPassword {
+    return ldap.LDAPResultConstraintViolation
+  }
+  code, _ := s.setPassword(e, oldPassword, newPassword)
+  return code
+}
+
+// decodeADPassword converts the quoted UTF-16LE value of unicodePwd
+func decodeADPassword(buf []byte) string {
+  runes := make([]rune, 0, len(buf) / 2)
+  for i := 0; i + 1 < len(buf); i += 2 {
+    runes = append(runes, rune(buf[i]) | rune(buf[i + 1]) << 8)
+  }
+  return strings.Trim(string(runes), `"`)
+}
+
+func (s *testServer) search(conn net.Conn, msgID int64, op *ber.Packet, paging *ldap.ControlPaging) {
+  baseDN := strings.ToLower(ber.DecodeString(op.Children[0].Data.Bytes()))
+  filter := op.Children[6]
+  attrs := make(map[string]bool)
+  for _, a := range op.Children[7].Children {
+    attrs[strings.ToLower(ber.DecodeString(a.Data.Bytes()))] = true
+  }
+  str, _ := ldap.DecompileFilter(filter)
+  s.mu.Lock()
+  s.filters = append(s.filters, str)
+  s.mu.Unlock()
+
+  found := []testEntry{}
+  for _, e := range s.entries {
+    if strings.HasSuffix(strings.ToLower(e.DN), baseDN) && s.match(filter, &e) {
+      found = append(found, e)
+    }
+  }
+  // The cookie is the offset of the next page
+  var next *ldap.ControlPaging
+  if paging != nil && paging.PagingSize > 0 {
+    offset, _ := strconv.Atoi(string(paging.Cookie))
+    if offset > len(found) {
+      offset = len(found)
+    }
+    end := offset + int(paging.PagingSize)
+    next = ldap.NewControlPaging(0)
+    if end < len(found) {
+      next.SetCookie([]byte(strconv.Itoa(end)))
+    } else {
+      end = len(found)
+    }
+    found = found[offset:end]
+    s.mu.Lock()
+    s.pages++
+    s.mu.Unlock()
+  }
+
+  for _, e := range found {
+    entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+    entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "DN"))
+    list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+    for name, values := range e.Attrs {
+      if len(attrs) > 0 && !attrs[strings.ToLower(name)] && !attrs["*"] {
+        continue
+      }
+      attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+      attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+      set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+      for _, v := range values {
+        set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+      }
+      attr.AppendChild(set)
+      list.AppendChild(attr)
+    }
+    entry.AppendChild(list)
+    s.write(conn, msgID, entry)
+  }
+  if next != nil {
+    s.write(conn, msgID, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess), next)
+    return
+  }
+  s.write(conn, msgID, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func (s *testServer) entry(dn string) *testEntry {
+  for i := range s.entries {
+    if strings.EqualFold(s.entries[i].DN, dn) {
+      return &s.entries[i]
+    }
+  }
+  return nil
+}
+
+// inChain checks if dn is the value of attr of the entry or of the entries of its values
+func (s *testServer) inChain(e *testEntry, attr string, dn string, seen map[string]bool) bool {
+  if seen[strings.ToLower(e.DN)] {
+    return false
+  }
+  seen[strings.ToLower(e.DN)] = true
+  for _, v := range e.values(attr) {
+    if strings.EqualFold(v, dn) {
+      return true
+    }
+    if child := s.entry(v); child != nil && s.inChain(child, attr, dn, seen) {
+      return true
+    }
+  }
+  return false
+}
+
+func (s *testServer) match(f *ber.Packet, e *testEntry) bool {
+  switch f.Tag {
+    case ldap.FilterAnd:
+      for _, c := range f.Children {
+        if !s.match(c, e) {
+          return false
+        }
+      }
+      return true
+    case ldap.FilterOr:
+      for _, c := range f.Children {
+        if s.match(c, e) {
+          return true
+        }
+      }
+      return false
+    case ldap.FilterNot:
+      return !s.match(f.Children[0], e)
+    case ldap.FilterPresent:
+      name := strings.ToLower(ber.DecodeString(f.Data.Bytes()))
+      return name == "objectclass" || len(e.values(name)) > 0
+    case ldap.FilterEqualityMatch:
+      name := ber.DecodeString(f.Children[0].Data.Bytes())
+      value := ber.DecodeString(f.Children[1].Data.Bytes())
+      for _, v := range e.values(name) {
+        if strings.EqualFold(v, value) {
+          return true
+        }
+      }
+    case ldap.FilterSubstrings:
+      name := ber.DecodeString(f.Children[0].Data.Bytes())
+      for _, v := range e.values(name) {
+        if matchSubstrings(strings.ToLower(v), f.Children[1].Children) {
+          return true
+        }
+      }
+    case ldap.FilterExtensibleMatch:
+      rule, name, value := "", "", ""
+      for _, c := range f.Children {
+        switch c.Tag {
+          case ldap.MatchingRuleAssertionMatchingRule:
+            rule = ber.DecodeString(c.Data.Bytes())
+          case ldap.MatchingRuleAssertionType:
+            name = ber.DecodeString(c.Data.Bytes())
+          case ldap.MatchingRuleAssertionMatchValue:
+            value = ber.DecodeString(c.Data.Bytes())
+        }
+      }
+      if rule == "1.2.840.113556.1.4.1941" {
+        return s.inChain(e, name, value, make(map[string]bool))
+      }
+  }
+  return false
+}
+
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+  for _, p := range parts {
+    sub := strings.ToLower(ber.DecodeString(p.Data.Bytes()))
+    switch p.Tag {
+      case ldap.FilterSubstringsInitial:
+        if !strings.HasPrefix(v, sub) {
+          return false
+        }
+        v = v[len(sub):]
+      case ldap.FilterSubstringsAny:
+        i := strings.Index(v, sub)
+        if i < 0 {
+          return false
+        }
+        v = v[i + len(sub):]
+      case ldap.FilterSubstringsFinal:
+        if !strings.HasSuffix(v, sub) {
+          return false
+        }
+    }
+  }
+  return true
+}
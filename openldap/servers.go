@@ -0,0 +1,230 @@
+package openldap
+
+import (
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "strings"
+  "strconv"
+  "net/url"
+  "crypto/tls"
+  "github.com/go-ldap/ldap/v3"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const (
+  // The servers are tried in the order of the config
+  ServersFailover   = "failover"
+  // The new connections go to the next server
+  ServersRoundRobin = "round_robin"
+
+  defaultServerTimeout = 10 * time.Second
+  defaultServerBackoff = 30 * time.Second
+)
+
+type ServerStats struct {
+  URL              string
+  Down             bool
+  Dials            int64
+  Failures         int64
+}
+
+type server struct {
+  url              string
+  addr             string
+  host             string
+  tlsMode          string
+  timeout          time.Duration
+  downUntil        time.Time
+  stats            ServerStats
+}
+
+type serverList struct {
+  mu               sync.Mutex
+  servers        []*server
+  roundRobin       bool
+  next             int
+  backoff          time.Duration
+  tls             *tls.Config
+  // Host of the server by default
+  serverName       string
+}
+
+// newServerList reads the servers of the config: ldap://host:port or ldaps://host:port
+// with the optional ?timeout=<seconds>, or Host and Port without the servers
+func newServerList(info *base.LDAPInfo) (*serverList, error) {
+  if _, err := tlsConfig(info); err != nil {
+    return nil, err
+  }
+  cfg, err := newTLSConfig(info)
+  if err != nil {
+    return nil, err
+  }
+  l := &serverList{
+    backoff:    time.Duration(info.Server_backoff) * time.Second,
+    tls:        cfg,
+    serverName: info.Tls_server_name,
+  }
+  switch strings.ToLower(info.Server_policy) {
+    case "", ServersFailover:
+    case ServersRoundRobin:
+      l.roundRobin = true
+    default:
+      return nil, fmt.Errorf("unknown server_policy '%s'", info.Server_policy)
+  }
+  if l.backoff <= 0 {
+    l.backoff = defaultServerBackoff
+  }
+  timeout := time.Duration(info.Timeout) * time.Second
+  if timeout <= 0 {
+    timeout = defaultServerTimeout
+  }
+
+  urls := info.Servers
+  if len(urls) == 0 {
+    scheme := "ldap"
+    if tlsMode(info) == TLSLDAPS {
+      scheme = "ldaps"
+    }
+    urls = []string{fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(info.Host, strconv.Itoa(info.Port)))}
+  }
+  for _, str := range urls {
+    u, err := url.Parse(str)
+    if err != nil {
+      return nil, err
+    }
+    s := &server{url: str, host: u.Hostname(), timeout: timeout, stats: ServerStats{URL: str}}
+    port := u.Port()
+    switch strings.ToLower(u.Scheme) {
+      case "ldap":
+        if port == "" {
+          port = "389"
+        }
+        s.tlsMode = tlsMode(info)
+        if s.tlsMode == TLSLDAPS {
+          return nil, fmt.Errorf("server '%s': ldap:// with tls_mode ldaps", str)
+        }
+      case "ldaps":
+        if port == "" {
+          port = "636"
+        }
+        s.tlsMode = TLSLDAPS
+      default:
+        return nil, fmt.Errorf("server '%s': unknown scheme", str)
+    }
+    if t := u.Query().Get("timeout"); t != "" {
+      sec, err := strconv.Atoi(t)
+      if err != nil || sec <= 0 {
+        return nil, fmt.Errorf("server '%s': bad timeout", str)
+      }
+      s.timeout = time.Duration(sec) * time.Second
+    }
+    s.addr = net.JoinHostPort(s.host, port)
+    l.servers = append(l.servers, s)
+  }
+  return l, nil
+}
+
+func (l *serverList) String() string {
+  res := make([]string, 0, len(l.servers))
+  for _, s := range l.servers {
+    res = append(res, s.url)
+  }
+  return strings.Join(res, ",")
+}
+
+// order returns the servers to try: the servers in backoff go last
+func (l *serverList) order() []*server {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  start := 0
+  if l.roundRobin {
+    start = l.next % len(l.servers)
+    l.next++
+  }
+  now := time.Now()
+  up := make([]*server, 0, len(l.servers))
+  down := make([]*server, 0)
+  for i := range l.servers {
+    s := l.servers[(start + i) % len(l.servers)]
+    if now.Before(s.downUntil) {
+      down = append(down, s)
+    } else {
+      up = append(up, s)
+    }
+  }
+  return append(up, down...)
+}
+
+func (l *serverList) result(s *server, err error) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  s.stats.Dials++
+  if err == nil {
+    s.downUntil = time.Time{}
+    return
+  }
+  s.stats.Failures++
+  s.downUntil = time.Now().Add(l.backoff)
+  glog.Errorf("ERR: LDAP (%s): %v, down for %v", s.url, err, l.backoff)
+}
+
+func (l *serverList) getStats() []ServerStats {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  res := make([]ServerStats, 0, len(l.servers))
+  now := time.Now()
+  for _, s := range l.servers {
+    st := s.stats
+    st.Down = now.Before(s.downUntil)
+    res = append(res, st)
+  }
+  return res
+}
+
+func (l *serverList) dialServer(s *server) (*ldap.Conn, error) {
+  cfg := l.tls.Clone()
+  cfg.ServerName = l.serverName
+  if cfg.ServerName == "" {
+    cfg.ServerName = s.host
+  }
+  dialer := &net.Dialer{Timeout: s.timeout}
+  var conn *ldap.Conn
+  var err error
+  if s.tlsMode == TLSLDAPS {
+    conn, err = ldap.DialURL("ldaps://" + s.addr, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(cfg))
+  } else {
+    conn, err = ldap.DialURL("ldap://" + s.addr, ldap.DialWithDialer(dialer))
+  }
+  if err != nil {
+    return nil, err
+  }
+  conn.SetTimeout(s.timeout)
+  if s.tlsMode == TLSStartTLS {
+    if err = conn.StartTLS(cfg); err != nil {
+      conn.Close()
+      return nil, err
+    }
+  }
+  return conn, nil
+}
+
+// dial connects to the first available server
+func (l *serverList) dial() (*ldap.Conn, error) {
+  var err error
+  for _, s := range l.order() {
+    var conn *ldap.Conn
+    conn, err = l.dialServer(s)
+    l.result(s, err)
+    if err == nil {
+      if glog.V(9) {
+        glog.Infof("DBG: LDAP: connected to %s", s.url)
+      }
+      return conn, nil
+    }
+  }
+  return nil, err
+}
@@ -0,0 +1,122 @@
+package openldap
+
+import (
+  "fmt"
+  "net"
+  "time"
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+// closedPort returns a port without a listener
+func closedPort(t *testing.T) int {
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  assert.Nil(t, err)
+  port := ln.Addr().(*net.TCPAddr).Port
+  ln.Close()
+  return port
+}
+
+func TestLDAPServerList(t *testing.T) {
+  l, err := newServerList(&base.LDAPInfo{Host: "dc1.test", Port: 389})
+  assert.Nil(t, err)
+  assert.Equal(t, "ldap://dc1.test:389", l.String())
+  assert.Equal(t, defaultServerTimeout, l.servers[0].timeout)
+  assert.Equal(t, defaultServerBackoff, l.backoff)
+
+  l, err = newServerList(&base.LDAPInfo{Host: "dc1.test", Port: 636, Tls_mode: "ldaps"})
+  assert.Nil(t, err)
+  assert.Equal(t, "ldaps://dc1.test:636", l.String())
+
+  l, err = newServerList(&base.LDAPInfo{Servers: []string{"ldap://dc1.test", "ldaps://dc2.test?timeout=3", "ldap://dc3.test:10389"}, Timeout: 5, Server_backoff: 60, Tls_mode: "starttls"})
+  assert.Nil(t, err)
+  assert.Equal(t, "dc1.test:389", l.servers[0].addr)
+  assert.Equal(t, TLSStartTLS, l.servers[0].tlsMode)
+  assert.Equal(t, 5 * time.Second, l.servers[0].timeout)
+  assert.Equal(t, "dc2.test:636", l.servers[1].addr)
+  assert.Equal(t, TLSLDAPS, l.servers[1].tlsMode)
+  assert.Equal(t, 3 * time.Second, l.servers[1].timeout)
+  assert.Equal(t, "dc3.test:10389", l.servers[2].addr)
+  assert.Equal(t, time.Minute, l.backoff)
+
+  for _, info := range []base.LDAPInfo{
+        {Servers: []string{"http://dc1.test"}},
+        {Servers: []string{"ldap://dc1.test?timeout=x"}},
+        {Servers: []string{"ldap://dc1.test"}, Tls_mode: "ldaps"},
+        {Servers: []string{"ldap://dc1.test"}, Server_policy: "random"},
+      } {
+    _, err = newServerList(&info)
+    assert.NotNil(t, err, info)
+  }
+}
+
+func TestLDAPFailover(t *testing.T) {
+  srv1 := newTestServer(t, testDirectory()...)
+  defer srv1.close()
+  srv2 := newTestServer(t, testDirectory()...)
+  defer srv2.close()
+
+  down := fmt.Sprintf("ldap://127.0.0.1:%d?timeout=1", closedPort(t))
+  l := newTestInfo(srv1)
+  l.LDAP.Servers = []string{down, fmt.Sprintf("ldap://127.0.0.1:%d", srv1.port()), fmt.Sprintf("ldap://127.0.0.1:%d", srv2.port())}
+  assert.Equal(t, true, l.Init())
+  defer l.Close()
+
+  _, ok := l.Login("alice", "alice-pwd")
+  assert.Equal(t, true, ok)
+  assert.NotEqual(t, "", srv1.lastFilter())
+  assert.Equal(t, "", srv2.lastFilter())
+
+  stats := l.Stats().Servers
+  assert.Equal(t, true, stats[0].Down)
+  assert.Equal(t, int64(1), stats[0].Failures)
+  assert.Equal(t, false, stats[1].Down)
+  assert.Equal(t, int64(2), stats[1].Dials)
+  assert.Equal(t, int64(0), stats[2].Dials)
+
+  // The server in backoff is not dialed again
+  srv1.close()
+  srv1.dropConns()
+  time.Sleep(20 * time.Millisecond)
+  _, ok = l.Login("bob", "bob-pwd")
+  assert.Equal(t, true, ok)
+  assert.NotEqual(t, "", srv2.lastFilter())
+  stats = l.Stats().Servers
+  assert.Equal(t, int64(1), stats[0].Dials)
+  assert.Equal(t, true, stats[1].Down)
+  assert.Equal(t, false, stats[2].Down)
+
+  // After the backoff the servers are tried in order again
+  l.servers.mu.Lock()
+  for _, s := range l.servers.servers {
+    s.downUntil = time.Time{}
+  }
+  l.servers.mu.Unlock()
+  conn, err := l.servers.dial()
+  assert.Nil(t, err)
+  conn.Close()
+  stats = l.Stats().Servers
+  assert.Equal(t, int64(2), stats[0].Dials)
+  assert.Equal(t, int64(2), stats[1].Failures)
+}
+
+func TestLDAPRoundRobin(t *testing.T) {
+  srv1 := newTestServer(t, testDirectory()...)
+  defer srv1.close()
+  srv2 := newTestServer(t, testDirectory()...)
+  defer srv2.close()
+
+  l, err := newServerList(&base.LDAPInfo{Server_policy: ServersRoundRobin,
+                                         Servers: []string{fmt.Sprintf("ldap://127.0.0.1:%d", srv1.port()), fmt.Sprintf("ldap://127.0.0.1:%d", srv2.port())}})
+  assert.Nil(t, err)
+  for i := 0; i < 4; i++ {
+    conn, err := l.dial()
+    assert.Nil(t, err)
+    conn.Close()
+  }
+  stats := l.getStats()
+  assert.Equal(t, int64(2), stats[0].Dials)
+  assert.Equal(t, int64(2), stats[1].Dials)
+}
@@ -0,0 +1,76 @@
+package openldap
+
+import (
+  "fmt"
+  "strings"
+  "io/ioutil"
+  "crypto/tls"
+  "crypto/x509"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const (
+  TLSNone     = "none"
+  TLSLDAPS    = "ldaps"
+  TLSStartTLS = "starttls"
+)
+
+var tlsVersions = map[string]uint16{
+  "1.0": tls.VersionTLS10,
+  "1.1": tls.VersionTLS11,
+  "1.2": tls.VersionTLS12,
+  "1.3": tls.VersionTLS13,
+}
+
+func tlsMode(info *base.LDAPInfo) string {
+  if info.Tls_mode == "" {
+    return TLSNone
+  }
+  return strings.ToLower(info.Tls_mode)
+}
+
+// tlsConfig makes the TLS config of the connections, it is nil in the none mode
+func tlsConfig(info *base.LDAPInfo) (*tls.Config, error) {
+  switch tlsMode(info) {
+    case TLSNone:
+      return nil, nil
+    case TLSLDAPS, TLSStartTLS:
+    default:
+      return nil, fmt.Errorf("unknown tls_mode '%s'", info.Tls_mode)
+  }
+  return newTLSConfig(info)
+}
+
+// newTLSConfig makes the TLS config whatever tls_mode is, f.e. for the ldaps:// servers
+func newTLSConfig(info *base.LDAPInfo) (*tls.Config, error) {
+  cfg := &tls.Config{ServerName: info.Tls_server_name, MinVersion: tls.VersionTLS12}
+  if cfg.ServerName == "" {
+    cfg.ServerName = info.Host
+  }
+  if info.Tls_min_version != "" {
+    v, ok := tlsVersions[info.Tls_min_version]
+    if !ok {
+      return nil, fmt.Errorf("unknown tls_min_version '%s'", info.Tls_min_version)
+    }
+    cfg.MinVersion = v
+  }
+  if info.Tls_ca_file != "" {
+    buf, err := ioutil.ReadFile(info.Tls_ca_file)
+    if err != nil {
+      return nil, err
+    }
+    cfg.RootCAs = x509.NewCertPool()
+    if !cfg.RootCAs.AppendCertsFromPEM(buf) {
+      return nil, fmt.Errorf("no certificates in '%s'", info.Tls_ca_file)
+    }
+  }
+  if info.Tls_cert_file != "" || info.Tls_key_file != "" {
+    cert, err := tls.LoadX509KeyPair(info.Tls_cert_file, info.Tls_key_file)
+    if err != nil {
+      return nil, err
+    }
+    cfg.Certificates = []tls.Certificate{cert}
+  }
+  return cfg, nil
+}
@@ -0,0 +1,180 @@
+package openldap
+
+import (
+  "net"
+  "time"
+  "testing"
+  "math/big"
+  "io/ioutil"
+  "path/filepath"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/rand"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "github.com/stretchr/testify/assert"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+type testPKI struct {
+  caFile       string
+  certFile     string
+  keyFile      string
+  server       tls.Certificate
+  pool        *x509.CertPool
+}
+
+// newTestPKI makes a CA with the server certificate of 127.0.0.1 and ldap.test
+// and the client certificate in the files
+func newTestPKI(t *testing.T) *testPKI {
+  dir := t.TempDir()
+  caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  caTmpl := &x509.Certificate{
+    SerialNumber:          big.NewInt(1),
+    Subject:               pkix.Name{CommonName: "Test CA"},
+    NotBefore:             time.Now().Add(-time.Hour),
+    NotAfter:              time.Now().Add(time.Hour),
+    IsCA:                  true,
+    KeyUsage:              x509.KeyUsageCertSign,
+    BasicConstraintsValid: true,
+  }
+  caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+  assert.Nil(t, err)
+  ca, _ := x509.ParseCertificate(caDER)
+
+  issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+    key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    tmpl := &x509.Certificate{
+      SerialNumber: big.NewInt(serial),
+      Subject:      pkix.Name{CommonName: "ldap.test"},
+      DNSNames:     []string{"ldap.test"},
+      IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+      NotBefore:    time.Now().Add(-time.Hour),
+      NotAfter:     time.Now().Add(time.Hour),
+      KeyUsage:     x509.KeyUsageDigitalSignature,
+      ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+    assert.Nil(t, err)
+    keyDER, _ := x509.MarshalECPrivateKey(key)
+    return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+  }
+
+  p := &testPKI{
+    caFile:   filepath.Join(dir, "ca.pem"),
+    certFile: filepath.Join(dir, "client.pem"),
+    keyFile:  filepath.Join(dir, "client.key"),
+    pool:     x509.NewCertPool(),
+  }
+  p.pool.AddCert(ca)
+  ioutil.WriteFile(p.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+  certPEM, keyPEM := issue(2, x509.ExtKeyUsageServerAuth)
+  p.server, err = tls.X509KeyPair(certPEM, keyPEM)
+  assert.Nil(t, err)
+  certPEM, keyPEM = issue(3, x509.ExtKeyUsageClientAuth)
+  ioutil.WriteFile(p.certFile, certPEM, 0600)
+  ioutil.WriteFile(p.keyFile, keyPEM, 0600)
+  return p
+}
+
+func (p *testPKI) serverConfig() *tls.Config {
+  return &tls.Config{Certificates: []tls.Certificate{p.server}}
+}
+
+func TestLDAPTLSConfig(t *testing.T) {
+  cfg, err := tlsConfig(&base.LDAPInfo{Host: "ldap.test"})
+  assert.Nil(t, err)
+  assert.Nil(t, cfg)
+
+  cfg, err = tlsConfig(&base.LDAPInfo{Host: "ldap.test", Tls_mode: "LDAPS"})
+  assert.Nil(t, err)
+  assert.Equal(t, "ldap.test", cfg.ServerName)
+  assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+
+  cfg, err = tlsConfig(&base.LDAPInfo{Host: "ldap.test", Tls_mode: "starttls", Tls_server_name: "dc1.test", Tls_min_version: "1.3"})
+  assert.Nil(t, err)
+  assert.Equal(t, "dc1.test", cfg.ServerName)
+  assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+
+  _, err = tlsConfig(&base.LDAPInfo{Tls_mode: "ssl"})
+  assert.NotNil(t, err)
+  _, err = tlsConfig(&base.LDAPInfo{Tls_mode: "ldaps", Tls_min_version: "2.0"})
+  assert.NotNil(t, err)
+  _, err = tlsConfig(&base.LDAPInfo{Tls_mode: "ldaps", Tls_ca_file: "/nonexistent/ca.pem"})
+  assert.NotNil(t, err)
+  _, err = tlsConfig(&base.LDAPInfo{Tls_mode: "ldaps", Tls_cert_file: "/nonexistent/client.pem"})
+  assert.NotNil(t, err)
+}
+
+func TestLDAPTLS(t *testing.T) {
+  pki := newTestPKI(t)
+
+  connect := func(srv *testServer, mode string, info func(l *base.LDAPInfo)) (*Info, bool) {
+    l := newTestInfo(srv)
+    l.LDAP.Tls_mode = mode
+    l.LDAP.Tls_ca_file = pki.caFile
+    if info != nil {
+      info(&l.LDAP)
+    }
+    ok := l.Init()
+    return l, ok
+  }
+
+  for _, ldaps := range []bool{true, false} {
+    mode := TLSStartTLS
+    if ldaps {
+      mode = TLSLDAPS
+    }
+    srv := newTestTLSServer(t, pki.serverConfig(), ldaps, testDirectory()...)
+
+    l, ok := connect(srv, mode, nil)
+    assert.Equal(t, true, ok, mode)
+    _, ok = l.Login("alice", "alice-pwd")
+    assert.Equal(t, true, ok, mode)
+    l.Close()
+
+    // Server name
+    l, ok = connect(srv, mode, func(info *base.LDAPInfo) { info.Tls_server_name = "ldap.test" })
+    assert.Equal(t, true, ok, mode)
+    l.Close()
+    l, ok = connect(srv, mode, func(info *base.LDAPInfo) { info.Tls_server_name = "other.test" })
+    assert.Equal(t, false, ok, mode)
+    l.Close()
+
+    // Unknown CA
+    l, ok = connect(srv, mode, func(info *base.LDAPInfo) { info.Tls_ca_file = "" })
+    assert.Equal(t, false, ok, mode)
+    l.Close()
+    srv.close()
+  }
+
+  // Minimum version
+  cfg := pki.serverConfig()
+  cfg.MaxVersion = tls.VersionTLS12
+  srv := newTestTLSServer(t, cfg, true, testDirectory()...)
+  l, ok := connect(srv, TLSLDAPS, func(info *base.LDAPInfo) { info.Tls_min_version = "1.3" })
+  assert.Equal(t, false, ok)
+  l.Close()
+  l, ok = connect(srv, TLSLDAPS, func(info *base.LDAPInfo) { info.Tls_min_version = "1.2" })
+  assert.Equal(t, true, ok)
+  l.Close()
+  srv.close()
+
+  // Client certificate
+  cfg = pki.serverConfig()
+  cfg.ClientAuth = tls.RequireAndVerifyClientCert
+  cfg.ClientCAs = pki.pool
+  srv = newTestTLSServer(t, cfg, true, testDirectory()...)
+  l, ok = connect(srv, TLSLDAPS, nil)
+  assert.Equal(t, false, ok)
+  l.Close()
+  l, ok = connect(srv, TLSLDAPS, func(info *base.LDAPInfo) { info.Tls_cert_file = pki.certFile; info.Tls_key_file = pki.keyFile })
+  assert.Equal(t, true, ok)
+  _, ok = l.Login("bob", "bob-pwd")
+  assert.Equal(t, true, ok)
+  l.Close()
+  srv.close()
+}
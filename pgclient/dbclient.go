@@ -2,6 +2,7 @@ package pgclient
 
 import (
   "time"
+  "context"
   "net/http"
   "github.com/google/uuid"
   "github.com/golang/glog"
@@ -79,6 +80,27 @@ func (a *Info) Close() {
 }
 
 func (a *Info) Login(login string, password string) (base.User, bool) {
+  return a.LoginContext(context.Background(), login, password)
+}
+
+// LoginContext returns when ctx is done even if the database does not answer
+func (a *Info) LoginContext(ctx context.Context, login string, password string) (base.User, bool) {
+  var user base.User
+  var ok bool
+  err := base.RunContext(ctx, func() {
+    user, ok = a.login(login, password)
+  })
+  if err != nil {
+    glog.Errorf("ERR: AUTH: Login(%v): %v", login, err)
+    return base.User{}, false
+  }
+  if ok && !a.CheckUserGroups(&user) {
+    return base.User{}, false
+  }
+  return user, ok
+}
+
+func (a *Info) login(login string, password string) (base.User, bool) {
   u := UserAuth{}
   user := base.User{}
   sql1 := a.Handle.Table(a.AuthTable).Where("login = ?", login)
@@ -115,3 +137,10 @@ func (a *Info) OAuthGetUserData(code string) ([]byte, error) {
   buf := make([]byte, 0)
   return buf, nil
 }
+
+func (a *Info) OAuthGetUserDataContext(ctx context.Context, code string) ([]byte, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  return a.OAuthGetUserData(code)
+}
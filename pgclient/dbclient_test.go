@@ -2,6 +2,7 @@ package pgclient
 
 import (
   "testing"
+  "context"
   "strconv"
   "github.com/stretchr/testify/assert"
   "flag"
@@ -111,3 +112,15 @@ func BenchmarkDBClient(b *testing.B) {
   defer db.Close()
 }
 
+
+func TestDBLoginContext(t *testing.T) {
+  cfg := base.AuthConfig{ CODE: "db", TypeAuth: "postgres" }
+  db := New(&cfg)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  _, ok := db.LoginContext(ctx, "user1", "password1")
+  assert.Equal(t, false, ok)
+  _, err := db.OAuthGetUserDataContext(ctx, "code")
+  assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,482 @@
+package auth
+
+import (
+  "fmt"
+  "sync"
+  "time"
+  "strings"
+  "strconv"
+  "net/http"
+  "gopkg.in/yaml.v2"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const (
+  PolicyAllow = "allow"
+  PolicyDeny  = "deny"
+)
+
+// Condition is one check or a group of checks:
+//
+//   attr: resource.owner      # user.*, resource.*, env.*
+//   op: eq                    # eq, ne, in, contains, gt, ge, lt, le, exists
+//   ref: user.id              # compare with other attribute, or
+//   value: 5                  # compare with the value
+//
+// or all: [...], any: [...], not: {...}
+type Condition struct {
+  All        []Condition      `yaml:"all"`
+  Any        []Condition      `yaml:"any"`
+  Not         *Condition      `yaml:"not"`
+
+  Attr         string         `yaml:"attr"`
+  Op           string         `yaml:"op"`
+  Value        interface{}    `yaml:"value"`
+  Ref          string         `yaml:"ref"`
+}
+
+type PolicyRule struct {
+  Name         string         `yaml:"name"`
+  Effect       string         `yaml:"effect"`
+  If           Condition      `yaml:"if"`
+}
+
+type PolicyInfo struct {
+  Rules      []PolicyRule     `yaml:"rules"`
+}
+
+// PoliciesInfo is the YAML config:
+//
+//   policies:
+//     invoice_edit:
+//       rules:
+//         - name: owner
+//           effect: allow
+//           if: {attr: resource.owner, op: eq, ref: user.id}
+//         - name: accounting in business hours
+//           effect: allow
+//           if:
+//             all:
+//               - {attr: user.groups, op: contains, value: accounting}
+//               - {attr: env.hour, op: ge, value: 9}
+//               - {attr: env.hour, op: lt, value: 18}
+type PoliciesInfo struct {
+  Policies     map[string]PolicyInfo    `yaml:"policies"`
+}
+
+// PolicyInput is what the rules are evaluated against
+type PolicyInput struct {
+  User         *base.User
+  Resource     map[string]interface{}
+  // Attributes of the request: env.ip, env.method, env.path and the custom ones
+  Env          map[string]interface{}
+  // The time of env.hour and env.weekday (0 = Sunday), now by default
+  Time         time.Time
+}
+
+// PolicyDecision is the result with the trace of the evaluation
+type PolicyDecision struct {
+  Policy       string
+  Allowed      bool
+  // The rule which made the decision, empty when no rule matched (denied by default)
+  Rule         string
+  Trace      []string
+}
+
+type Policies struct {
+  mu           sync.RWMutex
+  policies     map[string]PolicyInfo
+  trace        bool
+}
+
+func NewPolicies() *Policies {
+  return &Policies{policies: make(map[string]PolicyInfo)}
+}
+
+// SetTrace logs the trace of the denied requests
+func (p *Policies) SetTrace(trace bool) {
+  p.mu.Lock()
+  p.trace = trace
+  p.mu.Unlock()
+}
+
+func (p *Policies) Load(filename string, fileBuf []byte) bool {
+  var cfg PoliciesInfo
+  // The unknown keys are errors, a misspelled condition must not become an empty one
+  if err := yaml.UnmarshalStrict(fileBuf, &cfg); err != nil {
+    glog.Errorf("ERR: POLICY: yamlFile(%s): YAML: %v", filename, err)
+    return false
+  }
+  return p.Init(&cfg)
+}
+
+// Init replaces the policies, the old ones are kept on error
+func (p *Policies) Init(cfg *PoliciesInfo) bool {
+  for name, policy := range cfg.Policies {
+    for i, rule := range policy.Rules {
+      if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+        glog.Errorf("ERR: POLICY: %s: rule %d: unknown effect '%s'", name, i, rule.Effect)
+        return false
+      }
+      if err := rule.If.validate(); err != nil {
+        glog.Errorf("ERR: POLICY: %s: rule %d: %v", name, i, err)
+        return false
+      }
+    }
+  }
+  p.mu.Lock()
+  p.policies = cfg.Policies
+  p.mu.Unlock()
+  if glog.V(2) {
+    glog.Infof("LOG: POLICY: Loaded %d policies", len(cfg.Policies))
+  }
+  return true
+}
+
+// validate checks the condition, the empty one is an error: it would match everything
+func (c *Condition) validate() error {
+  if len(c.All) == 0 && len(c.Any) == 0 && c.Not == nil && c.Attr == "" {
+    return fmt.Errorf("empty condition")
+  }
+  for i := range c.All {
+    if err := c.All[i].validate(); err != nil {
+      return err
+    }
+  }
+  for i := range c.Any {
+    if err := c.Any[i].validate(); err != nil {
+      return err
+    }
+  }
+  if c.Not != nil {
+    if err := c.Not.validate(); err != nil {
+      return err
+    }
+  }
+  if c.Attr == "" {
+    if c.Op != "" || c.Ref != "" || c.Value != nil {
+      return fmt.Errorf("op '%s' without attr", c.Op)
+    }
+    return nil
+  }
+  switch c.Op {
+    case "eq", "ne", "in", "contains", "gt", "ge", "lt", "le", "exists":
+    default:
+      return fmt.Errorf("unknown op '%s'", c.Op)
+  }
+  if !validAttr(c.Attr) || (c.Ref != "" && !validAttr(c.Ref)) {
+    return fmt.Errorf("unknown attribute '%s' or '%s'", c.Attr, c.Ref)
+  }
+  return nil
+}
+
+func validAttr(name string) bool {
+  return strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "resource.") || strings.HasPrefix(name, "env.")
+}
+
+// NewPolicyInput makes the input of the request with the user of the context (see Middleware).
+// env.ip is the remote address, Session.NewPolicyInput takes the client behind the proxies
+func NewPolicyInput(r *http.Request, resource map[string]interface{}) *PolicyInput {
+  ip := r.RemoteAddr
+  if i := strings.LastIndex(ip, ":"); i > 0 {
+    ip = strings.Trim(ip[:i], "[]")
+  }
+  return newPolicyInput(r, resource, ip)
+}
+
+// NewPolicyInput is NewPolicyInput with env.ip of the client by the policy of the session (see SessionPolicy.Trust_proxy)
+func (s *Session) NewPolicyInput(r *http.Request, resource map[string]interface{}) *PolicyInput {
+  return newPolicyInput(r, resource, s.clientIP(r))
+}
+
+func newPolicyInput(r *http.Request, resource map[string]interface{}, ip string) *PolicyInput {
+  user, _ := UserFromRequest(r)
+  return &PolicyInput{
+    User:     user,
+    Resource: resource,
+    Env:      map[string]interface{}{"ip": ip, "method": r.Method, "path": r.URL.Path},
+    Time:     time.Now(),
+  }
+}
+
+func (in *PolicyInput) attr(name string) (interface{}, bool) {
+  parts := strings.SplitN(name, ".", 2)
+  key := parts[1]
+  switch parts[0] {
+    case "user":
+      if in.User == nil {
+        return nil, false
+      }
+      switch key {
+        case "id":
+          return in.User.ID.String(), true
+        case "login":
+          return in.User.Login, true
+        case "email":
+          return in.User.EMail, true
+        case "group":
+          return in.User.Group, true
+        case "groups":
+          groups := make([]interface{}, 0, len(in.User.Groups) + 1)
+          if in.User.Group != "" {
+            groups = append(groups, in.User.Group)
+          }
+          for _, g := range in.User.Groups {
+            groups = append(groups, g)
+          }
+          return groups, true
+        case "lang":
+          return in.User.Language, true
+        case "auth_code":
+          return in.User.AuthCode, true
+      }
+    case "resource":
+      v, ok := in.Resource[key]
+      return v, ok
+    case "env":
+      t := in.Time
+      if t.IsZero() {
+        t = time.Now()
+      }
+      switch key {
+        case "hour":
+          return t.Hour(), true
+        case "weekday":
+          return int(t.Weekday()), true
+      }
+      v, ok := in.Env[key]
+      return v, ok
+  }
+  return nil, false
+}
+
+func toNumber(v interface{}) (float64, bool) {
+  switch n := v.(type) {
+    case int:
+      return float64(n), true
+    case int32:
+      return float64(n), true
+    case int64:
+      return float64(n), true
+    case uint:
+      return float64(n), true
+    case uint64:
+      return float64(n), true
+    case float32:
+      return float64(n), true
+    case float64:
+      return n, true
+    case string:
+      f, err := strconv.ParseFloat(n, 64)
+      return f, err == nil
+  }
+  return 0, false
+}
+
+func toList(v interface{}) []interface{} {
+  switch l := v.(type) {
+    case []interface{}:
+      return l
+    case []string:
+      res := make([]interface{}, 0, len(l))
+      for _, s := range l {
+        res = append(res, s)
+      }
+      return res
+  }
+  return []interface{}{v}
+}
+
+// equalValues compares the numbers by value and the strings exactly:
+// "1e3" is not "1000", the strings are parsed only by gt, ge, lt, le
+func equalValues(a interface{}, b interface{}) bool {
+  _, strA := a.(string)
+  _, strB := b.(string)
+  if !strA && !strB {
+    if fa, ok := toNumber(a); ok {
+      if fb, ok := toNumber(b); ok {
+        return fa == fb
+      }
+    }
+  }
+  return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func equalFold(a interface{}, b interface{}) bool {
+  sa, okA := a.(string)
+  sb, okB := b.(string)
+  return okA && okB && strings.EqualFold(sa, sb)
+}
+
+func compareValues(op string, a interface{}, b interface{}) bool {
+  fa, okA := toNumber(a)
+  fb, okB := toNumber(b)
+  if !okA || !okB {
+    return false
+  }
+  switch op {
+    case "gt":
+      return fa > fb
+    case "ge":
+      return fa >= fb
+    case "lt":
+      return fa < fb
+    case "le":
+      return fa <= fb
+  }
+  return false
+}
+
+// eval evaluates the condition and appends the results to the trace
+func (c *Condition) eval(in *PolicyInput, trace *[]string, indent string) bool {
+  res := true
+  if len(c.All) > 0 {
+    *trace = append(*trace, indent + "all:")
+    for i := range c.All {
+      if !c.All[i].eval(in, trace, indent + "  ") {
+        res = false
+        break
+      }
+    }
+  }
+  if res && len(c.Any) > 0 {
+    *trace = append(*trace, indent + "any:")
+    found := false
+    for i := range c.Any {
+      if c.Any[i].eval(in, trace, indent + "  ") {
+        found = true
+        break
+      }
+    }
+    res = found
+  }
+  if res && c.Not != nil {
+    *trace = append(*trace, indent + "not:")
+    res = !c.Not.eval(in, trace, indent + "  ")
+  }
+  if res && c.Attr != "" {
+    res = c.check(in, trace, indent)
+  }
+  return res
+}
+
+func (c *Condition) check(in *PolicyInput, trace *[]string, indent string) bool {
+  a, okA := in.attr(c.Attr)
+  b, what := c.Value, fmt.Sprintf("%v", c.Value)
+  okB := true
+  if c.Ref != "" {
+    b, okB = in.attr(c.Ref)
+    what = fmt.Sprintf("%s (%v)", c.Ref, b)
+  }
+  res := false
+  switch {
+    case c.Op == "exists":
+      res = okA
+    case !okA || !okB:
+      res = false
+    case c.Op == "eq":
+      res = equalValues(a, b)
+    case c.Op == "ne":
+      res = !equalValues(a, b)
+    case c.Op == "in" || c.Op == "contains":
+      list, item := toList(b), a
+      if c.Op == "contains" {
+        list, item = toList(a), b
+      }
+      // The groups are compared without the case like by base.User.HasGroup
+      groups := c.Attr == "user.groups" || c.Ref == "user.groups"
+      for _, v := range list {
+        if equalValues(v, item) || (groups && equalFold(v, item)) {
+          res = true
+          break
+        }
+      }
+    default:
+      res = compareValues(c.Op, a, b)
+  }
+  if c.Op == "exists" {
+    *trace = append(*trace, fmt.Sprintf("%s%s exists => %v", indent, c.Attr, res))
+  } else {
+    *trace = append(*trace, fmt.Sprintf("%s%s (%v) %s %s => %v", indent, c.Attr, a, c.Op, what, res))
+  }
+  return res
+}
+
+// Explain evaluates the policy: a matched deny rule wins over the allow rules,
+// the request is denied when no rule matches
+func (p *Policies) Explain(name string, in *PolicyInput) *PolicyDecision {
+  d := &PolicyDecision{Policy: name, Trace: make([]string, 0)}
+  p.mu.RLock()
+  policy, ok := p.policies[name]
+  p.mu.RUnlock()
+  if !ok {
+    d.Trace = append(d.Trace, fmt.Sprintf("policy '%s' is not found", name))
+    return d
+  }
+  for i, rule := range policy.Rules {
+    ruleName := rule.Name
+    if ruleName == "" {
+      ruleName = fmt.Sprintf("#%d", i)
+    }
+    d.Trace = append(d.Trace, fmt.Sprintf("rule %s (%s):", ruleName, rule.Effect))
+    if !rule.If.eval(in, &d.Trace, "  ") {
+      continue
+    }
+    if rule.Effect == PolicyDeny {
+      d.Allowed = false
+      d.Rule = ruleName
+      d.Trace = append(d.Trace, "denied by rule " + ruleName)
+      return d
+    }
+    if !d.Allowed {
+      d.Allowed = true
+      d.Rule = ruleName
+    }
+  }
+  if d.Allowed {
+    d.Trace = append(d.Trace, "allowed by rule " + d.Rule)
+  } else {
+    d.Trace = append(d.Trace, "denied: no rule matched")
+  }
+  return d
+}
+
+func (p *Policies) Allowed(name string, in *PolicyInput) bool {
+  d := p.Explain(name, in)
+  p.mu.RLock()
+  trace := p.trace
+  p.mu.RUnlock()
+  if !d.Allowed && trace {
+    glog.Infof("LOG: POLICY: %s: denied:\n%s", name, strings.Join(d.Trace, "\n"))
+  }
+  return d.Allowed
+}
+
+// Require passes the requests allowed by the policy to next, the user is authenticated by m.
+// resource returns the attributes of the requested resource, it may be nil
+func (p *Policies) Require(m *Middleware, name string, resource func(r *http.Request) map[string]interface{}) func(http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      _, r, ok := m.user(w, r)
+      if !ok {
+        m.UnauthorizedHandler.ServeHTTP(w, r)
+        return
+      }
+      var attrs map[string]interface{}
+      if resource != nil {
+        attrs = resource(r)
+      }
+      in := NewPolicyInput(r, attrs)
+      if m.session != nil {
+        in = m.session.NewPolicyInput(r, attrs)
+      }
+      if !p.Allowed(name, in) {
+        m.ForbiddenHandler.ServeHTTP(w, r)
+        return
+      }
+      next.ServeHTTP(w, r)
+    })
+  }
+}
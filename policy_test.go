@@ -0,0 +1,136 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "time"
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const testPolicies = `
+policies:
+  invoice_edit:
+    rules:
+      - name: owner
+        effect: allow
+        if: {attr: resource.owner, op: eq, ref: user.id}
+      - name: accounting in business hours
+        effect: allow
+        if:
+          all:
+            - {attr: user.groups, op: contains, value: accounting}
+            - {attr: env.hour, op: ge, value: 9}
+            - {attr: env.hour, op: lt, value: 18}
+            - not: {attr: env.weekday, op: in, value: [0, 6]}
+      - name: closed
+        effect: deny
+        if: {attr: resource.status, op: eq, value: closed}
+`
+
+func TestPolicies(t *testing.T) {
+  p := NewPolicies()
+  assert.False(t, p.Load("bad.yaml", []byte("policies: [")))
+  assert.True(t, p.Load("policies.yaml", []byte(testPolicies)))
+
+  owner, _ := uuid.Parse("00000002-0003-0004-0005-000000000040")
+  other, _ := uuid.Parse("00000002-0003-0004-0005-000000000041")
+  // Wednesday
+  workTime := time.Date(2021, 3, 3, 10, 0, 0, 0, time.UTC)
+  night := time.Date(2021, 3, 3, 22, 0, 0, 0, time.UTC)
+  sunday := time.Date(2021, 3, 7, 10, 0, 0, 0, time.UTC)
+
+  invoice := map[string]interface{}{"owner": owner.String(), "status": "open"}
+  ownerUser := base.User{ID: owner, Login: "owner"}
+  accUser := base.User{ID: other, Login: "acc", Groups: []string{"accounting"}}
+
+  assert.True(t, p.Allowed("invoice_edit", &PolicyInput{User: &ownerUser, Resource: invoice, Time: night}))
+  assert.True(t, p.Allowed("invoice_edit", &PolicyInput{User: &accUser, Resource: invoice, Time: workTime}))
+  assert.False(t, p.Allowed("invoice_edit", &PolicyInput{User: &accUser, Resource: invoice, Time: night}))
+  // The groups are compared without the case
+  accUpper := base.User{ID: other, Login: "acc", Groups: []string{"Accounting"}}
+  assert.True(t, p.Allowed("invoice_edit", &PolicyInput{User: &accUpper, Resource: invoice, Time: workTime}))
+  assert.False(t, equalValues("Accounting", "accounting"))
+  assert.False(t, p.Allowed("invoice_edit", &PolicyInput{User: &accUser, Resource: invoice, Time: sunday}))
+  assert.False(t, p.Allowed("invoice_edit", &PolicyInput{Resource: invoice, Time: workTime}))
+  assert.False(t, p.Allowed("unknown", &PolicyInput{User: &ownerUser, Resource: invoice}))
+
+  // Deny wins
+  closed := map[string]interface{}{"owner": owner.String(), "status": "closed"}
+  d := p.Explain("invoice_edit", &PolicyInput{User: &ownerUser, Resource: closed, Time: workTime})
+  assert.False(t, d.Allowed)
+  assert.Equal(t, "closed", d.Rule)
+
+  d = p.Explain("invoice_edit", &PolicyInput{User: &accUser, Resource: invoice, Time: night})
+  assert.False(t, d.Allowed)
+  assert.Equal(t, "", d.Rule)
+  assert.Contains(t, d.Trace, "    env.hour (22) lt 18 => false")
+  assert.Equal(t, "denied: no rule matched", d.Trace[len(d.Trace) - 1])
+
+  d = p.Explain("invoice_edit", &PolicyInput{User: &ownerUser, Resource: invoice, Time: night})
+  assert.True(t, d.Allowed)
+  assert.Equal(t, "owner", d.Rule)
+
+  // Bad configs do not replace the loaded one
+  assert.False(t, p.Init(&PoliciesInfo{Policies: map[string]PolicyInfo{"a": {Rules: []PolicyRule{{Effect: "maybe"}}}}}))
+  assert.False(t, p.Init(&PoliciesInfo{Policies: map[string]PolicyInfo{"a": {Rules: []PolicyRule{{Effect: PolicyAllow, If: Condition{Attr: "user.id", Op: "like"}}}}}}))
+  assert.False(t, p.Init(&PoliciesInfo{Policies: map[string]PolicyInfo{"a": {Rules: []PolicyRule{{Effect: PolicyAllow, If: Condition{Attr: "owner", Op: "eq"}}}}}}))
+  // The empty and misspelled conditions would match everything
+  assert.False(t, p.Init(&PoliciesInfo{Policies: map[string]PolicyInfo{"a": {Rules: []PolicyRule{{Effect: PolicyAllow}}}}}))
+  assert.False(t, p.Init(&PoliciesInfo{Policies: map[string]PolicyInfo{"a": {Rules: []PolicyRule{{Effect: PolicyAllow, If: Condition{Any: []Condition{{}}}}}}}}))
+  assert.False(t, p.Load("typo.yaml", []byte("policies:\n  a:\n    rules:\n      - effect: allow\n        if: {atr: user.id, op: exists}\n")))
+  assert.True(t, p.Allowed("invoice_edit", &PolicyInput{User: &ownerUser, Resource: invoice}))
+
+  // The strings are equal only when they are the same
+  assert.True(t, equalValues(5, 5.0))
+  assert.True(t, equalValues(5, "5"))
+  assert.False(t, equalValues("1e3", "1000"))
+  assert.False(t, equalValues("0x10", 16))
+  assert.True(t, compareValues("ge", "1e3", 1000))
+}
+
+func TestPoliciesRequire(t *testing.T) {
+  p := NewPolicies()
+  p.SetTrace(true)
+  assert.True(t, p.Init(&PoliciesInfo{Policies: map[string]PolicyInfo{
+    "delete": {Rules: []PolicyRule{{Name: "owner from office", Effect: PolicyAllow, If: Condition{All: []Condition{
+      {Attr: "resource.owner", Op: "eq", Ref: "user.login"},
+      {Attr: "env.ip", Op: "in", Value: []interface{}{"10.0.0.1", "10.0.0.2"}},
+    }}}}},
+  }}))
+
+  j := JWTItem{ServiceJWTType: "HS256", ServiceJWTKey: "mkdvrmiot5e8945er89345tmiwr8345rej34n7w46s", ExpiryTime: 100}
+  assert.True(t, j.JWTInit())
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000040")
+  jwtToken, _ := j.JWTGen(&base.User{ID: uid, Login: "Max"}, "system")
+
+  m := NewMiddleware(nil, &j, &MiddlewareInfo{})
+  h := p.Require(m, "delete", func(r *http.Request) map[string]interface{} {
+    return map[string]interface{}{"owner": r.URL.Query().Get("owner")}
+  })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+  serve := func(url string, ip string) int {
+    req, _ := http.NewRequest("DELETE", url, nil)
+    req.RemoteAddr = ip + ":34567"
+    req.Header.Set("Authorization", "Bearer " + jwtToken)
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    return rr.Code
+  }
+  assert.Equal(t, http.StatusOK, serve("/doc?owner=Max", "10.0.0.2"))
+  assert.Equal(t, http.StatusForbidden, serve("/doc?owner=Max", "10.0.0.3"))
+  assert.Equal(t, http.StatusForbidden, serve("/doc?owner=Bob", "10.0.0.1"))
+
+  // The client behind the proxy
+  s := NewSessions()
+  assert.True(t, s.SetPolicy(&SessionPolicy{Trust_proxy: true, Trusted_proxies: []string{"192.168.1.1"}}))
+  req, _ := http.NewRequest("DELETE", "/doc", nil)
+  req.RemoteAddr = "192.168.1.1:34567"
+  req.Header.Set("X-Forwarded-For", "10.0.0.1")
+  assert.Equal(t, "192.168.1.1", NewPolicyInput(req, nil).Env["ip"])
+  assert.Equal(t, "10.0.0.1", s.NewPolicyInput(req, nil).Env["ip"])
+}
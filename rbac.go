@@ -0,0 +1,225 @@
+package auth
+
+import (
+  "sort"
+  "sync"
+  "strings"
+  "net/http"
+  "gopkg.in/yaml.v2"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+// RBACAnyProvider is the mapping code used for the users of any provider
+const RBACAnyProvider = "*"
+
+type RoleInfo struct {
+  Permissions   []string          `yaml:"permissions"`
+  Inherits      []string          `yaml:"inherits"`
+}
+
+// RBACInfo is the YAML config of the roles:
+//
+//   roles:
+//     viewer:
+//       permissions: ["invoice:read"]
+//     accountant:
+//       inherits: ["viewer"]
+//       permissions: ["invoice:approve"]
+//   mappings:
+//     ldap:                     # code of the provider or "*"
+//       accounting: ["accountant"]
+type RBACInfo struct {
+  Roles         map[string]RoleInfo              `yaml:"roles"`
+  Mappings      map[string]map[string][]string   `yaml:"mappings"`
+}
+
+type RBAC struct {
+  mu            sync.RWMutex
+  // role -> permissions including the inherited ones
+  roles         map[string]map[string]bool
+  // provider code -> group (lower case) -> roles
+  mappings      map[string]map[string][]string
+}
+
+func NewRBAC() *RBAC {
+  return &RBAC{roles: make(map[string]map[string]bool), mappings: make(map[string]map[string][]string)}
+}
+
+func (a *RBAC) Load(filename string, fileBuf []byte) bool {
+  var cfg RBACInfo
+  if err := yaml.Unmarshal(fileBuf, &cfg); err != nil {
+    glog.Errorf("ERR: RBAC: yamlFile(%s): YAML: %v", filename, err)
+    return false
+  }
+  return a.Init(&cfg)
+}
+
+// Init replaces the roles and the mappings, the old ones are kept on error
+func (a *RBAC) Init(cfg *RBACInfo) bool {
+  roles := make(map[string]map[string]bool, len(cfg.Roles))
+  for name := range cfg.Roles {
+    if !resolveRole(cfg.Roles, name, roles, make(map[string]bool)) {
+      return false
+    }
+  }
+  mappings := make(map[string]map[string][]string, len(cfg.Mappings))
+  for code, groups := range cfg.Mappings {
+    m := make(map[string][]string, len(groups))
+    for group, names := range groups {
+      for _, name := range names {
+        if _, ok := roles[name]; !ok {
+          glog.Errorf("ERR: RBAC: Mapping(%s:%s): unknown role '%s'", code, group, name)
+          return false
+        }
+      }
+      key := strings.ToLower(group)
+      m[key] = append(m[key], names...)
+    }
+    mappings[code] = m
+  }
+  a.mu.Lock()
+  a.roles = roles
+  a.mappings = mappings
+  a.mu.Unlock()
+  if glog.V(2) {
+    glog.Infof("LOG: RBAC: Loaded %d roles, %d mappings", len(roles), len(mappings))
+  }
+  return true
+}
+
+// resolveRole collects the permissions of the role and of the inherited roles
+func resolveRole(cfg map[string]RoleInfo, name string, res map[string]map[string]bool, path map[string]bool) bool {
+  if _, ok := res[name]; ok {
+    return true
+  }
+  info, ok := cfg[name]
+  if !ok {
+    glog.Errorf("ERR: RBAC: Unknown role '%s'", name)
+    return false
+  }
+  if path[name] {
+    glog.Errorf("ERR: RBAC: Role '%s' inherits itself", name)
+    return false
+  }
+  path[name] = true
+  perms := make(map[string]bool)
+  for _, parent := range info.Inherits {
+    if !resolveRole(cfg, parent, res, path) {
+      return false
+    }
+    for p := range res[parent] {
+      perms[p] = true
+    }
+  }
+  for _, p := range info.Permissions {
+    perms[p] = true
+  }
+  delete(path, name)
+  res[name] = perms
+  return true
+}
+
+// Roles returns the roles of the user mapped from the groups for its provider
+func (a *RBAC) Roles(user *base.User) []string {
+  if user == nil {
+    return []string{}
+  }
+  groups := make([]string, 0, len(user.Groups) + 1)
+  if user.Group != "" {
+    groups = append(groups, user.Group)
+  }
+  groups = append(groups, user.Groups...)
+
+  found := make(map[string]bool)
+  a.mu.RLock()
+  for _, code := range []string{user.AuthCode, RBACAnyProvider} {
+    m, ok := a.mappings[code]
+    if !ok {
+      continue
+    }
+    for _, group := range groups {
+      for _, role := range m[strings.ToLower(group)] {
+        found[role] = true
+      }
+    }
+  }
+  a.mu.RUnlock()
+
+  res := make([]string, 0, len(found))
+  for role := range found {
+    res = append(res, role)
+  }
+  sort.Strings(res)
+  return res
+}
+
+// Permissions returns all permissions of the user
+func (a *RBAC) Permissions(user *base.User) []string {
+  found := make(map[string]bool)
+  roles := a.Roles(user)
+  a.mu.RLock()
+  for _, role := range roles {
+    for p := range a.roles[role] {
+      found[p] = true
+    }
+  }
+  a.mu.RUnlock()
+
+  res := make([]string, 0, len(found))
+  for p := range found {
+    res = append(res, p)
+  }
+  sort.Strings(res)
+  return res
+}
+
+// matchPermission checks the permission against the granted one,
+// "*" grants everything and "invoice:*" grants "invoice:approve"
+func matchPermission(granted string, permission string) bool {
+  if granted == permission || granted == "*" {
+    return true
+  }
+  if strings.HasSuffix(granted, ":*") {
+    return strings.HasPrefix(permission, granted[:len(granted) - 1])
+  }
+  return false
+}
+
+// Can checks if the user has the permission
+func (a *RBAC) Can(user *base.User, permission string) bool {
+  if permission == "" {
+    return false
+  }
+  for _, p := range a.Permissions(user) {
+    if matchPermission(p, permission) {
+      return true
+    }
+  }
+  return false
+}
+
+// Require passes the requests of the users with all permissions to next,
+// the user is authenticated by m
+func (a *RBAC) Require(m *Middleware, permissions ...string) func(http.Handler) http.Handler {
+  return func(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      user, r, ok := m.user(w, r)
+      if !ok {
+        m.UnauthorizedHandler.ServeHTTP(w, r)
+        return
+      }
+      for _, p := range permissions {
+        if !a.Can(user, p) {
+          if glog.V(2) {
+            glog.Warningf("WRN: RBAC: User '%s' has not permission '%s'", user.Login, p)
+          }
+          m.ForbiddenHandler.ServeHTTP(w, r)
+          return
+        }
+      }
+      next.ServeHTTP(w, r)
+    })
+  }
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const testRBAC = `
+roles:
+  viewer:
+    permissions: ["invoice:read"]
+  accountant:
+    inherits: ["viewer"]
+    permissions: ["invoice:approve"]
+  admin:
+    inherits: ["accountant"]
+    permissions: ["user:*"]
+mappings:
+  ldap:
+    Accounting: ["accountant"]
+    admins: ["admin"]
+  db:
+    accounting: ["viewer"]
+  "*":
+    staff: ["viewer"]
+`
+
+func TestRBAC(t *testing.T) {
+  a := NewRBAC()
+  assert.False(t, a.Load("bad.yaml", []byte("roles: [")))
+  assert.True(t, a.Load("rbac.yaml", []byte(testRBAC)))
+
+  acc := base.User{Login: "acc", Groups: []string{"accounting"}, AuthCode: "ldap"}
+  assert.Equal(t, []string{"accountant"}, a.Roles(&acc))
+  assert.Equal(t, []string{"invoice:approve", "invoice:read"}, a.Permissions(&acc))
+  assert.True(t, a.Can(&acc, "invoice:approve"))
+  assert.True(t, a.Can(&acc, "invoice:read"))
+  assert.False(t, a.Can(&acc, "user:delete"))
+  assert.False(t, a.Can(&acc, ""))
+
+  // The same group of other provider
+  acc.AuthCode = "db"
+  assert.True(t, a.Can(&acc, "invoice:read"))
+  assert.False(t, a.Can(&acc, "invoice:approve"))
+
+  // Any provider
+  staff := base.User{Login: "staff", Group: "staff"}
+  assert.Equal(t, []string{"viewer"}, a.Roles(&staff))
+
+  admin := base.User{Login: "root", Groups: []string{"admins"}, AuthCode: "ldap"}
+  assert.True(t, a.Can(&admin, "user:delete"))
+  assert.True(t, a.Can(&admin, "invoice:read"))
+  assert.False(t, a.Can(&admin, "users:delete"))
+  assert.False(t, a.Can(nil, "invoice:read"))
+
+  // Bad configs do not replace the loaded one
+  assert.False(t, a.Init(&RBACInfo{Roles: map[string]RoleInfo{"a": {Inherits: []string{"b"}}, "b": {Inherits: []string{"a"}}}}))
+  assert.False(t, a.Init(&RBACInfo{Roles: map[string]RoleInfo{"a": {Inherits: []string{"c"}}}}))
+  assert.False(t, a.Init(&RBACInfo{Roles: map[string]RoleInfo{"a": {}}, Mappings: map[string]map[string][]string{"ldap": {"g": {"c"}}}}))
+  assert.True(t, a.Can(&admin, "user:delete"))
+
+  assert.True(t, a.Init(&RBACInfo{Roles: map[string]RoleInfo{"root": {Permissions: []string{"*"}}}, Mappings: map[string]map[string][]string{"*": {"admins": {"root"}}}}))
+  assert.True(t, a.Can(&admin, "anything"))
+  assert.False(t, a.Can(&acc, "invoice:read"))
+}
+
+func TestRBACRequire(t *testing.T) {
+  a := NewRBAC()
+  assert.True(t, a.Load("rbac.yaml", []byte(testRBAC)))
+
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+
+  m := NewMiddleware(s, nil, &MiddlewareInfo{})
+  next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("ok"))
+  })
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000039")
+  info := base.User{ID: uid, Login: "acc", EMail: "acc@aaa.ru", Groups: []string{"accounting"}, AuthCode: "ldap"}
+  rr := httptest.NewRecorder()
+  token, err := s.HTTPUserLoginToken(rr, s.genToken(), &info)
+  assert.Nil(t, err)
+
+  serve := func(h http.Handler, token string) int {
+    req, _ := http.NewRequest("POST", "/api/v1/invoice/approve", nil)
+    if token != "" {
+      req.AddCookie(&http.Cookie{Name: "__session", Value: token})
+    }
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    return rr.Code
+  }
+
+  // The provider of the user is kept in the session
+  assert.Equal(t, http.StatusOK, serve(a.Require(m, "invoice:approve")(next), token))
+  assert.Equal(t, http.StatusForbidden, serve(a.Require(m, "invoice:approve", "user:delete")(next), token))
+  assert.Equal(t, http.StatusUnauthorized, serve(a.Require(m, "invoice:read")(next), ""))
+
+  s.Close()
+}
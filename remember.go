@@ -0,0 +1,347 @@
+package auth
+
+import (
+  "sync"
+  "context"
+  "time"
+  "strings"
+  "net/http"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "encoding/base64"
+  "github.com/golang/glog"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-cache"
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const rememberCookieName = "__remember"
+
+// The previous validator is accepted so long after the rotation,
+// the parallel requests come with the same cookie
+const rememberGrace = 30 * time.Second
+
+// RememberToken is a persistent login token. The cookie keeps
+// the selector and the validator, the store keeps only the hash of the validator
+type RememberToken struct {
+  Selector      string        `json:"selector"`
+  Hash          string        `json:"hash"`
+  User          base.User     `json:"user"`
+  // The provider of the user, base.User does not keep it in JSON
+  AuthCode      string        `json:"auth_code,omitempty"`
+  Expires       time.Time     `json:"expires"`
+  // The hash of the validator before the last rotation and the time of the rotation
+  PrevHash      string        `json:"prev_hash,omitempty"`
+  Rotated       time.Time     `json:"rotated,omitempty"`
+}
+
+type RememberStore interface {
+  Save(token *RememberToken) error
+  Get(selector string) (*RememberToken, bool)
+  Remove(selector string)
+  RemoveUser(userID uuid.UUID)
+}
+
+////
+// Remember-me tokens in memory
+////
+type RememberMemory struct {
+  tokens        map[string]RememberToken
+  mu            sync.RWMutex
+}
+
+func NewRememberMemory() *RememberMemory {
+  return &RememberMemory{tokens: make(map[string]RememberToken)}
+}
+
+func (m *RememberMemory) Save(token *RememberToken) error {
+  m.mu.Lock()
+  m.tokens[token.Selector] = *token
+  m.mu.Unlock()
+  return nil
+}
+
+func (m *RememberMemory) Get(selector string) (*RememberToken, bool) {
+  m.mu.RLock()
+  token, ok := m.tokens[selector]
+  m.mu.RUnlock()
+  if !ok {
+    return nil, false
+  }
+  return &token, true
+}
+
+func (m *RememberMemory) Remove(selector string) {
+  m.mu.Lock()
+  delete(m.tokens, selector)
+  m.mu.Unlock()
+}
+
+func (m *RememberMemory) RemoveUser(userID uuid.UUID) {
+  m.mu.Lock()
+  for selector, token := range m.tokens {
+    if token.User.ID == userID {
+      delete(m.tokens, selector)
+    }
+  }
+  m.mu.Unlock()
+}
+
+////
+// Remember-me tokens in the cache (redis, aerospike), shared by the processes.
+// The selectors of the user are listed under a key of the user for RemoveUser,
+// the list is not updated atomically between the processes
+////
+const (
+  rememberKeyPrefix     = "__remember:"
+  rememberUserKeyPrefix = "__remember_user:"
+)
+
+type RememberCache struct {
+  store         cache.ICache
+  mu            sync.Mutex
+}
+
+// NewRememberCache keeps the tokens in the store, its expiry should not be shorter than the tokens
+func NewRememberCache(store cache.ICache) *RememberCache {
+  return &RememberCache{store: store}
+}
+
+func (m *RememberCache) Save(token *RememberToken) error {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.store.Set(rememberKeyPrefix + token.Selector, *token)
+  selectors := m.userSelectors(token.User.ID)
+  for _, selector := range selectors {
+    if selector == token.Selector {
+      return nil
+    }
+  }
+  m.store.Set(rememberUserKeyPrefix + token.User.ID.String(), append(selectors, token.Selector))
+  return nil
+}
+
+func (m *RememberCache) Get(selector string) (*RememberToken, bool) {
+  var token RememberToken
+  obj, ok := m.store.Get(rememberKeyPrefix + selector, &token)
+  if !ok {
+    return nil, false
+  }
+  switch t := obj.(type) {
+    case *RememberToken:
+      res := *t
+      return &res, true
+    case RememberToken:
+      return &t, true
+  }
+  return nil, false
+}
+
+func (m *RememberCache) Remove(selector string) {
+  m.store.Remove(rememberKeyPrefix + selector)
+}
+
+func (m *RememberCache) RemoveUser(userID uuid.UUID) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  for _, selector := range m.userSelectors(userID) {
+    m.store.Remove(rememberKeyPrefix + selector)
+  }
+  m.store.Remove(rememberUserKeyPrefix + userID.String())
+}
+
+func (m *RememberCache) userSelectors(userID uuid.UUID) []string {
+  var selectors []string
+  obj, ok := m.store.Get(rememberUserKeyPrefix + userID.String(), &selectors)
+  if !ok {
+    return []string{}
+  }
+  res := []string{}
+  switch list := obj.(type) {
+    case *[]string:
+      res = append(res, (*list)...)
+    case []string:
+      res = append(res, list...)
+  }
+  // The forgotten and expired tokens are dropped from the list
+  active := res[:0]
+  for _, selector := range res {
+    if m.store.Check(rememberKeyPrefix + selector) {
+      active = append(active, selector)
+    }
+  }
+  return active
+}
+
+////
+// Remember-me in Session
+////
+
+// SetRemember enables remember-me tokens living for expiry
+func (s *Session) SetRemember(store RememberStore, expiry time.Duration) {
+  s.remember = store
+  s.rememberExpiry = expiry
+}
+
+// SetUserReload sets the function which reads the user again before the remember-me login,
+// f.e. Auth.ReloadUser. The error refuses the login and forgets the token.
+// Without it the user saved with the token is logged in unless it is disabled
+func (s *Session) SetUserReload(fn func(ctx context.Context, user *base.User) (*base.User, error)) {
+  s.reloadUser = fn
+}
+
+// HTTPUserLoginRemember logs in the user like HTTPUserLogin and sets
+// the remember-me cookie which logs the user in again when the session is gone
+func (s *Session) HTTPUserLoginRemember(w http.ResponseWriter, sessionToken string, user *base.User) error {
+  if s.remember == nil {
+    return s.HTTPUserLogin(w, sessionToken, user)
+  }
+  selector, err := s.issueRemember(w, user, nil)
+  if err != nil {
+    return err
+  }
+  if _, err = s.userLogin(context.Background(), w, sessionToken, user, selector); err != nil {
+    s.forgetRemember(selector)
+    s.clearRememberCookie(w)
+    return err
+  }
+  return nil
+}
+
+// ForgetUser removes all remember-me tokens of the user,
+// f.e. when the user changes the password
+func (s *Session) ForgetUser(userID uuid.UUID) {
+  if s.remember != nil {
+    s.remember.RemoveUser(userID)
+  }
+}
+
+func hashValidator(validator string) string {
+  h := sha256.Sum256([]byte(validator))
+  return hex.EncodeToString(h[:])
+}
+
+// issueRemember saves a new validator of the rotated token prev, a new token is made when prev is nil.
+// The selector and the expiry stay the same on the rotation, so a reused old validator
+// reveals a stolen cookie and the token can not be prolonged forever
+func (s *Session) issueRemember(w http.ResponseWriter, user *base.User, prev *RememberToken) (string, error) {
+  validator := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+  token := &RememberToken{Hash: hashValidator(validator), User: *user, AuthCode: user.AuthCode}
+  if prev == nil {
+    token.Selector = base64.RawURLEncoding.EncodeToString(randomBytes(12))
+    token.Expires = time.Now().Add(s.rememberExpiry)
+  } else {
+    token.Selector = prev.Selector
+    token.Expires = prev.Expires
+    token.PrevHash = prev.Hash
+    token.Rotated = time.Now()
+  }
+  selector, expires := token.Selector, token.Expires
+  err := s.remember.Save(token)
+  if err != nil {
+    glog.Errorf("ERR: SESSION: REMEMBER: Save: %v", err)
+    return "", err
+  }
+  http.SetCookie(w, &http.Cookie{
+    Name:     rememberCookieName,
+    Value:    selector + ":" + validator,
+    Path:     "/",
+    Expires:  expires,
+    HttpOnly: true,
+    Secure:   s.secure,
+    SameSite: http.SameSiteLaxMode,
+  })
+  return selector, nil
+}
+
+func (s *Session) forgetRemember(selector string) {
+  if s.remember != nil {
+    s.remember.Remove(selector)
+  }
+}
+
+func (s *Session) clearRememberCookie(w http.ResponseWriter) {
+  if s.remember != nil {
+    http.SetCookie(w, &http.Cookie{Name: rememberCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: s.secure})
+  }
+}
+
+func (s *Session) hasRememberCookie(r *http.Request) bool {
+  if s.remember == nil {
+    return false
+  }
+  c, err := r.Cookie(rememberCookieName)
+  return err == nil && c.Value != ""
+}
+
+// httpRemember logs in the session with the remember-me cookie and rotates the token
+func (s *Session) httpRemember(w http.ResponseWriter, r *http.Request, sessionToken string) (string, bool) {
+  c, err := r.Cookie(rememberCookieName)
+  if err != nil || c.Value == "" {
+    return "", false
+  }
+  parts := strings.SplitN(c.Value, ":", 2)
+  if len(parts) != 2 {
+    s.clearRememberCookie(w)
+    return "", false
+  }
+  token, ok := s.remember.Get(parts[0])
+  if !ok || time.Now().After(token.Expires) {
+    if glog.V(2) {
+      glog.Warningf("WRN: SESSION: REMEMBER: Token is not found or expired")
+    }
+    s.forgetRemember(parts[0])
+    s.clearRememberCookie(w)
+    return "", false
+  }
+  hash := hashValidator(parts[1])
+  rotate := true
+  if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) != 1 {
+    if token.PrevHash == "" || time.Now().After(token.Rotated.Add(rememberGrace)) ||
+       subtle.ConstantTimeCompare([]byte(token.PrevHash), []byte(hash)) != 1 {
+      // The selector is known but the validator is not: the token was stolen
+      glog.Warningf("WRN: SESSION: REMEMBER: Bad validator, forget all tokens of user %v", token.User.ID)
+      s.remember.RemoveUser(token.User.ID)
+      s.clearRememberCookie(w)
+      return "", false
+    }
+    // The parallel request with the cookie before the rotation, the new cookie is already sent
+    rotate = false
+  }
+  user := token.User
+  user.AuthCode = token.AuthCode
+  if s.reloadUser != nil {
+    fresh, err := s.reloadUser(r.Context(), &user)
+    if err != nil {
+      glog.Warningf("WRN: SESSION: REMEMBER: User '%s' is refused: %v", user.Login, err)
+      s.forgetRemember(token.Selector)
+      s.clearRememberCookie(w)
+      return "", false
+    }
+    user = *fresh
+  }
+  if user.Disable {
+    glog.Warningf("WRN: SESSION: REMEMBER: User '%s' is disabled", user.Login)
+    s.forgetRemember(token.Selector)
+    s.clearRememberCookie(w)
+    return "", false
+  }
+  selector := token.Selector
+  if rotate {
+    if selector, err = s.issueRemember(w, &user, token); err != nil {
+      return "", false
+    }
+  }
+  newToken, err := s.userLogin(context.Background(), w, sessionToken, &user, selector)
+  if err != nil {
+    s.forgetRemember(selector)
+    s.clearRememberCookie(w)
+    return "", false
+  }
+  if glog.V(2) {
+    glog.Infof("LOG: SESSION: REMEMBER: User '%s' is logged in again", user.Login)
+  }
+  return newToken, true
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "time"
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestRemember(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+  store := NewRememberMemory()
+  s.SetRemember(store, time.Hour)
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  login := func() (*http.Cookie, *http.Cookie) {
+    req, _ := http.NewRequest("GET", "/login", nil)
+    rr := httptest.NewRecorder()
+    token := s.HTTPStart(rr, req)
+    assert.Nil(t, s.HTTPUserLoginRemember(rr, token, &info))
+    return lastCookie(rr, "__session"), lastCookie(rr, "__remember")
+  }
+  // iam returns the user of the request and the new remember-me cookie
+  iam := func(cookies ...*http.Cookie) (*base.User, bool, *http.Cookie) {
+    req, _ := http.NewRequest("GET", "/iam", nil)
+    for _, c := range cookies {
+      req.AddCookie(c)
+    }
+    rr := httptest.NewRecorder()
+    user, ok := s.HTTPUserInfo(rr, req)
+    return user, ok, lastCookie(rr, "__remember")
+  }
+
+  session, remember := login()
+  assert.NotNil(t, remember)
+  assert.Equal(t, true, remember.HttpOnly)
+  assert.NotContains(t, store.tokens[remember.Value[:16]].Hash, remember.Value[17:])
+
+  // The session is alive, the remember-me cookie is not used
+  user, ok, newRemember := iam(session, remember)
+  assert.Equal(t, true, ok)
+  assert.Nil(t, newRemember)
+
+  // The session is gone, the user is logged in again and the token is rotated
+  s.DestroyAll()
+  user, ok, newRemember = iam(session, remember)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+  assert.NotNil(t, newRemember)
+  assert.NotEqual(t, remember.Value, newRemember.Value)
+  assert.Equal(t, 1, len(store.tokens))
+  // The rotation does not prolong the token
+  assert.Equal(t, remember.Expires.Unix(), newRemember.Expires.Unix())
+  assert.Equal(t, remember.Expires.Unix(), store.tokens[newRemember.Value[:16]].Expires.Unix())
+  assert.Equal(t, 1, len(s.ListUserSessions(uid)))
+
+  // Without the session cookie too
+  s.DestroyAll()
+  user, ok, newRemember2 := iam(newRemember)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+
+  // The parallel request with the previous validator is logged in without the rotation
+  s.DestroyAll()
+  user, ok, newRemember3 := iam(newRemember)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+  assert.Nil(t, newRemember3)
+  _, ok, _ = iam(newRemember2)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, 1, len(store.tokens))
+
+  // The old token is reused: all tokens of the user are forgotten
+  s.DestroyAll()
+  _, remember3 := login()
+  assert.Equal(t, 2, len(store.tokens))
+  s.DestroyAll()
+  _, ok, _ = iam(remember)
+  assert.Equal(t, false, ok)
+  _, ok, _ = iam(newRemember2)
+  assert.Equal(t, false, ok)
+  _, ok, _ = iam(remember3)
+  assert.Equal(t, false, ok)
+  assert.Equal(t, 0, len(store.tokens))
+
+  // The previous validator after the grace time
+  _, remember = login()
+  s.DestroyAll()
+  _, ok, newRemember = iam(remember)
+  assert.Equal(t, true, ok)
+  token := store.tokens[newRemember.Value[:16]]
+  token.Rotated = token.Rotated.Add(-rememberGrace - time.Second)
+  store.tokens[newRemember.Value[:16]] = token
+  s.DestroyAll()
+  _, ok, _ = iam(remember)
+  assert.Equal(t, false, ok)
+  assert.Equal(t, 0, len(store.tokens))
+
+  // Logout forgets the token
+  session, remember = login()
+  req, _ := http.NewRequest("GET", "/logout", nil)
+  req.AddCookie(session)
+  rr := httptest.NewRecorder()
+  s.HTTPUserLogout(rr, s.GetToken(rr, req))
+  assert.Equal(t, -1, lastCookie(rr, "__remember").MaxAge)
+  s.DestroyAll()
+  _, ok, _ = iam(remember)
+  assert.Equal(t, false, ok)
+
+  // Password change
+  _, remember = login()
+  s.ForgetUser(uid)
+  s.DestroyAll()
+  _, ok, _ = iam(remember)
+  assert.Equal(t, false, ok)
+
+  s.Close()
+}
+
+func TestRememberReload(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+  s.SetRemember(NewRememberMemory(), time.Hour)
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru", Groups: []string{"staff"}, AuthCode: "ldap"}
+
+  login := func() *http.Cookie {
+    rr := httptest.NewRecorder()
+    user := info
+    assert.Nil(t, s.HTTPUserLoginRemember(rr, "", &user))
+    s.DestroyAll()
+    return lastCookie(rr, "__remember")
+  }
+  iam := func(c *http.Cookie) (*base.User, bool) {
+    req, _ := http.NewRequest("GET", "/iam", nil)
+    req.AddCookie(c)
+    return s.HTTPUserInfo(httptest.NewRecorder(), req)
+  }
+
+  var reloaded []string
+  reloadErr := error(nil)
+  s.SetUserReload(func(ctx context.Context, user *base.User) (*base.User, error) {
+    reloaded = append(reloaded, user.AuthCode + ":" + user.Login)
+    if reloadErr != nil {
+      return nil, reloadErr
+    }
+    res := *user
+    res.Groups = []string{"admins"}
+    return &res, nil
+  })
+
+  // The groups are read again
+  user, ok := iam(login())
+  assert.Equal(t, true, ok)
+  assert.Equal(t, []string{"admins"}, user.Groups)
+  assert.Equal(t, []string{"ldap:Max"}, reloaded)
+
+  // The account is disabled in the provider
+  reloadErr = ErrUserChanged
+  remember := login()
+  _, ok = iam(remember)
+  assert.Equal(t, false, ok)
+  reloadErr = nil
+  _, ok = iam(remember)
+  assert.Equal(t, false, ok)
+
+  // The disabled user is refused without the hook too
+  s.SetUserReload(nil)
+  info.Disable = true
+  _, ok = iam(login())
+  assert.Equal(t, false, ok)
+
+  s.Close()
+}
+
+func TestRememberCache(t *testing.T) {
+  store := NewRememberCache(NewMemoryStore(0))
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  uid2, _ := uuid.Parse("00000002-0003-0004-0005-000000000002")
+  assert.Nil(t, store.Save(&RememberToken{Selector: "a", Hash: "1", User: base.User{ID: uid, Login: "Max"}, AuthCode: "ldap"}))
+  assert.Nil(t, store.Save(&RememberToken{Selector: "a", Hash: "2", User: base.User{ID: uid, Login: "Max"}, AuthCode: "ldap"}))
+  assert.Nil(t, store.Save(&RememberToken{Selector: "b", Hash: "3", User: base.User{ID: uid, Login: "Max"}}))
+  assert.Nil(t, store.Save(&RememberToken{Selector: "c", Hash: "4", User: base.User{ID: uid2, Login: "Alex"}}))
+
+  token, ok := store.Get("a")
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "2", token.Hash)
+  assert.Equal(t, "Max", token.User.Login)
+  assert.Equal(t, "ldap", token.AuthCode)
+  assert.Equal(t, []string{"a", "b"}, store.userSelectors(uid))
+
+  store.Remove("b")
+  assert.Equal(t, []string{"a"}, store.userSelectors(uid))
+  store.RemoveUser(uid)
+  _, ok = store.Get("a")
+  assert.Equal(t, false, ok)
+  _, ok = store.Get("c")
+  assert.Equal(t, true, ok)
+
+  // Two processes with the same cache
+  shared := NewMemoryStore(0)
+  s1 := NewSessions()
+  s1.Init("memory", 10000, "", 0)
+  s1.SetRemember(NewRememberCache(shared), time.Hour)
+  s2 := NewSessions()
+  s2.Init("memory", 10000, "", 0)
+  s2.SetRemember(NewRememberCache(shared), time.Hour)
+
+  rr := httptest.NewRecorder()
+  assert.Nil(t, s1.HTTPUserLoginRemember(rr, "", &base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}))
+  req, _ := http.NewRequest("GET", "/iam", nil)
+  req.AddCookie(lastCookie(rr, "__remember"))
+  user, ok := s2.HTTPUserInfo(httptest.NewRecorder(), req)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+
+  s1.Close()
+  s2.Close()
+}
+
+func TestRememberSecure(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, true, s.InitConfig(&SessionInfo{Mode: "memory", Expiry_time: 100, Remember_expiry_time: 100, Cookie: CookieInfo{Secure: true}}))
+
+  rr := httptest.NewRecorder()
+  req, _ := http.NewRequest("GET", "/login", nil)
+  assert.Nil(t, s.HTTPUserLoginRemember(rr, s.HTTPStart(rr, req), &base.User{Login: "Max", EMail: "max@aaa.ru"}))
+  for _, c := range rr.Result().Cookies() {
+    assert.Equal(t, true, c.Secure, c.Name)
+    assert.Equal(t, true, c.HttpOnly, c.Name)
+  }
+  assert.Equal(t, http.SameSiteLaxMode, lastCookie(rr, "__session").SameSite)
+  assert.NotNil(t, lastCookie(rr, "__remember"))
+
+  s.Close()
+}
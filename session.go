@@ -1,19 +1,37 @@
 package auth
 
 import (
+  "net"
+  "errors"
+  "context"
+  "strings"
+  "strconv"
+  "net/url"
+  "encoding/json"
   "time"
+  "sync"
   "net/http"
   "github.com/golang/glog"
   "github.com/google/uuid"
   
-  "github.com/Lunkov/lib-ref"
   "github.com/Lunkov/lib-cache"
   "github.com/Lunkov/lib-auth/base"
 )
 
+var (
+  ErrSessionNotInit    = errors.New("ERR: SESSION: Not initialized")
+  ErrTooManySessions   = errors.New("ERR: SESSION: Too many sessions of the user")
+  ErrSessionNotFound   = errors.New("ERR: SESSION: Session not found")
+)
+
 type DBInfo struct {
   Url              string  `yaml:"url"`
   Max_connections  int     `yaml:"max_connections"`
+  // The index of the sessions of the users and the remember-me tokens are kept
+  // in other databases than the sessions, so Count and DestroyAll see the sessions only.
+  // The next redis databases after url by default (f.e. redis://host:6379/1 and /2 after /0)
+  Index_url        string  `yaml:"index_url"`
+  Remember_url     string  `yaml:"remember_url"`
 }
 
 type SessionInfo struct {
@@ -21,12 +39,78 @@ type SessionInfo struct {
   Expiry_time  int64          `yaml:"expiry_time"`
   Redis        DBInfo         `yaml:"redis"`
   Aerospike    DBInfo         `yaml:"aerospike"`
+
+  Max_sessions         int     `yaml:"max_sessions"`
+  Max_sessions_policy  string  `yaml:"max_sessions_policy"`
+
+  Cookie       CookieInfo     `yaml:"cookie"`
+
+  Remember_expiry_time  int64  `yaml:"remember_expiry_time"`
+
+  Policy       SessionPolicy  `yaml:"policy"`
+
+  // f.e. ["cookie", "bearer", "header:X-Session-Token", "query:token"]
+  Token_lookup []string       `yaml:"token_lookup"`
+}
+
+// SessionMeta describes the client that owns a session
+type SessionMeta struct {
+  Token         string          `json:"token"`
+  UserID        uuid.UUID       `json:"user_id"`
+  Created       time.Time       `json:"created"`
+  LastSeen      time.Time       `json:"last_seen"`
+  IP            string          `json:"ip"`
+  UserAgent     string          `json:"user_agent"`
+  // The client of the session has changed, see SessionPolicy
+  Suspicious    bool            `json:"suspicious,omitempty"`
 }
 
+// sessionItem is the value stored in the cache under the session token
+type sessionItem struct {
+  User          base.User       `json:"user"`
+  Meta          SessionMeta     `json:"meta"`
+
+  Data          map[string]json.RawMessage      `json:"data,omitempty"`
+  Flash         map[string][]json.RawMessage    `json:"flash,omitempty"`
+
+  // Selector of the remember-me token which logged in the session
+  Remember      string          `json:"remember,omitempty"`
+  // The provider of the user, base.User does not keep it in JSON
+  AuthCode      string          `json:"auth_code,omitempty"`
+}
+
+// LastSeen is written back to the cache not more often than touchInterval
+const touchInterval = time.Minute
+
 type Session struct {
   sessions              cache.ICache
+  // Sessions are kept in the cookies when the mode is "cookie"
+  cookie                *cookieCodec
   expiryTimeDuration    time.Duration
   tokenName             string
+  tokenLookup           []tokenSource
+  // Secure flag of the cookies
+  secure                bool
+
+  // User ID -> session tokens, see session_index.go
+  index                 cache.ICache
+  muIndex               sync.Mutex
+
+  maxSessions           int
+  maxSessionsPolicy     string
+  muLogin               sync.Mutex
+
+  // guards read-modify-write of the session items
+  muItem                sync.Mutex
+
+  remember              RememberStore
+  rememberExpiry        time.Duration
+  reloadUser            func(ctx context.Context, user *base.User) (*base.User, error)
+
+  policy                SessionPolicy
+  onAnomaly             func(a *SessionAnomaly)
+
+  hooks                 sessionHooks
 }
 
 func NewSessions() *Session {
@@ -34,6 +118,9 @@ func NewSessions() *Session {
 }
 
 func (s *Session) HasError() bool {
+  if s.cookie != nil {
+    return false
+  }
   if s.sessions == nil {
     return true
   }
@@ -41,6 +128,9 @@ func (s *Session) HasError() bool {
 }
 
 func (s *Session) Mode() string {
+  if s.cookie != nil {
+    return "cookie"
+  }
   if s.sessions == nil {
     return "undefined"
   }
@@ -58,6 +148,9 @@ func (s *Session) DestroyAll() {
   if s.sessions != nil {
     s.sessions.Clear()
   }
+  if s.index != nil && s.index != s.sessions {
+    s.index.Clear()
+  }
 }
 
 func (s *Session) genToken() string {
@@ -85,37 +178,62 @@ func (s *Session) HTTPStart(w http.ResponseWriter, r *http.Request) string {
   var sessionToken string
 
   reCreate := true
-  cookie, err := r.Cookie(s.tokenName)
-  if glog.V(9) {
-    glog.Infof("LOG: GET COOKIE: '%v' err=%v\n", cookie, err)
-  }
-  if err == nil && cookie.Value != "" {
-    if s.sessions != nil {
-      sessionToken = cookie.Value
-      _, ok := s.sessions.Get(cookie.Value, &base.User{})
+  newToken := true
+  token := s.GetToken(w, r)
+  if token != "" {
+    if s.sessions != nil || s.cookie != nil {
+      _, ok := s.getItem(token)
       if ok {
+        sessionToken = token
         reCreate = false
-      } else {
-        s.sessions.Remove(cookie.Value)
+        newToken = false
+      } else if s.cookie != nil {
+        // Only the authentic cookie has expired, the rest are unknown tokens.
+        // The server sessions are reported by the index, see ListUserSessions
+        if item, ok := s.cookie.expired(token); ok {
+          s.emit(EventSessionExpired, token, item)
+        }
       }
     }
-  } else {
-    if glog.V(2) {
-      glog.Warningf("WRN: TOKEN GET COOKIE(%v): '%v'\n", sessionToken, err)
-    }
+  } else if glog.V(2) {
+    glog.Warningf("WRN: TOKEN GET: '%v' is not found\n", s.tokenName)
+  }
+  if newToken {
+    // The unknown token is never taken as the session ID, it may be fixed by an attacker
     sessionToken = s.genToken()
-    cookie := http.Cookie{Name: s.tokenName, Value: sessionToken, Path: "/", HttpOnly: true}
-    http.SetCookie(w, &cookie)
-    if glog.V(9) {
-      glog.Infof("LOG: SET COOKIE: '%v' cookie=%v\n", sessionToken, cookie)
+    if s.cookie == nil {
+      cookie := http.Cookie{Name: s.tokenName, Value: sessionToken, Path: "/", HttpOnly: true, Secure: s.secure}
+      http.SetCookie(w, &cookie)
+      if glog.V(9) {
+        glog.Infof("LOG: SET COOKIE: '%v' cookie=%v\n", sessionToken, cookie)
+      }
     }
   }
 
-  if reCreate && s.sessions != nil {
+  if reCreate && (s.sessions != nil || s.cookie != nil) {
     if glog.V(9) {
       glog.Infof("LOG: TOKEN SET NEW SESSION: '%v'\n", sessionToken)
     }
-    s.sessions.Set(sessionToken, base.User{TimeLogin: time.Now()})
+    now := time.Now()
+    item := &sessionItem{
+      User: base.User{TimeLogin: now},
+      Meta: SessionMeta{Token: s.sessionID(sessionToken), Created: now, LastSeen: now, IP: s.clientIP(r), UserAgent: r.UserAgent()},
+    }
+    token, err := s.saveItem(sessionToken, item)
+    if err == nil {
+      if s.cookie != nil {
+        sessionToken = token
+        http.SetCookie(w, &http.Cookie{Name: s.tokenName, Value: sessionToken, Path: "/", HttpOnly: true, Secure: s.secure})
+      }
+      s.emit(EventSessionCreated, sessionToken, item)
+    }
+  }
+  if s.remember != nil {
+    if _, ok := s.GetUserInfo(sessionToken); !ok {
+      if token, ok := s.httpRemember(w, r, sessionToken); ok {
+        sessionToken = token
+      }
+    }
   }
   if glog.V(9) {
     glog.Infof("LOG: COOKIE: TOKEN: '%v' = '%v'\n", s.tokenName, sessionToken)
@@ -123,67 +241,253 @@ func (s *Session) HTTPStart(w http.ResponseWriter, r *http.Request) string {
   return sessionToken
 }
 
+// SetSecure sets the Secure flag of the session and remember-me cookies, for the sites on HTTPS
+func (s *Session) SetSecure(secure bool) {
+  s.secure = secure
+}
+
 func (s *Session) SetToken(w http.ResponseWriter, sessionToken string) {
   if glog.V(2) {
     glog.Infof("LOG: COOKIE: SET TOKEN: '%v' = '%v'\n", s.tokenName, sessionToken)
   }
   http.SetCookie(w, &http.Cookie{
-    Name:    s.tokenName,
-    Value:   sessionToken,
-    Path:    "/",
-    Expires: time.Now().Add(s.expiryTimeDuration),
+    Name:     s.tokenName,
+    Value:    sessionToken,
+    Path:     "/",
+    Expires:  time.Now().Add(s.expiryTimeDuration),
+    HttpOnly: true,
+    Secure:   s.secure,
+    SameSite: http.SameSiteLaxMode,
   })
 }
 
+// GetToken returns the session token of the request, the sources set
+// by SetTokenLookup are tried in order (the cookie only by default)
 func (s *Session) GetToken(w http.ResponseWriter, r *http.Request) string {
-  c, err := r.Cookie(s.tokenName)
-  if err != nil {
-    if glog.V(2) {
-      glog.Warningf("WRN: COOKIE: GET TOKEN: '%v' = '%v'\n", s.tokenName, err)
+  lookup := s.tokenLookup
+  if len(lookup) == 0 {
+    lookup = defaultTokenLookup
+  }
+  for _, src := range lookup {
+    if token := src.get(r, s.tokenName); token != "" {
+      if glog.V(2) {
+        glog.Infof("LOG: %s: GET TOKEN: '%v' = '%v'\n", strings.ToUpper(src.kind), s.tokenName, token)
+      }
+      return token
     }
-    return ""
   }
   if glog.V(2) {
-    glog.Infof("LOG: COOKIE: GET TOKEN: '%v' = '%v'\n", s.tokenName, c.Value)
+    glog.Warningf("WRN: GET TOKEN: '%v' is not found\n", s.tokenName)
   }
-  return c.Value
+  return ""
+}
+
+func (s *Session) HTTPUserLogin(w http.ResponseWriter, sessionToken string, user *base.User) error {
+  _, err := s.userLogin(context.Background(), w, sessionToken, user, "")
+  return err
+}
+
+// HTTPUserLoginToken is HTTPUserLogin which returns the new token of the session
+// for the clients without the cookie (bearer, header)
+func (s *Session) HTTPUserLoginToken(w http.ResponseWriter, sessionToken string, user *base.User) (string, error) {
+  return s.userLogin(context.Background(), w, sessionToken, user, "")
 }
 
-func (s *Session) HTTPUserLogin(w http.ResponseWriter, sessionToken string, user *base.User) {
-  user.TimeLogin = time.Now()
+type loginResult struct {
+  token    string
+  item     *sessionItem
+  err      error
+}
+
+// userLogin puts the user into the session and returns the new token of the session.
+// remember is the selector of the remember-me token used by the session.
+// It returns ctx.Err() when ctx ends first, the store is written in the background then:
+// the login decides under mu whether the caller is still waiting, the session is removed if not
+func (s *Session) userLogin(ctx context.Context, w http.ResponseWriter, sessionToken string, user *base.User, remember string) (string, error) {
+  if s.sessions == nil && s.cookie == nil {
+    glog.Errorf("ERR: SESSION: HTTPUserLogin: sessions are not initialized")
+    return "", ErrSessionNotInit
+  }
   if sessionToken == "" {
     sessionToken = s.genToken()
   }
-  if sessionToken != "" {
-    if glog.V(9) {
-      glog.Infof("LOG: SessionHTTPUserLogin: s.sessions.Set: (token=%v) (user=%v) => %v\n", sessionToken, user, s.expiryTimeDuration)
+  login := *user
+  login.TimeLogin = time.Now()
+  if glog.V(9) {
+    glog.Infof("LOG: SessionHTTPUserLogin: s.sessions.Set: (token=%v) (user=%v) => %v\n", sessionToken, login, s.expiryTimeDuration)
+  }
+  var mu sync.Mutex
+  abandoned := false
+  done := make(chan loginResult, 1)
+  go func() {
+    var res loginResult
+    res.token, res.item, res.err = s.storeLogin(ctx, sessionToken, &login, remember)
+    mu.Lock()
+    defer mu.Unlock()
+    if abandoned && res.err == nil {
+      // Nobody gets the token of the session
+      s.remove(res.token)
     }
-    s.sessions.Set(sessionToken, *user)
-    s.SetToken(w, sessionToken)
+    done <- res
+  }()
+  var res loginResult
+  select {
+    case res = <-done:
+    case <-ctx.Done():
+      mu.Lock()
+      select {
+        case res = <-done:
+        default:
+          abandoned = true
+      }
+      mu.Unlock()
+      if abandoned {
+        glog.Errorf("ERR: SESSION: HTTPUserLogin: %v", ctx.Err())
+        return "", ctx.Err()
+      }
+  }
+  if res.err != nil {
+    return "", res.err
+  }
+  user.TimeLogin = login.TimeLogin
+  s.SetToken(w, res.token)
+  s.emit(EventUserLogin, res.token, res.item)
+  return res.token, nil
+}
+
+// storeLogin moves the stored session item to a new token with the user,
+// the token known before the login is removed.
+// Nothing is saved when ctx is done before the store is written
+func (s *Session) storeLogin(ctx context.Context, sessionToken string, user *base.User, remember string) (string, *sessionItem, error) {
+  s.muLogin.Lock()
+  defer s.muLogin.Unlock()
+  if err := ctx.Err(); err != nil {
+    return "", nil, err
+  }
+  if err := s.checkMaxSessions(user.ID, sessionToken); err != nil {
+    return "", nil, err
+  }
+  s.muItem.Lock()
+  defer s.muItem.Unlock()
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    item = &sessionItem{Meta: SessionMeta{Token: s.sessionID(sessionToken), Created: user.TimeLogin}}
+  }
+  s.unindex(item.Meta.UserID, sessionToken)
+  if item.Remember != "" && item.Remember != remember {
+    s.forgetRemember(item.Remember)
+  }
+  item.User = *user
+  item.AuthCode = user.AuthCode
+  item.Remember = remember
+  item.Meta.UserID = user.ID
+  item.Meta.LastSeen = user.TimeLogin
+  item.Meta.Token = s.genToken()
+  if err := ctx.Err(); err != nil {
+    return "", nil, err
+  }
+  newToken, err := s.saveItem(item.Meta.Token, item)
+  if err != nil {
+    return "", nil, err
+  }
+  if s.cookie == nil {
+    s.sessions.Remove(sessionToken)
   }
+  s.addIndex(user.ID, newToken)
+  return newToken, item, nil
 }
 
 func (s *Session) HTTPUserLogout(w http.ResponseWriter, sessionToken string) {
   if sessionToken != "" {
-    s.sessions.Set(sessionToken, base.User{})
-    s.SetToken(w, sessionToken)
+    newToken, user, item, err := s.storeLogout(w, sessionToken)
+    if err != nil {
+      return
+    }
+    s.SetToken(w, newToken)
+    item.User = user
+    s.emit(EventUserLogout, newToken, item)
+  }
+}
+
+// storeLogout removes the user from the stored session item and returns the user
+func (s *Session) storeLogout(w http.ResponseWriter, sessionToken string) (string, base.User, *sessionItem, error) {
+  s.muItem.Lock()
+  defer s.muItem.Unlock()
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    item = &sessionItem{Meta: SessionMeta{Token: s.sessionID(sessionToken), Created: time.Now()}}
+  }
+  user := item.User
+  s.unindex(item.Meta.UserID, sessionToken)
+  if item.Remember != "" {
+    s.forgetRemember(item.Remember)
+    s.clearRememberCookie(w)
+    item.Remember = ""
   }
+  item.User = base.User{}
+  item.AuthCode = ""
+  item.Meta.UserID = uuid.Nil
+  item.Data = nil
+  item.Flash = nil
+  newToken, err := s.saveItem(sessionToken, item)
+  return newToken, user, item, err
 }
 
 func (s *Session) Find(sessionToken string) bool {
+  if s.cookie != nil {
+    _, ok := s.cookie.open(sessionToken)
+    return ok
+  }
+  if s.sessions == nil {
+    return false
+  }
   return s.sessions.Check(sessionToken)
 }
 
 func (s *Session) HTTPCheck(w http.ResponseWriter, r *http.Request) bool {
   sessionToken := s.GetToken(w, r)
   if sessionToken != "" {
-    return s.sessions.Check(sessionToken)
+    return s.Find(sessionToken) && s.checkClient(w, r, sessionToken)
   }
   return false
 }
 
+// HTTPSessionID returns the ID of the session of the request, it does not change
+// during the session life even when the token does (cookie mode)
+func (s *Session) HTTPSessionID(w http.ResponseWriter, r *http.Request) string {
+  sessionToken := s.GetToken(w, r)
+  if s.cookie == nil {
+    if s.Find(sessionToken) {
+      return sessionToken
+    }
+    return ""
+  }
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    return ""
+  }
+  return item.Meta.Token
+}
+
+// sessionID is the ID of a new session with sessionToken
+func (s *Session) sessionID(sessionToken string) string {
+  if s.cookie != nil {
+    return s.genToken()
+  }
+  return sessionToken
+}
+
 func (s *Session) HTTPUserInfo(w http.ResponseWriter, r *http.Request) (*base.User, bool) {
-  return s.GetUserInfo(s.GetToken(w, r))
+  sessionToken := s.GetToken(w, r)
+  user, ok := s.GetUserInfo(sessionToken)
+  if ok && !s.checkClient(w, r, sessionToken) {
+    return nil, false
+  }
+  if !ok && s.hasRememberCookie(r) {
+    // HTTPStart logs in the user with the remember-me cookie
+    user, ok = s.GetUserInfo(s.HTTPStart(w, r))
+  }
+  return user, ok
 }
 
 func (s *Session) GetUserInfo(sessionToken string) (*base.User, bool) {
@@ -191,46 +495,157 @@ func (s *Session) GetUserInfo(sessionToken string) (*base.User, bool) {
     glog.Infof("DBG: START: SessionGetUserInfo: (token = %v, s.sessions.DefaultExpiration = %v)", sessionToken, s.expiryTimeDuration)
   }
   if sessionToken != "" {
-    var u, user base.User
-    u1, ok := s.sessions.Get(sessionToken, &u)
-    if glog.V(9) {
-      glog.Infof("DBG: SessionGetUserInfo: s.sessions.Get: (%v) %v => %v (%s)", sessionToken, ok, u1, ref.GetType(u1))
-    }
+    item, ok := s.getItem(sessionToken)
     if !ok {
       return nil, false
     }
-    ok = false
-    if ref.GetType(u1) == "*User" {
-      u2, ok := (u1).(*base.User)
+    user := item.User
+    user.AuthCode = item.AuthCode
+    // The anonymous session has no user, the user may have no email
+    if user.ID == uuid.Nil {
       if glog.V(9) {
-        glog.Infof("DBG: SessionGetUserInfo: u1.(User): (%v) %v => %v\n", sessionToken, ok, user)
-      }
-      if !ok {
-        return nil, false
-      }
-      user = *u2
-    }
-    if ref.GetType(u1) == "User" {
-      u2, ok := (u1).(base.User)
-      if !ok {
-        if glog.V(9) {
-          glog.Errorf("ERR: SessionGetUserInfo: u1.(User): (%v) %v => %v\n", sessionToken, ok, user)
-        }
-        return nil, false
-      }
-      user = u2
-    }
-    if user.EMail == "" {
-      if glog.V(9) {
-        glog.Warningf("WRN: SessionGetUserInfo: user.EMail == EMPTY: (%v) %v => %v\n", sessionToken, ok, user)
+        glog.Warningf("WRN: SessionGetUserInfo: user.ID == EMPTY: (%v) => %v\n", sessionToken, user)
       }
       return nil, false
     }
+    s.touch(sessionToken, item)
     return &user, true
   }
   return nil, false
 }
 
+// getItem reads the session item, whatever way the cache returns it
+func (s *Session) getItem(sessionToken string) (*sessionItem, bool) {
+  if s.cookie != nil {
+    return s.cookie.open(sessionToken)
+  }
+  if s.sessions == nil || sessionToken == "" {
+    return nil, false
+  }
+  var i sessionItem
+  obj, ok := s.sessions.Get(sessionToken, &i)
+  if !ok {
+    return nil, false
+  }
+  switch item := obj.(type) {
+    case *sessionItem:
+      res := *item
+      return &res, true
+    case sessionItem:
+      return &item, true
+  }
+  if glog.V(9) {
+    glog.Errorf("ERR: SESSION: getItem(%v): unknown type %T", sessionToken, obj)
+  }
+  return nil, false
+}
+
+// touch updates LastSeen of the session
+func (s *Session) touch(sessionToken string, item *sessionItem) {
+  now := time.Now()
+  if now.Sub(item.Meta.LastSeen) < touchInterval {
+    return
+  }
+  err := s.updateItem(sessionToken, func(item *sessionItem) error {
+    item.Meta.LastSeen = now
+    return nil
+  })
+  if err == nil {
+    // The index lives as long as the sessions of the user
+    s.addIndex(item.Meta.UserID, sessionToken)
+  }
+}
+
+// saveItem stores the session item and returns its token.
+// In cookie mode the token is the new value of the cookie
+func (s *Session) saveItem(sessionToken string, item *sessionItem) (string, error) {
+  if s.cookie != nil {
+    return s.cookie.seal(item)
+  }
+  s.sessions.Set(sessionToken, *item)
+  return sessionToken, nil
+}
+
+// updateItem changes the stored session item with fn
+func (s *Session) updateItem(sessionToken string, fn func(item *sessionItem) error) error {
+  if s.cookie != nil {
+    return ErrStatelessSession
+  }
+  if s.sessions == nil {
+    return ErrSessionNotInit
+  }
+  s.muItem.Lock()
+  defer s.muItem.Unlock()
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    return ErrSessionNotFound
+  }
+  if err := fn(item); err != nil {
+    return err
+  }
+  s.sessions.Set(sessionToken, *item)
+  return nil
+}
+
+// httpUpdateItem changes the session of the request with fn,
+// in cookie mode the new cookie is written into w
+func (s *Session) httpUpdateItem(w http.ResponseWriter, r *http.Request, fn func(item *sessionItem) error) error {
+  sessionToken := s.GetToken(w, r)
+  if s.cookie == nil {
+    return s.updateItem(sessionToken, fn)
+  }
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    return ErrSessionNotFound
+  }
+  if err := fn(item); err != nil {
+    return err
+  }
+  sessionToken, err := s.saveItem(sessionToken, item)
+  if err != nil {
+    return err
+  }
+  s.SetToken(w, sessionToken)
+  return nil
+}
+
+// remove deletes the session from the cache and the user index
+// and returns the removed item
+func (s *Session) remove(sessionToken string) (*sessionItem, bool) {
+  if s.cookie != nil {
+    return nil, false
+  }
+  item, ok := s.getItem(sessionToken)
+  if ok {
+    s.unindex(item.Meta.UserID, sessionToken)
+  }
+  s.sessions.Remove(sessionToken)
+  return item, ok
+}
+
+// clientIP is the IP of the client of the request. X-Forwarded-For is read from the right,
+// the client may put anything into the left hops
+func (s *Session) clientIP(r *http.Request) string {
+  ip := r.RemoteAddr
+  if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+    ip = host
+  }
+  if !s.policy.Trust_proxy || (len(s.policy.proxies) > 0 && !s.policy.trustedProxy(ip)) {
+    return ip
+  }
+  hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+  for i := len(hops) - 1; i >= 0; i-- {
+    hop := strings.TrimSpace(hops[i])
+    if hop == "" {
+      continue
+    }
+    ip = hop
+    if !s.policy.trustedProxy(hop) {
+      break
+    }
+  }
+  return ip
+}
 
 ////
 // Init
@@ -239,8 +654,22 @@ func (s *Session) Init(mode string, expiryTime int64, URL string, MaxConnections
   if glog.V(9) {
     glog.Infof("DBG: SESSION: Init")
   }
+  if mode == "cookie" {
+    glog.Errorf("ERR: SESSION: Init(%s): use InitCookie with the keys", mode)
+    return false
+  }
+  s.cookie = nil
+  if mode == "memory" {
+    if !s.InitStore(NewMemoryStore(time.Duration(expiryTime) * time.Second), expiryTime) {
+      return false
+    }
+    // Count is the number of the sessions only
+    s.index = NewMemoryStore(time.Duration(expiryTime) * time.Second)
+    return true
+  }
+  s.Close()
   s.sessions = cache.New(mode, expiryTime, URL, MaxConnections)
-  if s.sessions == nil {
+  if s.sessions == nil || !s.InitIndex(mode, expiryTime, storeURL(mode, URL, indexDBOffset), MaxConnections) {
     glog.Errorf("ERR: SESSION: Init(%s) error", mode)
     return false
   }
@@ -249,9 +678,93 @@ func (s *Session) Init(mode string, expiryTime int64, URL string, MaxConnections
   return !s.sessions.HasError()
 }
 
+// InitIndex keeps the index of the sessions of the users in the store of URL, see DBInfo.Index_url
+func (s *Session) InitIndex(mode string, expiryTime int64, URL string, MaxConnections int) bool {
+  if s.index != nil && s.index != s.sessions {
+    s.index.Close()
+  }
+  s.index = cache.New(mode, expiryTime, URL, MaxConnections)
+  if s.index == nil {
+    glog.Errorf("ERR: SESSION: InitIndex(%s) error", mode)
+    return false
+  }
+  return !s.index.HasError()
+}
+
+// The redis databases of the index and of the remember-me tokens after the one of the sessions
+const (
+  indexDBOffset    = 1
+  rememberDBOffset = 2
+)
+
+// storeURL returns the redis URL of the database offset after the one of URL,
+// the other stores keep the keys of the index and of the remember-me tokens with the sessions
+func storeURL(mode string, URL string, offset int) string {
+  if mode != "redis" {
+    return URL
+  }
+  u, err := url.Parse(URL)
+  if err != nil {
+    return URL
+  }
+  db := 0
+  if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+    if db, err = strconv.Atoi(path); err != nil {
+      glog.Errorf("ERR: SESSION: Bad redis database in '%s'", URL)
+      return URL
+    }
+  }
+  u.Path = "/" + strconv.Itoa(db + offset)
+  return u.String()
+}
+
+func (s *Session) InitConfig(cfg *SessionInfo) bool {
+  db := DBInfo{}
+  switch cfg.Mode {
+    case "redis":
+      db = cfg.Redis
+    case "aerospike":
+      db = cfg.Aerospike
+  }
+  if cfg.Mode == "cookie" {
+    if !s.InitCookie(cfg.Expiry_time, cfg.Cookie.Keys, cfg.Cookie.Max_size) {
+      return false
+    }
+  } else if !s.Init(cfg.Mode, cfg.Expiry_time, db.Url, db.Max_connections) {
+    return false
+  } else if db.Index_url != "" && !s.InitIndex(cfg.Mode, cfg.Expiry_time, db.Index_url, db.Max_connections) {
+    return false
+  }
+  s.SetSecure(cfg.Cookie.Secure)
+  if !s.SetPolicy(&cfg.Policy) {
+    return false
+  }
+  if len(cfg.Token_lookup) > 0 && !s.SetTokenLookup(cfg.Token_lookup...) {
+    return false
+  }
+  if cfg.Remember_expiry_time > 0 {
+    var store RememberStore = NewRememberMemory()
+    if db.Url != "" {
+      // The tokens are shared by the processes with the sessions
+      rememberURL := db.Remember_url
+      if rememberURL == "" {
+        rememberURL = storeURL(cfg.Mode, db.Url, rememberDBOffset)
+      }
+      store = NewRememberCache(cache.New(cfg.Mode, cfg.Remember_expiry_time, rememberURL, db.Max_connections))
+    }
+    s.SetRemember(store, time.Duration(cfg.Remember_expiry_time) * time.Second)
+  }
+  return s.SetMaxSessions(cfg.Max_sessions, cfg.Max_sessions_policy)
+}
+
 func (s *Session) Close() {
+  if s.index != nil && s.index != s.sessions {
+    s.index.Close()
+  }
+  s.index = nil
   if s.sessions != nil {
     s.sessions.Close()
     s.sessions = nil
   }
+  s.cookie = nil
 }
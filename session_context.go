@@ -0,0 +1,41 @@
+package auth
+
+import (
+  "context"
+  "net/http"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+////
+// Session operations which return when ctx is done.
+// A slow store (redis, aerospike) can not block the handler beyond its deadline
+////
+
+func (s *Session) FindContext(ctx context.Context, sessionToken string) bool {
+  ok := false
+  if err := base.RunContext(ctx, func() { ok = s.Find(sessionToken) }); err != nil {
+    glog.Errorf("ERR: SESSION: Find: %v", err)
+    return false
+  }
+  return ok
+}
+
+func (s *Session) GetUserInfoContext(ctx context.Context, sessionToken string) (*base.User, bool) {
+  var user *base.User
+  ok := false
+  if err := base.RunContext(ctx, func() { user, ok = s.GetUserInfo(sessionToken) }); err != nil {
+    glog.Errorf("ERR: SESSION: GetUserInfo: %v", err)
+    return nil, false
+  }
+  return user, ok
+}
+
+// HTTPUserLoginContext is HTTPUserLogin which returns ctx.Err() when ctx ends first.
+// The cancellation stops the wait only: the login which is already running in the background
+// is not saved when ctx is done before the write, and the saved session is removed after it
+func (s *Session) HTTPUserLoginContext(ctx context.Context, w http.ResponseWriter, sessionToken string, user *base.User) error {
+  _, err := s.userLogin(ctx, w, sessionToken, user, "")
+  return err
+}
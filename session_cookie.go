@@ -0,0 +1,159 @@
+package auth
+
+import (
+  "io"
+  "time"
+  "errors"
+  "crypto/aes"
+  "crypto/rand"
+  "crypto/cipher"
+  "crypto/sha256"
+  "encoding/json"
+  "encoding/base64"
+  "github.com/golang/glog"
+)
+
+// Browsers keep at least 4096 bytes per cookie including its name and attributes
+const defaultCookieMaxSize = 4000
+
+var (
+  ErrCookieTooLarge    = errors.New("ERR: SESSION: Session does not fit into the cookie")
+  ErrStatelessSession  = errors.New("ERR: SESSION: Operation needs the HTTP request in cookie mode")
+)
+
+type CookieInfo struct {
+  // The first key encrypts new cookies, the rest only decrypt old ones
+  Keys       []string       `yaml:"keys"`
+  Max_size     int          `yaml:"max_size"`
+  // The session and remember-me cookies are sent over HTTPS only
+  Secure       bool         `yaml:"secure"`
+}
+
+// cookieEnvelope is sealed inside the session cookie
+type cookieEnvelope struct {
+  Issued     int64          `json:"iat"`
+  Item       sessionItem    `json:"item"`
+}
+
+// cookieCodec encrypts and authenticates the sessions with AES-256-GCM
+type cookieCodec struct {
+  aeads      []cipher.AEAD
+  maxSize    int
+  expiry     time.Duration
+  name       string
+}
+
+func newCookieCodec(name string, keys []string, maxSize int, expiry time.Duration) (*cookieCodec, error) {
+  if len(keys) == 0 {
+    return nil, errors.New("ERR: SESSION: COOKIE: Keys are not defined")
+  }
+  if maxSize <= 0 {
+    maxSize = defaultCookieMaxSize
+  }
+  c := &cookieCodec{maxSize: maxSize, expiry: expiry, name: name}
+  for _, key := range keys {
+    if len(key) < 32 {
+      return nil, errors.New("ERR: SESSION: COOKIE: Key is shorter than 32 symbols")
+    }
+    hash := sha256.Sum256([]byte(key))
+    block, err := aes.NewCipher(hash[:])
+    if err != nil {
+      return nil, err
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+      return nil, err
+    }
+    c.aeads = append(c.aeads, aead)
+  }
+  return c, nil
+}
+
+func (c *cookieCodec) seal(item *sessionItem) (string, error) {
+  plain, err := json.Marshal(cookieEnvelope{Issued: time.Now().Unix(), Item: *item})
+  if err != nil {
+    return "", err
+  }
+  aead := c.aeads[0]
+  nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(plain) + aead.Overhead())
+  if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+    return "", err
+  }
+  res := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(c.name)))
+  if len(res) + len(c.name) + 1 > c.maxSize {
+    glog.Errorf("ERR: SESSION: COOKIE: Size %d is more than %d", len(res), c.maxSize)
+    return "", ErrCookieTooLarge
+  }
+  return res, nil
+}
+
+func (c *cookieCodec) open(value string) (*sessionItem, bool) {
+  env, ok := c.openEnvelope(value)
+  if !ok {
+    return nil, false
+  }
+  if c.isExpired(env) {
+    if glog.V(9) {
+      glog.Infof("DBG: SESSION: COOKIE: Expired (issued=%v)", time.Unix(env.Issued, 0))
+    }
+    return nil, false
+  }
+  return &env.Item, true
+}
+
+// expired returns the session of the authentic cookie which has expired
+func (c *cookieCodec) expired(value string) (*sessionItem, bool) {
+  env, ok := c.openEnvelope(value)
+  if !ok || !c.isExpired(env) {
+    return nil, false
+  }
+  return &env.Item, true
+}
+
+func (c *cookieCodec) isExpired(env *cookieEnvelope) bool {
+  return c.expiry > 0 && time.Now().After(time.Unix(env.Issued, 0).Add(c.expiry))
+}
+
+// openEnvelope decrypts the cookie without the check of the expiry
+func (c *cookieCodec) openEnvelope(value string) (*cookieEnvelope, bool) {
+  if value == "" || len(value) + len(c.name) + 1 > c.maxSize {
+    return nil, false
+  }
+  buf, err := base64.RawURLEncoding.DecodeString(value)
+  if err != nil {
+    return nil, false
+  }
+  for _, aead := range c.aeads {
+    if len(buf) < aead.NonceSize() {
+      return nil, false
+    }
+    plain, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(c.name))
+    if err != nil {
+      continue
+    }
+    var env cookieEnvelope
+    if err = json.Unmarshal(plain, &env); err != nil {
+      glog.Errorf("ERR: SESSION: COOKIE: JSON: %v", err)
+      return nil, false
+    }
+    return &env, true
+  }
+  if glog.V(2) {
+    glog.Warningf("WRN: SESSION: COOKIE: Can`t decrypt the session")
+  }
+  return nil, false
+}
+
+// InitCookie keeps the sessions encrypted in the cookies instead of the cache
+func (s *Session) InitCookie(expiryTime int64, keys []string, maxSize int) bool {
+  s.Close()
+  s.expiryTimeDuration = time.Duration(expiryTime) * time.Second
+  c, err := newCookieCodec(s.tokenName, keys, maxSize, s.expiryTimeDuration)
+  if err != nil {
+    glog.Errorf("ERR: SESSION: Init(cookie): %v", err)
+    return false
+  }
+  s.cookie = c
+  glog.Infof("LOG: SESSION: Mode is cookie")
+  return true
+}
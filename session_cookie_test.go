@@ -0,0 +1,149 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "strings"
+  "time"
+  "net/http"
+  "net/http/httptest"
+  "encoding/json"
+  "encoding/base64"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const testCookieKey1 = "mkdvrmiot5e8945er89345tmiwr8345rej34n7w46s"
+const testCookieKey2 = "0987654321qwertyuiopasdfghjklzxcvbnm123456"
+
+func lastCookie(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+  var res *http.Cookie
+  for _, c := range rr.Result().Cookies() {
+    if c.Name == name {
+      res = c
+    }
+  }
+  return res
+}
+
+func TestSessionCookieInit(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, false, s.Init("cookie", 100, "", 0))
+  assert.Equal(t, false, s.InitCookie(100, []string{}, 0))
+  assert.Equal(t, false, s.InitCookie(100, []string{"short"}, 0))
+  assert.Equal(t, true, s.InitConfig(&SessionInfo{Mode: "cookie", Expiry_time: 100, Cookie: CookieInfo{Keys: []string{testCookieKey1}}}))
+  assert.Equal(t, false, s.HasError())
+  assert.Equal(t, "cookie", s.Mode())
+  assert.Equal(t, false, s.SetMaxSessions(1, SessionLimitReject))
+  s.Close()
+}
+
+func TestSessionCookie(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, true, s.InitCookie(1000, []string{testCookieKey1}, 0))
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  req, _ := http.NewRequest("GET", "/api/v1/iam", nil)
+  rr := httptest.NewRecorder()
+  token := s.HTTPStart(rr, req)
+  assert.NotEqual(t, "", token)
+  assert.Equal(t, 1, len(rr.Result().Cookies()))
+  cookie := lastCookie(rr, "__session")
+  assert.Equal(t, token, cookie.Value)
+  assert.Equal(t, true, s.Find(token))
+
+  // The session is not logged in yet
+  req, _ = http.NewRequest("GET", "/api/v1/iam", nil)
+  req.AddCookie(cookie)
+  user, ok := s.HTTPUserInfo(httptest.NewRecorder(), req)
+  assert.Equal(t, false, ok)
+  assert.Nil(t, user)
+
+  // HTTPStart keeps the valid cookie
+  rr = httptest.NewRecorder()
+  assert.Equal(t, token, s.HTTPStart(rr, req))
+  assert.Equal(t, 0, len(rr.Result().Cookies()))
+
+  // The token API can`t write in cookie mode
+  assert.Equal(t, ErrStatelessSession, s.SetData(token, "cart", "1"))
+
+  rr = httptest.NewRecorder()
+  assert.Nil(t, s.HTTPSetData(rr, req, "cart", "cart-1"))
+  cookie = lastCookie(rr, "__session")
+
+  rr = httptest.NewRecorder()
+  assert.Nil(t, s.HTTPUserLogin(rr, cookie.Value, &info))
+  cookie = lastCookie(rr, "__session")
+
+  req, _ = http.NewRequest("GET", "/api/v1/iam", nil)
+  req.AddCookie(cookie)
+  user, ok = s.HTTPUserInfo(httptest.NewRecorder(), req)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+  var cart string
+  assert.Equal(t, true, s.HTTPGetData(httptest.NewRecorder(), req, "cart", &cart))
+  assert.Equal(t, "cart-1", cart)
+  assert.Equal(t, 0, len(s.ListUserSessions(uid)))
+
+  // Tampered cookie
+  buf, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+  buf[len(buf) - 1] ^= 1
+  _, ok = s.GetUserInfo(base64.RawURLEncoding.EncodeToString(buf))
+  assert.Equal(t, false, ok)
+
+  // Too big session
+  rr = httptest.NewRecorder()
+  assert.Equal(t, ErrCookieTooLarge, s.HTTPSetData(rr, req, "big", strings.Repeat("x", 5000)))
+  assert.Nil(t, lastCookie(rr, "__session"))
+
+  // Key rotation: old cookies are still valid with the old key in the list
+  assert.Equal(t, true, s.InitCookie(1000, []string{testCookieKey2, testCookieKey1}, 0))
+  user, ok = s.GetUserInfo(cookie.Value)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+  assert.Equal(t, true, s.InitCookie(1000, []string{testCookieKey2}, 0))
+  _, ok = s.GetUserInfo(cookie.Value)
+  assert.Equal(t, false, ok)
+
+  // Logout
+  rr = httptest.NewRecorder()
+  s.HTTPUserLogout(rr, cookie.Value)
+  cookie = lastCookie(rr, "__session")
+  _, ok = s.GetUserInfo(cookie.Value)
+  assert.Equal(t, false, ok)
+  assert.Equal(t, true, s.Find(cookie.Value))
+
+  s.Close()
+}
+
+func TestSessionCookieExpired(t *testing.T) {
+  c, err := newCookieCodec("__session", []string{testCookieKey1}, 0, 10 * time.Second)
+  assert.Nil(t, err)
+
+  item := &sessionItem{User: base.User{Login: "Max", EMail: "max@aaa.ru"}}
+  token, err := c.seal(item)
+  assert.Nil(t, err)
+  _, ok := c.open(token)
+  assert.Equal(t, true, ok)
+
+  plain, _ := json.Marshal(cookieEnvelope{Issued: time.Now().Add(-time.Minute).Unix(), Item: *item})
+  nonce := make([]byte, c.aeads[0].NonceSize())
+  token = base64.RawURLEncoding.EncodeToString(c.aeads[0].Seal(nonce, nonce, plain, []byte("__session")))
+  _, ok = c.open(token)
+  assert.Equal(t, false, ok)
+  expired, ok := c.expired(token)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", expired.User.Login)
+
+  // Cookie sealed for another name
+  c2, _ := newCookieCodec("__other", []string{testCookieKey1}, 0, 10 * time.Second)
+  token, _ = c2.seal(item)
+  _, ok = c.open(token)
+  assert.Equal(t, false, ok)
+  _, ok = c.expired(token)
+  assert.Equal(t, false, ok)
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+  "errors"
+  "net/http"
+  "encoding/json"
+  "github.com/golang/glog"
+)
+
+////
+// Session data: values stored with the session next to the user.
+// Values are kept as JSON, so they come back the same way
+// from the memory caches, redis, aerospike or the session cookie
+////
+
+// errNoFlash stops updateItem when there is nothing to consume
+var errNoFlash = errors.New("no flash")
+
+func (item *sessionItem) setData(key string, buf json.RawMessage) {
+  data := make(map[string]json.RawMessage, len(item.Data) + 1)
+  for k, v := range item.Data {
+    data[k] = v
+  }
+  data[key] = buf
+  item.Data = data
+}
+
+func (item *sessionItem) getData(key string, value interface{}) bool {
+  buf, ok := item.Data[key]
+  if !ok {
+    return false
+  }
+  if err := json.Unmarshal(buf, value); err != nil {
+    glog.Errorf("ERR: SESSION: GetData(%s): JSON: %v", key, err)
+    return false
+  }
+  return true
+}
+
+func (item *sessionItem) deleteData(key string) {
+  if _, ok := item.Data[key]; !ok {
+    return
+  }
+  data := make(map[string]json.RawMessage, len(item.Data))
+  for k, v := range item.Data {
+    if k != key {
+      data[k] = v
+    }
+  }
+  item.Data = data
+}
+
+func (item *sessionItem) addFlash(key string, buf json.RawMessage) {
+  flash := make(map[string][]json.RawMessage, len(item.Flash) + 1)
+  for k, v := range item.Flash {
+    flash[k] = v
+  }
+  values := make([]json.RawMessage, 0, len(flash[key]) + 1)
+  values = append(values, flash[key]...)
+  flash[key] = append(values, buf)
+  item.Flash = flash
+}
+
+func (item *sessionItem) takeFlashes(key string) []json.RawMessage {
+  res := item.Flash[key]
+  if len(res) == 0 {
+    return nil
+  }
+  flash := make(map[string][]json.RawMessage, len(item.Flash))
+  for k, v := range item.Flash {
+    if k != key {
+      flash[k] = v
+    }
+  }
+  item.Flash = flash
+  return res
+}
+
+func marshalData(fn string, key string, value interface{}) (json.RawMessage, error) {
+  buf, err := json.Marshal(value)
+  if err != nil {
+    glog.Errorf("ERR: SESSION: %s(%s): JSON: %v", fn, key, err)
+  }
+  return buf, err
+}
+
+func unmarshalFlashes(key string, found []json.RawMessage, values interface{}) bool {
+  buf, err := json.Marshal(found)
+  if err == nil {
+    err = json.Unmarshal(buf, values)
+  }
+  if err != nil {
+    glog.Errorf("ERR: SESSION: GetFlashes(%s): JSON: %v", key, err)
+    return false
+  }
+  return true
+}
+
+// SetData stores value under key in the session
+func (s *Session) SetData(sessionToken string, key string, value interface{}) error {
+  buf, err := marshalData("SetData", key, value)
+  if err != nil {
+    return err
+  }
+  return s.updateItem(sessionToken, func(item *sessionItem) error {
+    item.setData(key, buf)
+    return nil
+  })
+}
+
+// GetData reads the value stored under key into value (a pointer)
+func (s *Session) GetData(sessionToken string, key string, value interface{}) bool {
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    return false
+  }
+  return item.getData(key, value)
+}
+
+func (s *Session) HasData(sessionToken string, key string) bool {
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    return false
+  }
+  _, ok = item.Data[key]
+  return ok
+}
+
+func (s *Session) DeleteData(sessionToken string, key string) error {
+  return s.updateItem(sessionToken, func(item *sessionItem) error {
+    item.deleteData(key)
+    return nil
+  })
+}
+
+// AddFlash appends value to the flash messages under key.
+// Flash messages are removed from the session when they are read
+func (s *Session) AddFlash(sessionToken string, key string, value interface{}) error {
+  buf, err := marshalData("AddFlash", key, value)
+  if err != nil {
+    return err
+  }
+  return s.updateItem(sessionToken, func(item *sessionItem) error {
+    item.addFlash(key, buf)
+    return nil
+  })
+}
+
+// GetFlashes consumes the flash messages under key into values (a pointer to a slice)
+func (s *Session) GetFlashes(sessionToken string, key string, values interface{}) bool {
+  var found []json.RawMessage
+  err := s.updateItem(sessionToken, func(item *sessionItem) error {
+    found = item.takeFlashes(key)
+    if found == nil {
+      return errNoFlash
+    }
+    return nil
+  })
+  if err != nil {
+    return false
+  }
+  return unmarshalFlashes(key, found, values)
+}
+
+////
+// The same for the session of the request, they work in all modes
+////
+func (s *Session) HTTPSetData(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+  buf, err := marshalData("SetData", key, value)
+  if err != nil {
+    return err
+  }
+  return s.httpUpdateItem(w, r, func(item *sessionItem) error {
+    item.setData(key, buf)
+    return nil
+  })
+}
+
+func (s *Session) HTTPGetData(w http.ResponseWriter, r *http.Request, key string, value interface{}) bool {
+  return s.GetData(s.GetToken(w, r), key, value)
+}
+
+func (s *Session) HTTPDeleteData(w http.ResponseWriter, r *http.Request, key string) error {
+  return s.httpUpdateItem(w, r, func(item *sessionItem) error {
+    item.deleteData(key)
+    return nil
+  })
+}
+
+func (s *Session) HTTPAddFlash(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+  buf, err := marshalData("AddFlash", key, value)
+  if err != nil {
+    return err
+  }
+  return s.httpUpdateItem(w, r, func(item *sessionItem) error {
+    item.addFlash(key, buf)
+    return nil
+  })
+}
+
+func (s *Session) HTTPGetFlashes(w http.ResponseWriter, r *http.Request, key string, values interface{}) bool {
+  var found []json.RawMessage
+  err := s.httpUpdateItem(w, r, func(item *sessionItem) error {
+    found = item.takeFlashes(key)
+    if found == nil {
+      return errNoFlash
+    }
+    return nil
+  })
+  if err != nil {
+    return false
+  }
+  return unmarshalFlashes(key, found, values)
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+type testCart struct {
+  ID      string    `json:"id"`
+  Items   []int     `json:"items"`
+}
+
+func TestSessionData(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+
+  assert.Equal(t, ErrSessionNotFound, s.SetData("unknown", "cart", 1))
+
+  req, _ := http.NewRequest("GET", "/api/v1/cart", nil)
+  token := s.HTTPStart(httptest.NewRecorder(), req)
+
+  // Anonymous session can hold data
+  cart := testCart{ID: "cart-1", Items: []int{1, 2, 3}}
+  assert.Nil(t, s.SetData(token, "cart", cart))
+  assert.Nil(t, s.SetData(token, "csrf", "secret"))
+  assert.Equal(t, true, s.HasData(token, "cart"))
+
+  var cart2 testCart
+  assert.Equal(t, true, s.GetData(token, "cart", &cart2))
+  assert.Equal(t, cart, cart2)
+
+  var csrf string
+  assert.Equal(t, true, s.GetData(token, "csrf", &csrf))
+  assert.Equal(t, "secret", csrf)
+  assert.Equal(t, false, s.GetData(token, "csrf", &cart2))
+  assert.Equal(t, false, s.GetData(token, "unknown", &csrf))
+
+  assert.Nil(t, s.DeleteData(token, "csrf"))
+  assert.Equal(t, false, s.HasData(token, "csrf"))
+  assert.Equal(t, true, s.HasData(token, "cart"))
+
+  // The anonymous session has no user
+  user, ok := s.GetUserInfo(token)
+  assert.Equal(t, false, ok)
+  assert.Nil(t, user)
+
+  // Data survives the login, the user may have no email
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max"}
+  oldToken := token
+  token, err := s.HTTPUserLoginToken(httptest.NewRecorder(), token, &info)
+  assert.Nil(t, err)
+  // The token is new after the login
+  assert.NotEqual(t, oldToken, token)
+  assert.Equal(t, false, s.HasData(oldToken, "cart"))
+  assert.Equal(t, true, s.GetData(token, "cart", &cart2))
+  user, ok = s.GetUserInfo(token)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+
+  // Flash messages are consumed on read
+  assert.Nil(t, s.AddFlash(token, "info", "Saved"))
+  assert.Nil(t, s.AddFlash(token, "info", "Sent"))
+  assert.Nil(t, s.AddFlash(token, "error", "Failed"))
+  var msgs []string
+  assert.Equal(t, true, s.GetFlashes(token, "info", &msgs))
+  assert.Equal(t, []string{"Saved", "Sent"}, msgs)
+  assert.Equal(t, false, s.GetFlashes(token, "info", &msgs))
+  assert.Equal(t, true, s.GetFlashes(token, "error", &msgs))
+  assert.Equal(t, []string{"Failed"}, msgs)
+
+  // Logout clears the data
+  s.HTTPUserLogout(httptest.NewRecorder(), token)
+  assert.Equal(t, false, s.HasData(token, "cart"))
+
+  s.Close()
+}
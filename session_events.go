@@ -0,0 +1,96 @@
+package auth
+
+import (
+  "sync"
+  "time"
+  "crypto/sha256"
+  "encoding/hex"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const (
+  EventSessionCreated = "session_created"
+  EventUserLogin      = "user_login"
+  EventUserLogout     = "user_logout"
+  // The expired server session is found by the index of the user,
+  // the expired cookie session is found when it comes back
+  EventSessionExpired = "session_expired"
+  EventSessionEvicted = "session_evicted"
+  EventSessionRevoked = "session_revoked"
+)
+
+// SessionEvent never has the session token itself, only its hash
+type SessionEvent struct {
+  Type          string
+  TokenHash     string
+  User          base.User
+  Meta          SessionMeta
+  Time          time.Time
+}
+
+type sessionHook struct {
+  fn            func(e *SessionEvent)
+  async         bool
+  types         map[string]bool
+}
+
+type sessionHooks struct {
+  list          []sessionHook
+  mu            sync.RWMutex
+}
+
+// Subscribe calls fn in the goroutine of the event for the events of types (all when empty).
+// fn must not log in or log out the users of the Session
+func (s *Session) Subscribe(fn func(e *SessionEvent), types ...string) {
+  s.subscribe(fn, false, types)
+}
+
+// SubscribeAsync calls fn in a new goroutine for the events of types (all when empty)
+func (s *Session) SubscribeAsync(fn func(e *SessionEvent), types ...string) {
+  s.subscribe(fn, true, types)
+}
+
+func (s *Session) subscribe(fn func(e *SessionEvent), async bool, types []string) {
+  h := sessionHook{fn: fn, async: async}
+  if len(types) > 0 {
+    h.types = make(map[string]bool)
+    for _, t := range types {
+      h.types[t] = true
+    }
+  }
+  s.hooks.mu.Lock()
+  s.hooks.list = append(s.hooks.list, h)
+  s.hooks.mu.Unlock()
+}
+
+func hashToken(token string) string {
+  h := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(h[:])
+}
+
+func (s *Session) emit(eventType string, sessionToken string, item *sessionItem) {
+  s.hooks.mu.RLock()
+  hooks := s.hooks.list
+  s.hooks.mu.RUnlock()
+  if len(hooks) == 0 {
+    return
+  }
+  id := item.Meta.Token
+  if id == "" {
+    id = sessionToken
+  }
+  meta := item.Meta
+  meta.Token = ""
+  for _, h := range hooks {
+    if h.types != nil && !h.types[eventType] {
+      continue
+    }
+    e := &SessionEvent{Type: eventType, TokenHash: hashToken(id), User: item.User, Meta: meta, Time: time.Now()}
+    if h.async {
+      go h.fn(e)
+    } else {
+      h.fn(e)
+    }
+  }
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "sync"
+  "time"
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestSessionEvents(t *testing.T) {
+  s := NewSessions()
+  s.Init("memory", 10000, "", 0)
+
+  var events []*SessionEvent
+  s.Subscribe(func(e *SessionEvent) {
+    events = append(events, e)
+  })
+  var logins []*SessionEvent
+  s.Subscribe(func(e *SessionEvent) {
+    logins = append(logins, e)
+  }, EventUserLogin)
+  var wg sync.WaitGroup
+  var async []string
+  var mu sync.Mutex
+  s.SubscribeAsync(func(e *SessionEvent) {
+    mu.Lock()
+    async = append(async, e.Type)
+    mu.Unlock()
+    wg.Done()
+  }, EventUserLogout)
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  req, _ := http.NewRequest("GET", "/login", nil)
+  req.RemoteAddr = "10.0.0.1:3456"
+  rr := httptest.NewRecorder()
+  token := s.HTTPStart(rr, req)
+  assert.Equal(t, 1, len(events))
+  assert.Equal(t, EventSessionCreated, events[0].Type)
+  assert.Equal(t, hashToken(token), events[0].TokenHash)
+  assert.Equal(t, "10.0.0.1", events[0].Meta.IP)
+  assert.Equal(t, "", events[0].Meta.Token)
+
+  token, err := s.HTTPUserLoginToken(rr, token, &info)
+  assert.Nil(t, err)
+  assert.Equal(t, 2, len(events))
+  assert.Equal(t, EventUserLogin, events[1].Type)
+  assert.Equal(t, "Max", events[1].User.Login)
+  assert.Equal(t, 1, len(logins))
+
+  wg.Add(1)
+  s.HTTPUserLogout(rr, token)
+  wg.Wait()
+  assert.Equal(t, EventUserLogout, events[2].Type)
+  assert.Equal(t, "Max", events[2].User.Login)
+  assert.Equal(t, []string{EventUserLogout}, async)
+
+  // Evicted
+  s.SetMaxSessions(1, SessionLimitEvictOldest)
+  token1, err := s.HTTPUserLoginToken(httptest.NewRecorder(), "token1", &info)
+  assert.Nil(t, err)
+  token2, err := s.HTTPUserLoginToken(httptest.NewRecorder(), "token2", &info)
+  assert.Nil(t, err)
+  assert.Equal(t, EventSessionEvicted, events[4].Type)
+  assert.Equal(t, hashToken(token1), events[4].TokenHash)
+  assert.Equal(t, EventUserLogin, events[5].Type)
+
+  // Revoked
+  assert.Equal(t, 1, s.RevokeUserSessions(uid, ""))
+  assert.Equal(t, EventSessionRevoked, events[6].Type)
+  assert.Equal(t, hashToken(token2), events[6].TokenHash)
+  assert.Equal(t, "Max", events[6].User.Login)
+
+  // Expired
+  token3, err := s.HTTPUserLoginToken(httptest.NewRecorder(), "token3", &info)
+  assert.Nil(t, err)
+  store, _ := s.MemoryStore()
+  store.Remove(token3)
+  s.ListUserSessions(uid)
+  assert.Equal(t, EventSessionExpired, events[8].Type)
+  assert.Equal(t, uid, events[8].User.ID)
+
+  // The unknown token has not expired
+  req, _ = http.NewRequest("GET", "/iam", nil)
+  req.AddCookie(&http.Cookie{Name: "__session", Value: "token4"})
+  s.HTTPStart(httptest.NewRecorder(), req)
+  assert.Equal(t, EventSessionCreated, events[9].Type)
+  assert.Equal(t, 10, len(events))
+  assert.Equal(t, 4, len(logins))
+
+  s.Close()
+}
+
+func TestSessionEventsCookie(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, true, s.InitCookie(1, []string{testCookieKey1}, 0))
+
+  var events []*SessionEvent
+  s.Subscribe(func(e *SessionEvent) {
+    events = append(events, e)
+  }, EventUserLogin, EventSessionExpired)
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+  token, err := s.HTTPUserLoginToken(httptest.NewRecorder(), "", &info)
+  assert.Nil(t, err)
+  assert.Equal(t, 1, len(events))
+
+  // Forged cookie
+  req, _ := http.NewRequest("GET", "/iam", nil)
+  req.AddCookie(&http.Cookie{Name: "__session", Value: "token4"})
+  s.HTTPStart(httptest.NewRecorder(), req)
+  assert.Equal(t, 1, len(events))
+
+  time.Sleep(2100 * time.Millisecond)
+  req, _ = http.NewRequest("GET", "/iam", nil)
+  req.AddCookie(&http.Cookie{Name: "__session", Value: token})
+  s.HTTPStart(httptest.NewRecorder(), req)
+  assert.Equal(t, 2, len(events))
+  assert.Equal(t, EventSessionExpired, events[1].Type)
+  // The same session ID as at the login
+  assert.Equal(t, events[0].TokenHash, events[1].TokenHash)
+  assert.Equal(t, "Max", events[1].User.Login)
+}
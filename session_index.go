@@ -0,0 +1,136 @@
+package auth
+
+import (
+  "sort"
+  "github.com/golang/glog"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+// The key of the session tokens of the user in the index store
+const indexKeyPrefix = "__user_sessions:"
+
+////
+// User ID -> Session tokens index.
+// The index is kept in the store (see Init, InitIndex and InitStore), so all processes with
+// the same redis or aerospike see the sessions of the user. The update of the index
+// is not atomic between the processes: a token added by two processes at the same time
+// may be lost from the index, the session itself stays valid
+////
+func indexKey(userID uuid.UUID) string {
+  return indexKeyPrefix + userID.String()
+}
+
+func (s *Session) addIndex(userID uuid.UUID, sessionToken string) {
+  // The cookies are not known on the server in cookie mode
+  if userID == uuid.Nil || sessionToken == "" || s.index == nil {
+    return
+  }
+  s.muIndex.Lock()
+  defer s.muIndex.Unlock()
+  tokens := s.userTokens(userID)
+  for _, token := range tokens {
+    if token == sessionToken {
+      // Set refreshes the expiry of the index
+      s.index.Set(indexKey(userID), tokens)
+      return
+    }
+  }
+  s.index.Set(indexKey(userID), append(tokens, sessionToken))
+}
+
+func (s *Session) unindex(userID uuid.UUID, sessionToken string) {
+  if userID == uuid.Nil || s.index == nil {
+    return
+  }
+  s.muIndex.Lock()
+  defer s.muIndex.Unlock()
+  tokens := s.userTokens(userID)
+  res := make([]string, 0, len(tokens))
+  for _, token := range tokens {
+    if token != sessionToken {
+      res = append(res, token)
+    }
+  }
+  if len(res) == len(tokens) {
+    return
+  }
+  if len(res) == 0 {
+    s.index.Remove(indexKey(userID))
+  } else {
+    s.index.Set(indexKey(userID), res)
+  }
+}
+
+// userTokens reads the tokens of the user from the index store
+func (s *Session) userTokens(userID uuid.UUID) []string {
+  if s.index == nil {
+    return []string{}
+  }
+  var tokens []string
+  obj, ok := s.index.Get(indexKey(userID), &tokens)
+  if !ok {
+    return []string{}
+  }
+  switch list := obj.(type) {
+    case *[]string:
+      return append([]string{}, (*list)...)
+    case []string:
+      return append([]string{}, list...)
+  }
+  if glog.V(9) {
+    glog.Errorf("ERR: SESSION: INDEX: userTokens(%v): unknown type %T", userID, obj)
+  }
+  return []string{}
+}
+
+// ListUserSessions returns the active sessions of the user, oldest first
+func (s *Session) ListUserSessions(userID uuid.UUID) []SessionMeta {
+  res := make([]SessionMeta, 0)
+  for _, token := range s.userTokens(userID) {
+    item, ok := s.getItem(token)
+    if !ok || item.Meta.UserID != userID {
+      if glog.V(9) {
+        glog.Infof("DBG: SESSION: INDEX: drop expired session (user=%v, token=%v)", userID, token)
+      }
+      s.unindex(userID, token)
+      if !ok {
+        s.emit(EventSessionExpired, token, &sessionItem{User: base.User{ID: userID}, Meta: SessionMeta{Token: token, UserID: userID}})
+      }
+      continue
+    }
+    meta := item.Meta
+    meta.Token = token
+    res = append(res, meta)
+  }
+  sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+  return res
+}
+
+// RevokeUserSessions destroys all sessions of the user except exceptToken
+// and returns the number of destroyed sessions
+func (s *Session) RevokeUserSessions(userID uuid.UUID, exceptToken string) int {
+  cnt := 0
+  for _, token := range s.userTokens(userID) {
+    if token == exceptToken {
+      continue
+    }
+    if item, ok := s.remove(token); ok {
+      s.emit(EventSessionRevoked, token, item)
+      cnt++
+    }
+    s.unindex(userID, token)
+  }
+  if glog.V(2) {
+    glog.Infof("LOG: SESSION: Revoke sessions (user=%v): %d", userID, cnt)
+  }
+  return cnt
+}
+
+// RevokeUser logs the user out everywhere except exceptToken: destroys the sessions
+// and the remember-me tokens. Use it after the change of the password
+func (s *Session) RevokeUser(userID uuid.UUID, exceptToken string) int {
+  s.ForgetUser(userID)
+  return s.RevokeUserSessions(userID, exceptToken)
+}
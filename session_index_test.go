@@ -0,0 +1,109 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestSessionIndex(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  login := func(ip string, ua string) string {
+    req, _ := http.NewRequest("GET", "/api/v1/login", nil)
+    req.RemoteAddr = ip + ":34567"
+    req.Header.Set("User-Agent", ua)
+    rr := httptest.NewRecorder()
+    token, _ := s.HTTPUserLoginToken(rr, s.HTTPStart(rr, req), &info)
+    return token
+  }
+
+  assert.Equal(t, 0, len(s.ListUserSessions(uid)))
+
+  token1 := login("10.0.0.1", "Firefox")
+  token2 := login("10.0.0.2", "Chrome")
+  token3 := login("10.0.0.3", "Safari")
+
+  list := s.ListUserSessions(uid)
+  assert.Equal(t, 3, len(list))
+  assert.Equal(t, token1, list[0].Token)
+  assert.Equal(t, "10.0.0.1", list[0].IP)
+  assert.Equal(t, "Firefox", list[0].UserAgent)
+  assert.Equal(t, uid, list[0].UserID)
+  assert.False(t, list[0].Created.IsZero())
+  assert.False(t, list[0].LastSeen.IsZero())
+
+  // Expired session disappears from the index
+  s.sessions.Remove(token3)
+  list = s.ListUserSessions(uid)
+  assert.Equal(t, 2, len(list))
+
+  // Logout removes the session from the index
+  s.HTTPUserLogout(httptest.NewRecorder(), token2)
+  list = s.ListUserSessions(uid)
+  assert.Equal(t, 1, len(list))
+  assert.Equal(t, token1, list[0].Token)
+
+  token4 := login("10.0.0.4", "Opera")
+  assert.Equal(t, 2, len(s.ListUserSessions(uid)))
+
+  // The expired session in the index is not counted
+  token5 := login("10.0.0.5", "Edge")
+  s.sessions.Remove(token5)
+
+  assert.Equal(t, 1, s.RevokeUserSessions(uid, token4))
+  list = s.ListUserSessions(uid)
+  assert.Equal(t, 1, len(list))
+  assert.Equal(t, token4, list[0].Token)
+
+  user, ok := s.GetUserInfo(token1)
+  assert.False(t, ok)
+  assert.Nil(t, user)
+  user, ok = s.GetUserInfo(token4)
+  assert.True(t, ok)
+  assert.Equal(t, "Max", user.Login)
+
+  assert.Equal(t, 1, s.RevokeUserSessions(uid, ""))
+  assert.Equal(t, 0, len(s.ListUserSessions(uid)))
+
+  s.Close()
+}
+
+func TestSessionIndexShared(t *testing.T) {
+  // Two processes with the same store
+  store := NewMemoryStore(0)
+  s1 := NewSessions()
+  assert.True(t, s1.InitStore(store, 0))
+  s2 := NewSessions()
+  assert.True(t, s2.InitStore(store, 0))
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+  token1, err := s1.HTTPUserLoginToken(httptest.NewRecorder(), "", &info)
+  assert.Nil(t, err)
+  token2, err := s2.HTTPUserLoginToken(httptest.NewRecorder(), "", &info)
+  assert.Nil(t, err)
+
+  list := s2.ListUserSessions(uid)
+  assert.Equal(t, 2, len(list))
+  assert.Equal(t, token1, list[0].Token)
+  assert.Equal(t, token2, list[1].Token)
+
+  assert.Equal(t, 1, s2.RevokeUserSessions(uid, token2))
+  _, ok := s1.GetUserInfo(token1)
+  assert.False(t, ok)
+  assert.Equal(t, 1, len(s1.ListUserSessions(uid)))
+
+  s1.Close()
+  s2.Close()
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+  "strings"
+  "github.com/golang/glog"
+  "github.com/google/uuid"
+)
+
+const (
+  // Login is refused when the user already has max sessions
+  SessionLimitReject = "reject"
+  // The oldest sessions of the user are destroyed to make room for the new one
+  SessionLimitEvictOldest = "evict_oldest"
+)
+
+// SetMaxSessions limits the number of simultaneous sessions of one user.
+// max <= 0 disables the limit. The sessions are counted by the index in the store,
+// so the processes with the same store share the limit; the logins at the same moment
+// in different processes are not serialized and may pass the limit by one
+func (s *Session) SetMaxSessions(max int, policy string) bool {
+  policy = strings.ToLower(policy)
+  switch policy {
+    case "":
+      policy = SessionLimitReject
+    case SessionLimitReject, SessionLimitEvictOldest:
+    default:
+      glog.Errorf("ERR: SESSION: Unknown max sessions policy '%s'", policy)
+      return false
+  }
+  if max > 0 && s.cookie != nil {
+    glog.Errorf("ERR: SESSION: Max sessions is not supported in cookie mode")
+    return false
+  }
+  s.muLogin.Lock()
+  s.maxSessions = max
+  s.maxSessionsPolicy = policy
+  s.muLogin.Unlock()
+  return true
+}
+
+// checkMaxSessions applies the policy before sessionToken becomes a session of the user
+func (s *Session) checkMaxSessions(userID uuid.UUID, sessionToken string) error {
+  if s.maxSessions <= 0 || userID == uuid.Nil {
+    return nil
+  }
+  active := make([]SessionMeta, 0)
+  for _, meta := range s.ListUserSessions(userID) {
+    if meta.Token != sessionToken {
+      active = append(active, meta)
+    }
+  }
+  if len(active) < s.maxSessions {
+    return nil
+  }
+  if s.maxSessionsPolicy != SessionLimitEvictOldest {
+    glog.Warningf("WRN: SESSION: User %v has too many sessions (%d, max=%d)", userID, len(active), s.maxSessions)
+    return ErrTooManySessions
+  }
+  // ListUserSessions returns the oldest sessions first
+  for _, meta := range active[:len(active) - s.maxSessions + 1] {
+    if glog.V(2) {
+      glog.Infof("LOG: SESSION: Evict session of user %v (created=%v)", userID, meta.Created)
+    }
+    if item, ok := s.remove(meta.Token); ok {
+      s.emit(EventSessionEvicted, meta.Token, item)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestSessionLimit(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, ErrSessionNotInit, s.HTTPUserLogin(httptest.NewRecorder(), "", &base.User{}))
+
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+  assert.Equal(t, false, s.SetMaxSessions(2, "unknown"))
+  assert.Equal(t, true, s.SetMaxSessions(2, ""))
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  login := func(token string) string {
+    token, err := s.HTTPUserLoginToken(httptest.NewRecorder(), token, &info)
+    assert.Nil(t, err)
+    return token
+  }
+
+  token1 := login("token1")
+  token2 := login("token2")
+  // Repeated login into the same session is not a new session
+  token2 = login(token2)
+  _, err := s.HTTPUserLoginToken(httptest.NewRecorder(), "token3", &info)
+  assert.Equal(t, ErrTooManySessions, err)
+  assert.Equal(t, false, s.Find("token3"))
+  assert.Equal(t, 2, len(s.ListUserSessions(uid)))
+
+  // Other users are not limited by the sessions of Max
+  uid2, _ := uuid.Parse("00000002-0003-0004-0005-000000000002")
+  assert.Nil(t, s.HTTPUserLogin(httptest.NewRecorder(), "token4", &base.User{ID: uid2, Login: "Alex", EMail: "alex@aaa.ru"}))
+
+  s.HTTPUserLogout(httptest.NewRecorder(), token1)
+  token3 := login("token3")
+
+  assert.Equal(t, true, s.SetMaxSessions(2, SessionLimitEvictOldest))
+  token5 := login("token5")
+  list := s.ListUserSessions(uid)
+  assert.Equal(t, 2, len(list))
+  assert.Equal(t, token3, list[0].Token)
+  assert.Equal(t, token5, list[1].Token)
+  _, ok := s.GetUserInfo(token2)
+  assert.Equal(t, false, ok)
+
+  assert.Equal(t, true, s.SetMaxSessions(0, ""))
+  assert.Nil(t, s.HTTPUserLogin(httptest.NewRecorder(), "token6", &info))
+  assert.Equal(t, 3, len(s.ListUserSessions(uid)))
+
+  s.Close()
+}
+
+func TestSessionInitConfig(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, true, s.InitConfig(&SessionInfo{Mode: "mutexmap", Expiry_time: 100, Max_sessions: 1}))
+  assert.Equal(t, "mutexmap", s.Mode())
+  assert.Equal(t, SessionLimitReject, s.maxSessionsPolicy)
+
+  s.Close()
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+  "sync"
+  "time"
+  "encoding/json"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-cache"
+)
+
+// FakeClock is a manual clock for the tests of the session expiry
+type FakeClock struct {
+  now      time.Time
+  mu       sync.Mutex
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+  return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.now
+}
+
+func (c *FakeClock) Add(d time.Duration) {
+  c.mu.Lock()
+  c.now = c.now.Add(d)
+  c.mu.Unlock()
+}
+
+type memoryItem struct {
+  value    []byte
+  expires  time.Time
+}
+
+// MemoryStore is an in-process cache.ICache for the sessions.
+// Values are kept as JSON like in redis, so the tests see the same types.
+// Set sweeps the expired items once in ttl, the abandoned sessions do not stay forever
+type MemoryStore struct {
+  items    map[string]memoryItem
+  ttl      time.Duration
+  now      func() time.Time
+  // The time of the next sweep
+  sweepAt  time.Time
+  mu       sync.Mutex
+}
+
+var _ cache.ICache = (*MemoryStore)(nil)
+
+// NewMemoryStore makes a store with the items living for ttl, ttl <= 0 disables the expiry
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+  return &MemoryStore{items: make(map[string]memoryItem), ttl: ttl, now: time.Now}
+}
+
+// SetClock replaces time.Now, f.e. with FakeClock.Now
+func (m *MemoryStore) SetClock(now func() time.Time) {
+  m.mu.Lock()
+  m.now = now
+  m.mu.Unlock()
+}
+
+func (m *MemoryStore) HasError() bool {
+  return false
+}
+
+func (m *MemoryStore) GetMode() string {
+  return "memory"
+}
+
+func (m *MemoryStore) Set(k string, obj interface{}) {
+  value, err := json.Marshal(obj)
+  if err != nil {
+    glog.Errorf("ERR: MEMORY: JSON %s\n", err)
+    return
+  }
+  m.mu.Lock()
+  item := memoryItem{value: value}
+  if m.ttl > 0 {
+    now := m.now()
+    item.expires = now.Add(m.ttl)
+    if !now.Before(m.sweepAt) {
+      m.sweep()
+      m.sweepAt = item.expires
+    }
+  }
+  m.items[k] = item
+  m.mu.Unlock()
+}
+
+// sweep removes the expired items
+func (m *MemoryStore) sweep() {
+  for k := range m.items {
+    m.get(k)
+  }
+}
+
+// get returns the item when it is not expired, expired items are removed
+func (m *MemoryStore) get(k string) (memoryItem, bool) {
+  item, ok := m.items[k]
+  if !ok {
+    return item, false
+  }
+  if !item.expires.IsZero() && !m.now().Before(item.expires) {
+    delete(m.items, k)
+    return item, false
+  }
+  return item, true
+}
+
+func (m *MemoryStore) Get(k string, obj interface{}) (interface{}, bool) {
+  m.mu.Lock()
+  item, ok := m.get(k)
+  m.mu.Unlock()
+  if !ok {
+    return nil, false
+  }
+  if err := json.Unmarshal(item.value, obj); err != nil {
+    glog.Errorf("ERR: MEMORY: GET: %s\n", err)
+    return nil, false
+  }
+  return obj, true
+}
+
+func (m *MemoryStore) Check(k string) bool {
+  m.mu.Lock()
+  _, ok := m.get(k)
+  m.mu.Unlock()
+  return ok
+}
+
+func (m *MemoryStore) Remove(k string) {
+  m.mu.Lock()
+  delete(m.items, k)
+  m.mu.Unlock()
+}
+
+func (m *MemoryStore) Clear() {
+  m.mu.Lock()
+  m.items = make(map[string]memoryItem)
+  m.mu.Unlock()
+}
+
+func (m *MemoryStore) Count() int64 {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.sweep()
+  return int64(len(m.items))
+}
+
+func (m *MemoryStore) Close() {
+}
+
+// InitStore uses the store for the sessions instead of the one made by cache.New.
+// The index of the sessions of the users is kept in the store too (see indexKeyPrefix)
+func (s *Session) InitStore(store cache.ICache, expiryTime int64) bool {
+  s.Close()
+  s.sessions = store
+  s.index = store
+  s.expiryTimeDuration = time.Duration(expiryTime) * time.Second
+  glog.Infof("LOG: SESSION: Mode is %s", s.sessions.GetMode())
+  return !s.sessions.HasError()
+}
+
+// MemoryStore returns the store of the sessions in "memory" mode
+func (s *Session) MemoryStore() (*MemoryStore, bool) {
+  m, ok := s.sessions.(*MemoryStore)
+  return m, ok
+}
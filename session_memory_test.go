@@ -0,0 +1,110 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "time"
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestMemoryStore(t *testing.T) {
+  clock := NewFakeClock(time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC))
+  m := NewMemoryStore(time.Minute)
+  m.SetClock(clock.Now)
+
+  m.Set("k1", base.User{Login: "Max"})
+  assert.Equal(t, true, m.Check("k1"))
+  assert.Equal(t, int64(1), m.Count())
+
+  var u base.User
+  res, ok := m.Get("k1", &u)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", res.(*base.User).Login)
+
+  clock.Add(59 * time.Second)
+  assert.Equal(t, true, m.Check("k1"))
+  clock.Add(time.Second)
+  assert.Equal(t, false, m.Check("k1"))
+  _, ok = m.Get("k1", &u)
+  assert.Equal(t, false, ok)
+  assert.Equal(t, int64(0), m.Count())
+
+  m.Set("k2", 1)
+  m.Remove("k2")
+  assert.Equal(t, false, m.Check("k2"))
+  m.Set("k3", 1)
+  m.Clear()
+  assert.Equal(t, int64(0), m.Count())
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+  clock := NewFakeClock(time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC))
+  m := NewMemoryStore(time.Minute)
+  m.SetClock(clock.Now)
+
+  m.Set("k1", 1)
+  m.Set("k2", 2)
+  clock.Add(30 * time.Second)
+  m.Set("k3", 3)
+  assert.Equal(t, 3, len(m.items))
+  // k1 and k2 have expired
+  clock.Add(40 * time.Second)
+  m.Set("k4", 4)
+  assert.Equal(t, 2, len(m.items))
+  assert.Equal(t, true, m.Check("k3"))
+
+  // The abandoned items are swept without the reads
+  clock.Add(2 * time.Minute)
+  m.Set("k5", 5)
+  assert.Equal(t, 1, len(m.items))
+}
+
+func TestHTTPMemoryStore(t *testing.T) {
+  s := NewSessions()
+  assert.Equal(t, true, s.Init("memory", 600, "", 0))
+  assert.Equal(t, "memory", s.Mode())
+  m, ok := s.MemoryStore()
+  assert.Equal(t, true, ok)
+  clock := NewFakeClock(time.Now())
+  m.SetClock(clock.Now)
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru", Groups: []string{"Users"}}
+
+  req, _ := http.NewRequest("GET", "/api/v1/login", nil)
+  rr := httptest.NewRecorder()
+  token := s.HTTPStart(rr, req)
+  assert.Equal(t, int64(1), s.Count())
+  token, err := s.HTTPUserLoginToken(rr, token, &info)
+  assert.Nil(t, err)
+  assert.Equal(t, int64(1), s.Count())
+  assert.Nil(t, s.SetData(token, "cart", []int{1, 2}))
+
+  req, _ = http.NewRequest("GET", "/api/v1/iam", nil)
+  req.AddCookie(lastCookie(rr, "__session"))
+  user, ok := s.HTTPUserInfo(httptest.NewRecorder(), req)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, info.Login, user.Login)
+  assert.Equal(t, info.Groups, user.Groups)
+  var cart []int
+  assert.Equal(t, true, s.GetData(token, "cart", &cart))
+  assert.Equal(t, []int{1, 2}, cart)
+  assert.Equal(t, 1, len(s.ListUserSessions(uid)))
+
+  // The session expires
+  clock.Add(11 * time.Minute)
+  user, ok = s.HTTPUserInfo(httptest.NewRecorder(), req)
+  assert.Equal(t, false, ok)
+  assert.Nil(t, user)
+  assert.Equal(t, 0, len(s.ListUserSessions(uid)))
+  assert.Equal(t, int64(0), s.Count())
+
+  s.Close()
+  _, ok = s.MemoryStore()
+  assert.Equal(t, false, ok)
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+  "net"
+  "strings"
+  "net/http"
+  "github.com/golang/glog"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+const (
+  // The session is marked as suspicious and the callback is called
+  PolicyActionFlag = "flag"
+  // The session is destroyed and the user has to log in again
+  PolicyActionInvalidate = "invalidate"
+)
+
+// SessionPolicy binds the session to the client which created it
+type SessionPolicy struct {
+  Bind_user_agent   bool     `yaml:"bind_user_agent"`
+  // The IP of the client may change inside the network prefix, 0 disables the check of the family.
+  // With any prefix set the switch between IPv4 and IPv6 is the move out of the network,
+  // with both 0 the IP is not checked at all
+  IPv4_prefix       int      `yaml:"ipv4_prefix"`
+  IPv6_prefix       int      `yaml:"ipv6_prefix"`
+  Action            string   `yaml:"action"`
+  // The IP of the client is taken from X-Forwarded-For
+  Trust_proxy       bool     `yaml:"trust_proxy"`
+  // IPs or CIDRs of the proxies, X-Forwarded-For is read only from them
+  // and these hops are skipped. Empty: the rightmost hop is the client
+  Trusted_proxies   []string `yaml:"trusted_proxies"`
+
+  proxies           []*net.IPNet
+}
+
+type SessionAnomaly struct {
+  Meta              SessionMeta
+  User              base.User
+  IP                string
+  UserAgent         string
+  Reason            string
+  Invalidated       bool
+}
+
+func (s *Session) SetPolicy(policy *SessionPolicy) bool {
+  p := *policy
+  p.Action = strings.ToLower(p.Action)
+  switch p.Action {
+    case "":
+      p.Action = PolicyActionFlag
+    case PolicyActionFlag, PolicyActionInvalidate:
+    default:
+      glog.Errorf("ERR: SESSION: Unknown policy action '%s'", p.Action)
+      return false
+  }
+  if p.IPv4_prefix < 0 || p.IPv4_prefix > 32 || p.IPv6_prefix < 0 || p.IPv6_prefix > 128 {
+    glog.Errorf("ERR: SESSION: Bad policy prefix (ipv4=%d, ipv6=%d)", p.IPv4_prefix, p.IPv6_prefix)
+    return false
+  }
+  p.proxies = nil
+  for _, proxy := range p.Trusted_proxies {
+    if !strings.Contains(proxy, "/") {
+      if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+        proxy += "/32"
+      } else {
+        proxy += "/128"
+      }
+    }
+    _, network, err := net.ParseCIDR(proxy)
+    if err != nil {
+      glog.Errorf("ERR: SESSION: Bad trusted proxy '%s': %v", proxy, err)
+      return false
+    }
+    p.proxies = append(p.proxies, network)
+  }
+  s.policy = p
+  return true
+}
+
+// OnAnomaly sets the callback called when the client of a session changes
+func (s *Session) OnAnomaly(fn func(a *SessionAnomaly)) {
+  s.onAnomaly = fn
+}
+
+func (p *SessionPolicy) enabled() bool {
+  return p.Bind_user_agent || p.IPv4_prefix > 0 || p.IPv6_prefix > 0
+}
+
+// trustedProxy checks that ip is one of the trusted proxies
+func (p *SessionPolicy) trustedProxy(ip string) bool {
+  addr := net.ParseIP(ip)
+  if addr == nil {
+    return false
+  }
+  for _, network := range p.proxies {
+    if network.Contains(addr) {
+      return true
+    }
+  }
+  return false
+}
+
+// sameNetwork checks that both IPs are inside one network prefix
+func (p *SessionPolicy) sameNetwork(ip1 string, ip2 string) bool {
+  a := net.ParseIP(ip1)
+  b := net.ParseIP(ip2)
+  if a == nil || b == nil {
+    return ip1 == ip2
+  }
+  if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+    if a4 == nil || b4 == nil {
+      return false
+    }
+    if p.IPv4_prefix == 0 {
+      return true
+    }
+    mask := net.CIDRMask(p.IPv4_prefix, 32)
+    return a4.Mask(mask).Equal(b4.Mask(mask))
+  }
+  if p.IPv6_prefix == 0 {
+    return true
+  }
+  mask := net.CIDRMask(p.IPv6_prefix, 128)
+  return a.Mask(mask).Equal(b.Mask(mask))
+}
+
+// checkClient compares the client of the request with the client of the session,
+// it returns false when the session is invalidated
+func (s *Session) checkClient(w http.ResponseWriter, r *http.Request, sessionToken string) bool {
+  if !s.policy.enabled() {
+    return true
+  }
+  item, ok := s.getItem(sessionToken)
+  if !ok {
+    return true
+  }
+  ip := s.clientIP(r)
+  ua := r.UserAgent()
+  if item.Meta.IP == "" && item.Meta.UserAgent == "" {
+    // The session was created without the request, the first client owns it
+    s.httpUpdateItem(w, r, func(item *sessionItem) error {
+      item.Meta.IP = ip
+      item.Meta.UserAgent = ua
+      return nil
+    })
+    return true
+  }
+  reasons := []string{}
+  if s.policy.Bind_user_agent && item.Meta.UserAgent != ua {
+    reasons = append(reasons, "user agent changed")
+  }
+  if (s.policy.IPv4_prefix > 0 || s.policy.IPv6_prefix > 0) && !s.policy.sameNetwork(item.Meta.IP, ip) {
+    reasons = append(reasons, "ip moved out of the network")
+  }
+  if len(reasons) == 0 {
+    return true
+  }
+  anomaly := &SessionAnomaly{
+    Meta:        item.Meta,
+    User:        item.User,
+    IP:          ip,
+    UserAgent:   ua,
+    Reason:      strings.Join(reasons, ", "),
+    Invalidated: s.policy.Action == PolicyActionInvalidate,
+  }
+  glog.Warningf("WRN: SESSION: Anomaly (user=%v, ip=%s->%s): %s", item.Meta.UserID, item.Meta.IP, ip, anomaly.Reason)
+  if anomaly.Invalidated {
+    if item.Remember != "" {
+      s.forgetRemember(item.Remember)
+      s.clearRememberCookie(w)
+    }
+    if s.cookie != nil {
+      if newToken, _, _, err := s.storeLogout(w, sessionToken); err == nil {
+        s.SetToken(w, newToken)
+      }
+    } else {
+      s.remove(sessionToken)
+    }
+    s.emit(EventSessionRevoked, sessionToken, item)
+  } else if item.Meta.Suspicious {
+    // The session is already reported
+    return true
+  } else {
+    s.httpUpdateItem(w, r, func(item *sessionItem) error {
+      item.Meta.Suspicious = true
+      return nil
+    })
+  }
+  if s.onAnomaly != nil {
+    s.onAnomaly(anomaly)
+  }
+  return !anomaly.Invalidated
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestSessionPolicyNetwork(t *testing.T) {
+  p := SessionPolicy{IPv4_prefix: 24, IPv6_prefix: 64}
+  assert.Equal(t, true, p.sameNetwork("10.0.0.1", "10.0.0.200"))
+  assert.Equal(t, false, p.sameNetwork("10.0.0.1", "10.0.1.1"))
+  assert.Equal(t, true, p.sameNetwork("2001:db8::1", "2001:db8::ffff"))
+  assert.Equal(t, false, p.sameNetwork("2001:db8:0:1::1", "2001:db8:0:2::1"))
+  assert.Equal(t, false, p.sameNetwork("10.0.0.1", "2001:db8::1"))
+
+  p = SessionPolicy{}
+  assert.Equal(t, true, p.sameNetwork("10.0.0.1", "192.168.0.1"))
+
+  s := NewSessions()
+  assert.Equal(t, false, s.SetPolicy(&SessionPolicy{Action: "kill"}))
+  assert.Equal(t, false, s.SetPolicy(&SessionPolicy{IPv4_prefix: 33}))
+  assert.Equal(t, true, s.SetPolicy(&SessionPolicy{IPv4_prefix: 16}))
+  assert.Equal(t, PolicyActionFlag, s.policy.Action)
+}
+
+func TestSessionPolicy(t *testing.T) {
+  s := NewSessions()
+  s.Init("mutexmap", 10000, "", 100)
+  s.DestroyAll()
+
+  var anomalies []*SessionAnomaly
+  s.OnAnomaly(func(a *SessionAnomaly) {
+    anomalies = append(anomalies, a)
+  })
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  newRequest := func(ip string, ua string, cookie *http.Cookie) *http.Request {
+    req, _ := http.NewRequest("GET", "/iam", nil)
+    req.RemoteAddr = ip + ":45678"
+    req.Header.Set("User-Agent", ua)
+    if cookie != nil {
+      req.AddCookie(cookie)
+    }
+    return req
+  }
+  login := func() *http.Cookie {
+    rr := httptest.NewRecorder()
+    token := s.HTTPStart(rr, newRequest("10.0.0.1", "Firefox", nil))
+    s.HTTPUserLogin(rr, token, &info)
+    return lastCookie(rr, "__session")
+  }
+
+  // Flag
+  assert.Equal(t, true, s.SetPolicy(&SessionPolicy{Bind_user_agent: true, IPv4_prefix: 24}))
+  cookie := login()
+  _, ok := s.HTTPUserInfo(httptest.NewRecorder(), newRequest("10.0.0.7", "Firefox", cookie))
+  assert.Equal(t, true, ok)
+  assert.Equal(t, 0, len(anomalies))
+
+  _, ok = s.HTTPUserInfo(httptest.NewRecorder(), newRequest("10.0.0.7", "Chrome", cookie))
+  assert.Equal(t, true, ok)
+  assert.Equal(t, 1, len(anomalies))
+  assert.Equal(t, "user agent changed", anomalies[0].Reason)
+  assert.Equal(t, "Max", anomalies[0].User.Login)
+  assert.Equal(t, false, anomalies[0].Invalidated)
+  assert.Equal(t, true, s.ListUserSessions(uid)[0].Suspicious)
+
+  // The suspicious session is reported once
+  _, ok = s.HTTPUserInfo(httptest.NewRecorder(), newRequest("10.0.0.7", "Chrome", cookie))
+  assert.Equal(t, true, ok)
+  assert.Equal(t, 1, len(anomalies))
+
+  // Invalidate
+  assert.Equal(t, true, s.SetPolicy(&SessionPolicy{IPv4_prefix: 24, Action: "invalidate"}))
+  cookie = login()
+  assert.Equal(t, true, s.HTTPCheck(httptest.NewRecorder(), newRequest("10.0.0.9", "Chrome", cookie)))
+  _, ok = s.HTTPUserInfo(httptest.NewRecorder(), newRequest("10.1.0.1", "Firefox", cookie))
+  assert.Equal(t, false, ok)
+  assert.Equal(t, 2, len(anomalies))
+  assert.Equal(t, "ip moved out of the network", anomalies[1].Reason)
+  assert.Equal(t, true, anomalies[1].Invalidated)
+  _, ok = s.HTTPUserInfo(httptest.NewRecorder(), newRequest("10.0.0.1", "Firefox", cookie))
+  assert.Equal(t, false, ok)
+
+  // No prefixes: the IP is not checked, even the switch to IPv6
+  assert.Equal(t, true, s.SetPolicy(&SessionPolicy{Bind_user_agent: true, Action: "invalidate"}))
+  cookie = login()
+  _, ok = s.HTTPUserInfo(httptest.NewRecorder(), newRequest("[2001:db8::1]", "Firefox", cookie))
+  assert.Equal(t, true, ok)
+  assert.Equal(t, 2, len(anomalies))
+  // Any prefix: the switch of the family is the move out of the network
+  assert.Equal(t, true, s.SetPolicy(&SessionPolicy{IPv4_prefix: 24, Action: "invalidate"}))
+  cookie = login()
+  _, ok = s.HTTPUserInfo(httptest.NewRecorder(), newRequest("[2001:db8::1]", "Firefox", cookie))
+  assert.Equal(t, false, ok)
+  assert.Equal(t, 3, len(anomalies))
+  assert.Equal(t, "ip moved out of the network", anomalies[2].Reason)
+
+  // Proxy
+  assert.Equal(t, true, s.SetPolicy(&SessionPolicy{IPv4_prefix: 32, Trust_proxy: true}))
+  req := newRequest("192.168.1.1", "Firefox", nil)
+  req.Header.Set("X-Forwarded-For", "10.0.0.1")
+  assert.Equal(t, "10.0.0.1", s.clientIP(req))
+  // The forged hops on the left are ignored
+  req.Header.Set("X-Forwarded-For", "6.6.6.6, 10.0.0.1")
+  assert.Equal(t, "10.0.0.1", s.clientIP(req))
+  req.Header.Set("X-Forwarded-For", "")
+  assert.Equal(t, "192.168.1.1", s.clientIP(req))
+
+  assert.Equal(t, false, s.SetPolicy(&SessionPolicy{Trust_proxy: true, Trusted_proxies: []string{"192.168.1.0/33"}}))
+  assert.Equal(t, true, s.SetPolicy(&SessionPolicy{IPv4_prefix: 32, Trust_proxy: true, Trusted_proxies: []string{"192.168.1.0/24", "172.16.0.5"}}))
+  req.Header.Set("X-Forwarded-For", "6.6.6.6, 10.0.0.1, 172.16.0.5")
+  assert.Equal(t, "10.0.0.1", s.clientIP(req))
+  req.Header.Set("X-Forwarded-For", "6.6.6.6")
+  req.Header.Add("X-Forwarded-For", "10.0.0.1, 192.168.1.7")
+  assert.Equal(t, "10.0.0.1", s.clientIP(req))
+  // The header from the client which is not a trusted proxy is ignored
+  req = newRequest("10.0.0.9", "Firefox", nil)
+  req.Header.Set("X-Forwarded-For", "10.0.0.1")
+  assert.Equal(t, "10.0.0.9", s.clientIP(req))
+
+  s.Close()
+}
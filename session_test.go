@@ -122,6 +122,10 @@ func TestHTTPMemory(t *testing.T) {
 
   s.HTTPUserLogin(rr, token, &info)
   assert.Equal(t, int64(1), s.Count())
+  // The token is changed at login
+  cookie = lastCookie(rr, "__session")
+  assert.NotEqual(t, token_begin, cookie.Value)
+  assert.Equal(t, false, s.Find(token_begin))
 
   req, err = http.NewRequest("GET", "/api/v1/iam", nil)
   assert.Nil(t, err)
@@ -146,7 +150,7 @@ func TestHTTPMemory(t *testing.T) {
 
   token = s.GetToken(rr, req)
   
-  assert.Equal(t, token_begin, token)
+  assert.Equal(t, cookie.Value, token)
 
   s.HTTPUserLogout(rr, token)
 
@@ -209,7 +213,13 @@ func TestHTTPRedis(t *testing.T) {
   glog.Infof("LOG: SessionHTTPUserLogin: (user = %v)\n", info)
   s.HTTPUserLogin(rr, token, &info)
 
+  // The index of the user is in the other database
   assert.Equal(t, int64(1), s.Count())
+  assert.Equal(t, 1, len(s.ListUserSessions(uid)))
+  // The token is changed at login
+  cookie = lastCookie(rr, "__session")
+  assert.NotEqual(t, token_begin, cookie.Value)
+  assert.Equal(t, false, s.Find(token_begin))
 
   req, err = http.NewRequest("GET", "/api/v1/iam", nil)
   assert.Nil(t, err)
@@ -228,7 +238,7 @@ func TestHTTPRedis(t *testing.T) {
   rr = httptest.NewRecorder()
 
   token = s.GetToken(rr, req)
-  assert.Equal(t, token_begin, token)
+  assert.Equal(t, cookie.Value, token)
   glog.Infof("LOG: SessionHTTPUserLogout: (token = %v)\n", token)
   s.HTTPUserLogout(rr, token)
 
@@ -245,3 +255,10 @@ func TestHTTPRedis(t *testing.T) {
 
   s.Close()
 }
+
+func TestSessionStoreURL(t *testing.T) {
+  assert.Equal(t, "redis://localhost:6379/1", storeURL("redis", "redis://localhost:6379/0", indexDBOffset))
+  assert.Equal(t, "redis://localhost:6379/5", storeURL("redis", "redis://localhost:6379/3", rememberDBOffset))
+  assert.Equal(t, "redis://:pwd@localhost:6379/1", storeURL("redis", "redis://:pwd@localhost:6379", indexDBOffset))
+  assert.Equal(t, "aerospike://localhost:3000/test", storeURL("aerospike", "aerospike://localhost:3000/test", indexDBOffset))
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+  "strings"
+  "net/http"
+  "github.com/golang/glog"
+)
+
+const (
+  TokenFromCookie = "cookie"
+  // Authorization: Bearer <token>
+  TokenFromBearer = "bearer"
+  // header:<Name>
+  TokenFromHeader = "header"
+  // query:<name>, f.e. for the websockets
+  TokenFromQuery  = "query"
+)
+
+type tokenSource struct {
+  kind       string
+  name       string
+}
+
+var defaultTokenLookup = []tokenSource{{kind: TokenFromCookie}}
+
+func (t *tokenSource) get(r *http.Request, tokenName string) string {
+  switch t.kind {
+    case TokenFromCookie:
+      name := t.name
+      if name == "" {
+        name = tokenName
+      }
+      if c, err := r.Cookie(name); err == nil {
+        return c.Value
+      }
+    case TokenFromBearer:
+      auth := r.Header.Get("Authorization")
+      if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+        return strings.TrimSpace(auth[7:])
+      }
+    case TokenFromHeader:
+      return r.Header.Get(t.name)
+    case TokenFromQuery:
+      return r.URL.Query().Get(t.name)
+  }
+  return ""
+}
+
+// SetTokenLookup sets the sources of the session token in the order they are tried:
+// "cookie", "cookie:<name>", "bearer", "header:<name>", "query:<name>"
+func (s *Session) SetTokenLookup(lookup ...string) bool {
+  res := make([]tokenSource, 0, len(lookup))
+  for _, item := range lookup {
+    parts := strings.SplitN(item, ":", 2)
+    src := tokenSource{kind: strings.ToLower(strings.TrimSpace(parts[0]))}
+    if len(parts) > 1 {
+      src.name = strings.TrimSpace(parts[1])
+    }
+    switch src.kind {
+      case TokenFromCookie, TokenFromBearer:
+      case TokenFromHeader, TokenFromQuery:
+        if src.name == "" {
+          glog.Errorf("ERR: SESSION: Token lookup '%s' has no name", item)
+          return false
+        }
+      default:
+        glog.Errorf("ERR: SESSION: Unknown token lookup '%s'", item)
+        return false
+    }
+    res = append(res, src)
+  }
+  s.tokenLookup = res
+  return true
+}
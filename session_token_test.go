@@ -0,0 +1,103 @@
+package auth
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+
+  "net/http"
+  "net/http/httptest"
+  "github.com/google/uuid"
+
+  "github.com/Lunkov/lib-auth/base"
+)
+
+func TestSessionTokenLookup(t *testing.T) {
+  s := NewSessions()
+  s.Init("memory", 10000, "", 0)
+
+  assert.Equal(t, false, s.SetTokenLookup("header"))
+  assert.Equal(t, false, s.SetTokenLookup("form:token"))
+  assert.Equal(t, true, s.SetTokenLookup("bearer", "header:X-Session-Token", "query:token", "cookie"))
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+  req, _ := http.NewRequest("GET", "/login", nil)
+  rr := httptest.NewRecorder()
+  token, err := s.HTTPUserLoginToken(rr, s.HTTPStart(rr, req), &info)
+  assert.Nil(t, err)
+
+  check := func(req *http.Request) bool {
+    rr := httptest.NewRecorder()
+    user, ok := s.HTTPUserInfo(rr, req)
+    assert.Equal(t, ok, s.HTTPCheck(rr, req))
+    return ok && user.Login == "Max"
+  }
+
+  req, _ = http.NewRequest("GET", "/iam", nil)
+  assert.Equal(t, false, check(req))
+  req.Header.Set("Authorization", "Bearer " + token)
+  assert.Equal(t, true, check(req))
+
+  req, _ = http.NewRequest("GET", "/iam", nil)
+  req.Header.Set("X-Session-Token", token)
+  assert.Equal(t, true, check(req))
+
+  req, _ = http.NewRequest("GET", "/ws?token=" + token, nil)
+  assert.Equal(t, true, check(req))
+
+  req, _ = http.NewRequest("GET", "/iam", nil)
+  req.AddCookie(&http.Cookie{Name: "__session", Value: token})
+  assert.Equal(t, true, check(req))
+
+  // The first found source wins
+  req, _ = http.NewRequest("GET", "/ws?token=" + token, nil)
+  req.Header.Set("Authorization", "Bearer unknown")
+  assert.Equal(t, "unknown", s.GetToken(httptest.NewRecorder(), req))
+  assert.Equal(t, false, check(req))
+
+  // HTTPStart finds the session by the header too
+  req, _ = http.NewRequest("GET", "/iam", nil)
+  req.Header.Set("Authorization", "bearer " + token)
+  rr = httptest.NewRecorder()
+  assert.Equal(t, token, s.HTTPStart(rr, req))
+  assert.Equal(t, 0, len(rr.Result().Cookies()))
+
+  // Only the cookie by default
+  assert.Equal(t, true, s.SetTokenLookup())
+  req, _ = http.NewRequest("GET", "/iam", nil)
+  req.Header.Set("Authorization", "Bearer " + token)
+  assert.Equal(t, false, check(req))
+
+  s.Close()
+}
+
+func TestSessionFixation(t *testing.T) {
+  s := NewSessions()
+  s.Init("memory", 10000, "", 0)
+
+  uid, _ := uuid.Parse("00000002-0003-0004-0005-000000000001")
+  info := base.User{ID: uid, Login: "Max", EMail: "max@aaa.ru"}
+
+  // The token planted by an attacker is not adopted
+  req, _ := http.NewRequest("GET", "/login", nil)
+  req.AddCookie(&http.Cookie{Name: "__session", Value: "planted"})
+  rr := httptest.NewRecorder()
+  token := s.HTTPStart(rr, req)
+  assert.NotEqual(t, "planted", token)
+  assert.Equal(t, token, lastCookie(rr, "__session").Value)
+  assert.Equal(t, false, s.Find("planted"))
+
+  // The known token is changed at login
+  rr = httptest.NewRecorder()
+  newToken, err := s.HTTPUserLoginToken(rr, token, &info)
+  assert.Nil(t, err)
+  assert.NotEqual(t, token, newToken)
+  assert.Equal(t, newToken, lastCookie(rr, "__session").Value)
+  assert.Equal(t, false, s.Find(token))
+  user, ok := s.GetUserInfo(newToken)
+  assert.Equal(t, true, ok)
+  assert.Equal(t, "Max", user.Login)
+  assert.Equal(t, 1, len(s.ListUserSessions(uid)))
+
+  s.Close()
+}
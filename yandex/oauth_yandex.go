@@ -1,6 +1,7 @@
 package yandex
 
 import (
+	"context"
 	"net/http"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/yandex"
@@ -44,6 +45,10 @@ func (a *Info) Login(login string, password string) (base.User, bool) {
   user := base.User{}
   return user, false
 }
+
+func (a *Info) LoginContext(ctx context.Context, login string, password string) (base.User, bool) {
+  return a.Login(login, password)
+}
   
 func (a *Info) OAuthLogin(w http.ResponseWriter, r *http.Request) {
 }
@@ -56,3 +61,15 @@ func (a *Info) OAuthGetUserData(code string) ([]byte, error) {
   return buf, nil
 }
 
+func (a *Info) OAuthGetUserDataContext(ctx context.Context, code string) ([]byte, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  return a.OAuthGetUserData(code)
+}
+
+// OAuthExchange converts the authorization code into the token, it is cancelled with ctx
+func (a *Info) OAuthExchange(ctx context.Context, code string) (*oauth2.Token, error) {
+  return a.OAuthCfg.Exchange(ctx, code)
+}
+